@@ -0,0 +1,429 @@
+/*
+ * Whitecat Blocky Environment, embeddable agent
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+The agent is an importable package, so it can be embedded in other programs. All its state is
+owned by an Agent, configured by a Config, and many agents can run in the same process if they
+use different addresses and data folders:
+
+config := agent.DefaultConfig()
+config.DataFolder = "/path/to/data"
+config.Address = "localhost:9080"
+
+a := agent.New(config)
+if err := a.Start(ctx); err != nil {
+	...
+}
+
+defer a.Stop()
+
+The wccagent program is a thin wrapper around an Agent, that adds the tray menu.
+
+*/
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// Version of the agent
+const Version = "2.2"
+
+// Settings of an agent. The fields without a json tag can be set in wccagent.json.
+type Config struct {
+	// "http://whitecatboard.org"
+	BaseURL string
+
+	// "https://raw.githubusercontent.com/whitecatboard/Lua-RTOS-ESP32/master"
+	SupportURL string
+
+	// "http://downloads.whitecatboard.org"
+	DownloadURL string
+
+	// "https://ide.whitecatboard.org"
+	BaseIdeURL string
+
+	// Origins allowed to connect to the agent. Defaults to the origin of BaseIdeURL.
+	AllowedOrigins []string
+
+	// Heartbeat of the websocket connections, in seconds
+	HeartbeatInterval int
+	HeartbeatTimeout  int
+
+	// Address of the gRPC service, host:port or unix:path. Empty disables it.
+	GrpcAddress string
+
+	// Sinks of the agent events, see bus.go
+	EventSinks []EventSinkConfig
+
+	// Address of the websocket server. Empty disables it.
+	Address string
+
+	// Address of the secure websocket server (wss), that serves the IDE
+	// endpoints with the generated certificates. Empty disables it.
+	SecureAddress string
+
+	// Advertise the agent on the LAN with mDNS, see mdns.go. Address or
+	// SecureAddress must not be loopback.
+	LanMode bool
+
+	// Attach the pseudo-terminals sent by the IDE as boards, such as the one of
+	// the Lua RTOS emulator, see transport.go
+	EmulatorDevices bool
+
+	// Folder where the agent keeps its data: the paired tokens, the control
+	// socket, the certificates, and the downloaded files
+	DataFolder string `json:"-"`
+
+	// Time that a session is kept after its client disconnects
+	SessionTimeout time.Duration `json:"-"`
+
+	// Settings of the certificates of the secure websocket server
+	Certificates CertificateOptions `json:"-"`
+}
+
+// Get the default settings
+func DefaultConfig() Config {
+	baseURL := "http://localhost:8082"
+
+	return Config{
+		BaseURL:     baseURL,
+		SupportURL:  baseURL + "/support",
+		DownloadURL: baseURL + "/download",
+		BaseIdeURL:  baseURL + "/ide",
+
+		HeartbeatInterval: 10,
+		HeartbeatTimeout:  30,
+		GrpcAddress:       "localhost:8083",
+		Address:           "localhost:8080",
+		SessionTimeout:    10 * time.Minute,
+		Certificates:      DefaultCertificateOptions(),
+	}
+}
+
+func (config *Config) lastBuildURL() string {
+	return config.BaseURL + "/lastbuildv2.php"
+}
+
+func (config *Config) firmwareURL() string {
+	return config.BaseURL + "/firmwarev2.php"
+}
+
+func (config *Config) supportedBoardsURL() string {
+	return config.SupportURL + "/boards/boards.json"
+}
+
+type Agent struct {
+	config Config
+
+	// Attached boards, in attach order, see boards.go
+	boards      []*Board
+	boardsMutex sync.Mutex
+
+	// Devices that can be a board, as sent by the IDE
+	devices []deviceDef
+
+	// Is the monitor running? ideDetach stops it.
+	monitoring      bool
+	monitoringMutex sync.Mutex
+	ideDetach       chan bool
+
+	// Time monitoring serial ports without success, in milliseconds
+	elapsed int
+
+	// Last connection attempts to the network boards
+	dials map[string]time.Time
+
+	hub *Hub
+	bus *eventBus
+
+	// Is a custom firmware uploaded by the IDE? See transfer.go.
+	customFirmware      bool
+	customFirmwareMutex sync.Mutex
+
+	// Pairing requests waiting for the user approval, and the paired IDEs
+	pairingRequests   chan *PairingRequest
+	pairedTokens      []PairedToken
+	pairedTokensMutex sync.Mutex
+
+	// Modification time and size of the tokens file when it was last read,
+	// or written, by the agent
+	pairedTokensTime time.Time
+	pairedTokensSize int64
+
+	// Servers started by the agent, and the configured event sinks
+	servers      []*http.Server
+	sinks        []*asyncSink
+	serversMutex sync.Mutex
+
+	// mDNS advertiser, in LAN mode
+	mdns *mdnsAdvertiser
+
+	// Certificate of the secure websocket server, see certificates.go
+	certificate      *tls.Certificate
+	certificateMutex sync.Mutex
+
+	// Closed when the agent is stopped
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Create an agent. Missing settings get their default value.
+func New(config Config) *Agent {
+	defaults := DefaultConfig()
+
+	if config.BaseURL == "" {
+		config.BaseURL = defaults.BaseURL
+	}
+
+	if config.SupportURL == "" {
+		config.SupportURL = config.BaseURL + "/support"
+	}
+
+	if config.DownloadURL == "" {
+		config.DownloadURL = config.BaseURL + "/download"
+	}
+
+	if config.BaseIdeURL == "" {
+		config.BaseIdeURL = config.BaseURL + "/ide"
+	}
+
+	if len(config.AllowedOrigins) == 0 {
+		config.AllowedOrigins = []string{config.BaseIdeURL}
+	}
+
+	// An empty Address only disables the plain websocket server when the secure
+	// one is enabled
+	if config.Address == "" && config.SecureAddress == "" {
+		config.Address = defaults.Address
+	}
+
+	if config.SessionTimeout == 0 {
+		config.SessionTimeout = defaults.SessionTimeout
+	}
+
+	config.Certificates = config.Certificates.withDefaults()
+
+	agent := &Agent{
+		config:          config,
+		ideDetach:       make(chan bool),
+		dials:           make(map[string]time.Time),
+		pairingRequests: make(chan *PairingRequest, maxPairingRequests),
+		done:            make(chan struct{}),
+	}
+
+	agent.hub = &Hub{agent: agent}
+
+	// The hub is always subscribed
+	agent.bus = &eventBus{subscriptions: []*subscription{{sink: agent.hub}}}
+
+	return agent
+}
+
+// Get the settings of the agent
+func (agent *Agent) Config() Config {
+	return agent.config
+}
+
+// Folder for the downloaded files
+func (agent *Agent) tmpFolder() string {
+	return path.Join(agent.config.DataFolder, "tmp")
+}
+
+// Start the agent: the websocket servers, the gRPC service, the control socket
+// and the event sinks. The board monitor is started when an IDE attaches. The
+// agent runs until ctx is done, or until Stop is called.
+func (agent *Agent) Start(ctx context.Context) error {
+	if agent.config.DataFolder == "" {
+		return errors.New("DataFolder is required")
+	}
+
+	select {
+	case <-agent.done:
+		return errors.New("agent is stopped")
+	default:
+	}
+
+	if err := os.MkdirAll(agent.tmpFolder(), 0755); err != nil {
+		return err
+	}
+
+	if agent.config.Address == "" && agent.config.SecureAddress == "" {
+		return errors.New("no websocket server address")
+	}
+
+	var advertiser *mdnsAdvertiser
+
+	if agent.config.LanMode {
+		var err error
+
+		if advertiser, err = newMdnsAdvertiser(agent); err != nil {
+			return err
+		}
+	}
+
+	var listener, secureListener net.Listener
+
+	if agent.config.SecureAddress != "" {
+		tlsConfig, err := agent.serverTLSConfig()
+		if err != nil {
+			return err
+		}
+
+		if secureListener, err = tls.Listen("tcp", agent.config.SecureAddress, tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if agent.config.Address != "" {
+		var err error
+
+		if listener, err = net.Listen("tcp", agent.config.Address); err != nil {
+			if secureListener != nil {
+				secureListener.Close()
+			}
+
+			return err
+		}
+	}
+
+	agent.loadTokens()
+	agent.startEventSinks()
+
+	go agent.grpcStart()
+	go agent.ctlStart()
+
+	log.Println("DataFolder: ", agent.config.DataFolder)
+
+	if listener != nil {
+		log.Println("Starting non secure websocket server on ", agent.config.Address, " ...")
+		go agent.serve(&http.Server{Handler: agent.handler()}, listener, "websocket server")
+	}
+
+	if secureListener != nil {
+		log.Println("Starting secure websocket server on ", agent.config.SecureAddress, " ...")
+		go agent.serve(&http.Server{Handler: agent.secureHandler()}, secureListener, "secure websocket server")
+	}
+
+	if advertiser != nil {
+		go agent.mdnsStart(advertiser)
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			agent.Stop()
+		case <-agent.done:
+		}
+	}()
+
+	return nil
+}
+
+// Stop the agent, its servers, and the board monitor, and detach the boards.
+// A stopped agent can't be started again.
+func (agent *Agent) Stop() {
+	agent.stopOnce.Do(func() {
+		close(agent.done)
+
+		agent.serversMutex.Lock()
+		servers, sinks, mdns := agent.servers, agent.sinks, agent.mdns
+		agent.servers, agent.sinks, agent.mdns = nil, nil, nil
+		agent.serversMutex.Unlock()
+
+		for _, server := range servers {
+			server.Close()
+		}
+
+		if mdns != nil {
+			mdns.close()
+		}
+
+		agent.stopMonitor()
+
+		agent.detachBoards()
+
+		for _, sink := range sinks {
+			sink.close()
+		}
+
+		log.Println("agent stopped")
+	})
+}
+
+// Get a channel that is closed when the agent is stopped
+func (agent *Agent) Done() <-chan struct{} {
+	return agent.done
+}
+
+// Test if the agent is stopped
+func (agent *Agent) stopped() bool {
+	select {
+	case <-agent.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Serve the connections accepted by a listener until the agent is stopped
+func (agent *Agent) serve(server *http.Server, listener net.Listener, name string) {
+	agent.serversMutex.Lock()
+
+	if agent.stopped() {
+		agent.serversMutex.Unlock()
+		listener.Close()
+		return
+	}
+
+	agent.servers = append(agent.servers, server)
+	agent.serversMutex.Unlock()
+
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Println(name, " stopped: ", err)
+	}
+}
+
+// Subscribe a sink to the agent events of the given types, or to all the events
+// if no type is given. Returns a function that unsubscribes the sink. The sink is
+// called in the goroutine that publishes the event, so it must not block.
+func (agent *Agent) Subscribe(sink EventSink, types ...string) (unsubscribe func()) {
+	return agent.bus.subscribe(sink, types...)
+}
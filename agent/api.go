@@ -0,0 +1,447 @@
+/*
+ * Whitecat Blocky Environment, REST API
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+The board commands are also available as a REST API under /api/v1, for tools that don't speak the
+websocket protocol. The API is described by the OpenAPI document served at /api/v1/openapi.json.
+
+Requests must send a paired token in the Authorization header. A token for scripts can be created
+with wccagent -token:
+
+curl -H "Authorization: Bearer xxxx" http://localhost:8080/api/v1/dir/examples
+curl -H "Authorization: Bearer xxxx" -T blink.lua http://localhost:8080/api/v1/files/examples/blink.lua
+
+The API commands are executed by the command queue, as the websocket commands, while the API holds
+the board lease. If an IDE holds the lease the request fails with the no-lease error. Errors are
+sent with the corresponding HTTP status:
+
+{"error": "no-board"}
+
+The deadline of a command can be set with the timeout query parameter, in milliseconds, and its
+board with the board query parameter. The default board is used if it is not set, see boards.go.
+
+*/
+
+import (
+	"context"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// Error sent when the request hasn't a valid token
+const ErrNotPaired = "not-paired"
+
+// Reply of a command executed for the API
+type apiReply struct {
+	Status string          `json:"status"`
+	Error  string          `json:"error"`
+	Info   json.RawMessage `json:"info"`
+}
+
+// HTTP status for each error code
+var apiStatus = map[string]int{
+	ErrTimeout:         http.StatusGatewayTimeout,
+	ErrBoardBusy:       http.StatusConflict,
+	ErrDecode:          http.StatusBadRequest,
+	ErrNoBoard:         http.StatusServiceUnavailable,
+	ErrInvalidFirmware: http.StatusConflict,
+	ErrDownload:        http.StatusBadGateway,
+	ErrNotAllowed:      http.StatusConflict,
+	ErrInvalidCommand:  http.StatusBadRequest,
+	ErrFileTooLarge:    http.StatusRequestEntityTooLarge,
+	ErrTransfer:        http.StatusBadRequest,
+	ErrNoLease:         http.StatusConflict,
+	ErrCancelled:       http.StatusServiceUnavailable,
+}
+
+func apiError(ctx *gin.Context, errCode string) {
+	status, ok := apiStatus[errCode]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+
+	ctx.JSON(status, gin.H{"error": errCode})
+	ctx.Abort()
+}
+
+// Check the origin and the token of a request. Requests from web pages are only
+// accepted from the allowed origins. If the request is rejected the HTTP status
+// and the error code are returned.
+func (agent *Agent) checkApiRequest(r *http.Request, token string) (status int, errCode string) {
+	if trustedRequest(r) {
+		return http.StatusOK, ""
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if originURL, err := url.Parse(origin); err != nil || !agent.originAllowed(originURL) {
+			return http.StatusForbidden, ErrNotAllowed
+		}
+	}
+
+	if !agent.validApiToken(token) {
+		return http.StatusUnauthorized, ErrNotPaired
+	}
+
+	return http.StatusOK, ""
+}
+
+// Get the token sent in the Authorization header
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+func (agent *Agent) apiAuth(ctx *gin.Context) {
+	if status, errCode := agent.checkApiRequest(ctx.Request, bearerToken(ctx.Request)); errCode != "" {
+		ctx.JSON(status, gin.H{"error": errCode})
+		ctx.Abort()
+		return
+	}
+
+	ctx.Next()
+}
+
+// Execute a board command for an API client, and wait for the reply. The
+// command is executed by board, or by the default board if it is empty, and it
+// is cancelled if ctx is done. Data sent by the command in binary
+// frames is returned in data. If the command fails the error code is returned.
+func (agent *Agent) apiExecute(ctx context.Context, board string, name string, timeout int, arguments interface{}, content []byte) (reply apiReply, data []byte, errCode string) {
+	c := &client{
+		id:  "api-" + newClientId(),
+		out: make(chan frame, clientQueueSize),
+	}
+
+	defer c.close()
+
+	if b := agent.findBoard(board); b != nil {
+		if granted, _ := agent.hub.requestLease(c, b.id, false); !granted {
+			return reply, nil, ErrNoLease
+		}
+
+		defer agent.hub.releaseLease(c, b.id)
+	}
+
+	command := CommandMessage{Id: c.id, Command: name, Timeout: timeout, Board: board}
+
+	if !agent.queueCommand(c, command, arguments, content) {
+		return reply, nil, ErrBoardBusy
+	}
+
+	size := -1
+
+	for {
+		select {
+		case f := <-c.out:
+			if f.binary {
+				data = append(data, f.data...)
+			} else if err := json.Unmarshal(f.data, &reply); err != nil {
+				return reply, nil, ErrDecode
+			} else if reply.Status == "error" {
+				return reply, nil, reply.Error
+			} else {
+				var transfer BinaryTransferInfo
+
+				json.Unmarshal(reply.Info, &transfer)
+				size = 0
+				if transfer.Transfer == BinaryTransfer {
+					size = transfer.Size
+				}
+			}
+
+			if size >= 0 && len(data) >= size {
+				return reply, data, ""
+			}
+
+		case <-ctx.Done():
+			// The client has gone
+			agent.cancelCommand(c, c.id)
+			return reply, nil, ErrCancelled
+		}
+	}
+}
+
+// Execute a board command for an API request. If the command fails the error
+// is sent, and ok is false.
+func (agent *Agent) apiCommand(ctx *gin.Context, name string, arguments interface{}, content []byte) (reply apiReply, data []byte, ok bool) {
+	timeout, _ := strconv.Atoi(ctx.Query("timeout"))
+
+	reply, data, errCode := agent.apiExecute(ctx.Request.Context(), ctx.Query("board"), name, timeout, arguments, content)
+	if errCode != "" {
+		apiError(ctx, errCode)
+		return reply, nil, false
+	}
+
+	return reply, data, true
+}
+
+// Get the path of the board file from the request
+func apiPath(ctx *gin.Context) string {
+	path := ctx.Param("path")
+	if path == "" {
+		path = "/"
+	}
+
+	return path
+}
+
+// Get the content sent in the request body
+func apiContent(ctx *gin.Context) ([]byte, bool) {
+	content, err := ioutil.ReadAll(io.LimitReader(ctx.Request.Body, MaxFileSize+1))
+	if err != nil {
+		apiError(ctx, ErrTransfer)
+		return nil, false
+	}
+
+	if len(content) > MaxFileSize {
+		apiError(ctx, ErrFileTooLarge)
+		return nil, false
+	}
+
+	return content, true
+}
+
+// Status of the agent. Board is the default board, and LeaseHolder the holder
+// of its lease.
+type AgentStatusInfo struct {
+	Version     string              `json:"version"`
+	Board       *BoardAttachedInfo  `json:"board"`
+	Boards      []BoardAttachedInfo `json:"boards"`
+	LeaseHolder string              `json:"leaseHolder"`
+	Clients     int                 `json:"clients"`
+}
+
+func (agent *Agent) apiAgentStatus(ctx *gin.Context) {
+	status := AgentStatusInfo{
+		Version:     Version,
+		LeaseHolder: agent.leaseHolderId(),
+		Clients:     agent.hub.clientCount(),
+		Boards:      []BoardAttachedInfo{},
+	}
+
+	for _, board := range agent.attachedBoards() {
+		status.Boards = append(status.Boards, board.attachedInfo())
+	}
+
+	if len(status.Boards) > 0 {
+		status.Board = &status.Boards[0]
+	}
+
+	ctx.JSON(http.StatusOK, status)
+}
+
+func (agent *Agent) apiBoardInfo(ctx *gin.Context) {
+	board := agent.findBoard(ctx.Query("board"))
+	if board == nil {
+		apiError(ctx, ErrNoBoard)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, board.attachedInfo())
+}
+
+func (agent *Agent) apiDirContent(ctx *gin.Context) {
+	reply, _, ok := agent.apiCommand(ctx, "boardGetDirContent", &PathArguments{Path: apiPath(ctx)}, nil)
+	if ok {
+		ctx.Data(http.StatusOK, "application/json; charset=utf-8", reply.Info)
+	}
+}
+
+func (agent *Agent) apiReadFile(ctx *gin.Context) {
+	_, data, ok := agent.apiCommand(ctx, "boardReadFile", &ReadFileArguments{Path: apiPath(ctx), Transfer: BinaryTransfer}, nil)
+	if ok {
+		ctx.Data(http.StatusOK, "application/octet-stream", data)
+	}
+}
+
+func (agent *Agent) apiWriteFile(ctx *gin.Context) {
+	content, ok := apiContent(ctx)
+	if !ok {
+		return
+	}
+
+	arguments := &WriteFileArguments{Path: apiPath(ctx), Transfer: BinaryTransfer, Size: len(content)}
+	if _, _, ok := agent.apiCommand(ctx, "boardWriteFile", arguments, content); ok {
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+func (agent *Agent) apiRemoveFile(ctx *gin.Context) {
+	// The path of boardRemoveFile is base64 encoded
+	path := base64.StdEncoding.EncodeToString([]byte(apiPath(ctx)))
+
+	if _, _, ok := agent.apiCommand(ctx, "boardRemoveFile", &PathArguments{Path: path}, nil); ok {
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+func (agent *Agent) apiRunProgram(ctx *gin.Context) {
+	code, ok := apiContent(ctx)
+	if !ok {
+		return
+	}
+
+	arguments := &RunProgramArguments{Path: apiPath(ctx), Transfer: BinaryTransfer, Size: len(code)}
+	if _, _, ok := agent.apiCommand(ctx, "boardRunProgram", arguments, code); ok {
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+func (agent *Agent) apiRunCommand(ctx *gin.Context) {
+	code, ok := apiContent(ctx)
+	if !ok {
+		return
+	}
+
+	arguments := &RunCommandArguments{Code: base64.StdEncoding.EncodeToString(code)}
+
+	reply, _, ok := agent.apiCommand(ctx, "boardRunCommand", arguments, nil)
+	if !ok {
+		return
+	}
+
+	var info RunCommandInfo
+	json.Unmarshal(reply.Info, &info)
+
+	ctx.JSON(http.StatusOK, gin.H{"response": string(info.Response)})
+}
+
+// Send console input to the board. The input is only accepted when no client
+// holds the board lease, and it is queued while a board operation is in
+// progress.
+func (agent *Agent) apiConsoleIn(ctx *gin.Context) {
+	input, ok := apiContent(ctx)
+	if !ok {
+		return
+	}
+
+	board := agent.findBoard(ctx.Query("board"))
+	if board == nil {
+		apiError(ctx, ErrNoBoard)
+		return
+	}
+
+	if agent.hub.leaseHolderId(board.id) != "" {
+		apiError(ctx, ErrNoLease)
+		return
+	}
+
+	if board.upgrading() {
+		apiError(ctx, ErrBoardBusy)
+		return
+	}
+
+	if errCode := board.writeConsole(input); errCode != "" {
+		apiError(ctx, errCode)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// Handler for the board commands without arguments
+func (agent *Agent) apiSimpleCommand(name string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if _, _, ok := agent.apiCommand(ctx, name, nil, nil); ok {
+			ctx.Status(http.StatusNoContent)
+		}
+	}
+}
+
+func (agent *Agent) apiUpgrade(ctx *gin.Context) {
+	arguments := &UpgradeArguments{Custom: ctx.Query("custom") == "true"}
+
+	if _, _, ok := agent.apiCommand(ctx, "boardUpgrade", arguments, nil); ok {
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+func (agent *Agent) apiInstall(ctx *gin.Context) {
+	arguments := &InstallArguments{}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(ctx.Request.Body, 64*1024))
+	if err := decodeStrict(body, arguments); err != nil {
+		apiError(ctx, ErrInvalidCommand)
+		return
+	}
+
+	if _, _, ok := agent.apiCommand(ctx, "boardInstall", arguments, nil); ok {
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+// The gin mode is global, and the routers are created concurrently by the
+// websocket servers and the control socket
+var ginModeOnce sync.Once
+
+// Create the router of the REST API
+func (agent *Agent) apiRouter() http.Handler {
+	ginModeOnce.Do(func() {
+		gin.SetMode(gin.ReleaseMode)
+	})
+
+	router := gin.New()
+	router.Use(gin.Recovery())
+
+	router.GET("/api/v1/openapi.json", func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "application/json; charset=utf-8", openAPIDocument)
+	})
+
+	api := router.Group("/api/v1", agent.apiAuth)
+
+	api.GET("/board", agent.apiBoardInfo)
+	api.POST("/board/reset", agent.apiSimpleCommand("boardReset"))
+	api.POST("/board/stop", agent.apiSimpleCommand("boardStop"))
+	api.POST("/board/upgrade", agent.apiUpgrade)
+	api.POST("/board/install", agent.apiInstall)
+	api.GET("/dir/*path", agent.apiDirContent)
+	api.GET("/files/*path", agent.apiReadFile)
+	api.PUT("/files/*path", agent.apiWriteFile)
+	api.DELETE("/files/*path", agent.apiRemoveFile)
+	api.POST("/run/*path", agent.apiRunProgram)
+	api.POST("/command", agent.apiRunCommand)
+	api.POST("/console", agent.apiConsoleIn)
+	api.GET("/status", agent.apiAgentStatus)
+
+	return router
+}
@@ -27,11 +27,11 @@
  * this software.
  */
 
-package main
+package agent
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -47,6 +47,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"github.com/mikepb/go-serial"
 )
@@ -71,16 +72,36 @@ type SupportedBoard struct {
 
 type SupportedBoards []SupportedBoard
 
-var Upgrading bool
+// Chunk size for send / receive files to / from board
+const BoardChunkSize = 255
+
+// Error raised when the board doesn't answer in time
+var errTimeout = errors.New("timeout")
+
+// Error raised when the firmware can't be flashed into the board
+var errInvalidFirmware = errors.New("invalid firmware")
+
+// The IDE framework can't be uploaded to the board
+var errInvalidPrerequisites = errors.New("invalid prerequisites")
 
 type Board struct {
-	// Serial port
-	port    *serial.Port
-	devInfo *serial.Info
+	// Agent that owns the board
+	agent *Agent
+
+	// Connection to the board, and the serial port info of USB boards
+	transport Transport
+	devInfo   *serial.Info
 
-	// Device name
+	// Device name, or address of a network board
 	dev string
 
+	// Id of the board, see boards.go
+	id string
+
+	// Lifecycle state, see state.go
+	state      BoardState
+	stateMutex sync.Mutex
+
 	// Is there a new firmware build?
 	newBuild bool
 
@@ -94,6 +115,10 @@ type Board struct {
 	ota      bool
 	firmware string
 
+	// Protects the board information and model, that are changed in the
+	// sessions on the port, and read by the notifications and the API
+	infoMutex sync.Mutex
+
 	// Has board shell enable?
 	shell bool
 
@@ -104,12 +129,26 @@ type Board struct {
 	chunkSize int
 
 	// If true disables notify board's boot events
-	disableInspectorBootNotify bool
+	disableInspectorBootNotify atomic.Bool
+
+	// Route the received data to the console, and / or to RXQueue. They are
+	// changed by the board operations while the inspector is running.
+	consoleOut atomic.Bool
+	consoleIn  atomic.Bool
 
-	consoleOut bool
-	consoleIn  bool
+	// Exclusive session on the port, and the console input queued while it
+	// is in progress, see exchange.go
+	sessionMutex sync.Mutex
+	inputMutex   sync.Mutex
+	inSession    bool
+	pendingInput []byte
 
-	quit chan bool
+	// Console output waiting to be sent, see console.go
+	console *consoleBuffer
+
+	// Closed when the transport is closed
+	quit      chan bool
+	closeOnce sync.Once
 
 	// Current timeout value, in milliseconds for read
 	timeoutVal int
@@ -122,19 +161,43 @@ type Board struct {
 
 	// Max bauds for this board
 	maxBauds int
+
+	// Context of the command in progress. Reads are aborted when it is done.
+	ctx      context.Context
+	ctxMutex sync.Mutex
+
+	// Commands waiting to be executed by the board, and the queued and running
+	// commands, see commands.go. detached is closed when the board is detached.
+	commands        chan *queuedCommand
+	pendingCommands []*queuedCommand
+	detached        chan struct{}
+	commandsStopped bool
+	commandsMutex   sync.Mutex
 }
 
+// Info sent by the board, and in the boardInfo reply
 type BoardInfo struct {
-	Build   string
-	Commit  string
-	Board   string
-	Subtype string
-	Brand   string
-	Ota     bool
+	Build   string `json:"build"`
+	Commit  string `json:"commit"`
+	Board   string `json:"board"`
+	Subtype string `json:"subtype"`
+	Brand   string `json:"brand"`
+	Ota     bool   `json:"ota"`
 	Status  struct {
-		Shell   bool
-		History bool
-	}
+		Shell   bool `json:"shell"`
+		History bool `json:"history"`
+	} `json:"status"`
+}
+
+// Get the info that the board has sent on its last reset
+func (board *Board) boardInfo() BoardInfo {
+	board.infoMutex.Lock()
+	defer board.infoMutex.Unlock()
+
+	var info BoardInfo
+	json.Unmarshal([]byte(board.info), &info)
+
+	return info
 }
 
 func (board *Board) timeout(ms int) {
@@ -145,6 +208,20 @@ func (board *Board) noTimeout() {
 	board.timeoutVal = math.MaxInt32
 }
 
+func (board *Board) setContext(ctx context.Context) {
+	board.ctxMutex.Lock()
+	defer board.ctxMutex.Unlock()
+
+	board.ctx = ctx
+}
+
+func (board *Board) context() context.Context {
+	board.ctxMutex.Lock()
+	defer board.ctxMutex.Unlock()
+
+	return board.ctx
+}
+
 // Inspects the serial data received for a board in order to find special
 // special events, such as reset, core dumps, exceptions, etc ...
 //
@@ -166,55 +243,49 @@ func (board *Board) inspector() {
 	line := ""
 
 	for {
-		if n, err := board.port.Read(buffer); err != nil {
+		if n, err := board.transport.Read(buffer); err != nil {
 			panic(err)
 		} else {
 			if n > 0 {
 				if buffer[0] == '\n' {
-					if !board.disableInspectorBootNotify {
+					if !board.disableInspectorBootNotify.Load() {
 						re = regexp.MustCompile(`^rst:.*\(POWERON_RESET\),boot:.*(.*)$`)
 						if re.MatchString(line) {
-							notify("boardPowerOnReset", "")
+							board.notify("boardPowerOnReset", nil)
 						}
 
 						re = regexp.MustCompile(`^rst:.*(SW_CPU_RESET),boot:.*(.*)$`)
 						if re.MatchString(line) {
-							notify("boardSoftwareReset", "")
+							board.notify("boardSoftwareReset", nil)
 						}
 
 						re = regexp.MustCompile(`^rst:.*(DEEPSLEEP_RESET),boot.*(.*)$`)
 						if re.MatchString(line) {
-							notify("boardDeepSleepReset", "")
+							board.notify("boardDeepSleepReset", nil)
 						}
 
 						re = regexp.MustCompile(`\<blockStart,(.*)\>`)
 						if re.MatchString(line) {
 							parts := re.FindStringSubmatch(line)
-							info := "\"block\": \"" + base64.StdEncoding.EncodeToString([]byte(parts[1])) + "\""
-							notify("blockStart", info)
+							board.notify("blockStart", BlockInfo{Block: []byte(parts[1])})
 						}
 
 						re = regexp.MustCompile(`\<blockEnd,(.*)\>`)
 						if re.MatchString(line) {
 							parts := re.FindStringSubmatch(line)
-							info := "\"block\": \"" + base64.StdEncoding.EncodeToString([]byte(parts[1])) + "\""
-							notify("blockEnd", info)
+							board.notify("blockEnd", BlockInfo{Block: []byte(parts[1])})
 						}
 
 						re = regexp.MustCompile(`\<blockError,([0-9]*),(.*)\>`)
 						if re.MatchString(line) {
 							parts := re.FindStringSubmatch(line)
-							info := "\"block\": \"" + base64.StdEncoding.EncodeToString([]byte(parts[1])) + "\", " +
-								"\"error\": \"" + base64.StdEncoding.EncodeToString([]byte(parts[2])) + "\""
-
-							notify("blockError", info)
+							board.notify("blockError", BlockErrorInfo{Block: []byte(parts[1]), Error: []byte(parts[2])})
 						}
 
 						re = regexp.MustCompile(`\<blockErrorCatched,(.*)\>`)
 						if re.MatchString(line) {
 							parts := re.FindStringSubmatch(line)
-							info := "\"block\": \"" + base64.StdEncoding.EncodeToString([]byte(parts[1])) + "\""
-							notify("blockErrorCatched", info)
+							board.notify("blockErrorCatched", BlockInfo{Block: []byte(parts[1])})
 						}
 					}
 
@@ -227,33 +298,37 @@ func (board *Board) inspector() {
 					if re.MatchString(tmpLine) {
 						parts := re.FindStringSubmatch(tmpLine)
 
-						info := "\"where\": \"" + parts[1] + "\", " +
-							"\"line\": \"" + parts[2] + "\", " +
-							"\"exception\": \"" + parts[3] + "\", " +
-							"\"message\": \"" + base64.StdEncoding.EncodeToString([]byte(parts[4])) + "\""
+						info := RuntimeErrorInfo{
+							Where:     parts[1],
+							Line:      parts[2],
+							Exception: parts[3],
+							Message:   []byte(parts[4]),
+						}
 						log.Println(parts[4])
 
 						re = regexp.MustCompile(`^WARNING\s.*$`)
 						if re.MatchString(parts[4]) {
-							notify("boardRuntimeWarning", info)
+							board.notify("boardRuntimeWarning", info)
 						} else {
-							notify("boardRuntimeError", info)
+							board.notify("boardRuntimeError", info)
 						}
 					} else {
 						re = regexp.MustCompile(`^([\/\.\/\-_a-zA-Z]*)\:(\d*)\:\s*(.*)$`)
 						if re.MatchString(tmpLine) {
 							parts := re.FindStringSubmatch(tmpLine)
 
-							info := "\"where\": \"" + parts[1] + "\", " +
-								"\"line\": \"" + parts[2] + "\", " +
-								"\"exception\": \"0\", " +
-								"\"message\": \"" + base64.StdEncoding.EncodeToString([]byte(parts[3])) + "\""
+							info := RuntimeErrorInfo{
+								Where:     parts[1],
+								Line:      parts[2],
+								Exception: "0",
+								Message:   []byte(parts[3]),
+							}
 
 							re = regexp.MustCompile(`^WARNING\s.*$`)
 							if re.MatchString(parts[3]) {
-								notify("boardRuntimeWarning", info)
+								board.notify("boardRuntimeWarning", info)
 							} else {
-								notify("boardRuntimeError", info)
+								board.notify("boardRuntimeError", info)
 							}
 						}
 					}
@@ -265,11 +340,11 @@ func (board *Board) inspector() {
 					}
 				}
 
-				if board.consoleOut {
-					ConsoleUp <- buffer[0]
+				if board.consoleOut.Load() {
+					board.console.write(buffer[0])
 				}
 
-				if board.consoleIn {
+				if board.consoleIn.Load() {
 					board.RXQueue <- buffer[0]
 				}
 			}
@@ -277,18 +352,24 @@ func (board *Board) inspector() {
 	}
 }
 
-func (board *Board) attach(info *serial.Info) {
+func (board *Board) attach(transport Transport, dev string) {
 	defer func() {
 		if err := recover(); err != nil {
-			board.detach()
+			// The board is kept in the error state, so the firmware can be
+			// installed
+			board.close()
 
-			connectedBoard = board
+			board.validFirmware = false
+			board.validPrerequisites = false
 
-			connectedBoard.validFirmware = false
-			connectedBoard.validPrerequisites = false
-			connectedBoard.model = ""
-			connectedBoard.subtype = ""
-			connectedBoard.brand = ""
+			board.infoMutex.Lock()
+			board.model = ""
+			board.subtype = ""
+			board.brand = ""
+			board.infoMutex.Unlock()
+
+			board.setState(BoardError, fmt.Sprint(err))
+			board.agent.addBoard(board)
 
 			panic(err)
 		}
@@ -296,44 +377,37 @@ func (board *Board) attach(info *serial.Info) {
 
 	log.Println("attaching board ...")
 
-	board.devInfo = info
-
-	// Configure options or serial port connection
-	options := serial.RawOptions
-	options.BitRate = 115200
-	options.Mode = serial.MODE_READ_WRITE
-	options.DTR = serial.DTR_OFF
-	options.RTS = serial.RTS_OFF
-
-	// Open port
-	port, openErr := options.Open(info.Name())
-	if openErr != nil {
-		panic(openErr)
+	// Create board struct
+	if board.id == "" {
+		board.id = dev
 	}
 
-	// Create board struct
-	board.port = port
-	board.dev = info.Name()
+	board.transport = transport
+	board.dev = dev
+	board.console = newConsoleBuffer()
 	board.RXQueue = make(chan byte, 10*1024)
-	board.chunkSize = 255
-	board.disableInspectorBootNotify = false
-	board.consoleOut = true
-	board.consoleIn = false
+	board.chunkSize = BoardChunkSize
+	board.disableInspectorBootNotify.Store(false)
+	board.consoleOut.Store(true)
+	board.consoleIn.Store(false)
 	board.quit = make(chan bool)
 	board.timeoutVal = math.MaxInt32
 	board.validFirmware = true
 	board.validPrerequisites = true
 
-	Upgrading = false
-
+	go board.consoleBroadcast()
 	go board.inspector()
 
+	board.startCommands()
+
 	// Reset the board
-	board.reset(true)
-	connectedBoard = board
+	board.exclusive(func() {
+		board.reset(true)
+	})
+	board.agent.addBoard(board)
 
 	if board.validFirmware && board.validPrerequisites {
-		notify("boardAttached", "")
+		board.notifyAttached()
 		log.Println("board attached")
 	}
 }
@@ -343,34 +417,60 @@ func (board *Board) detach() {
 
 	// Close board
 	if board != nil {
-		log.Println("closing serial port ...")
+		board.close()
+		board.stopCommands()
 
-		// Close serial port
-		board.port.Close()
-
-		time.Sleep(time.Millisecond * 1000)
+		board.agent.removeBoard(board)
+		board.setState(BoardDetached, "")
 	}
+}
+
+// Close the transport of the board, and stop sending its console output. The
+// transport is only closed once.
+func (board *Board) close() {
+	board.closeOnce.Do(func() {
+		log.Println("closing transport ...")
 
-	connectedBoard = nil
+		// Close transport
+		board.transport.Close()
+		close(board.quit)
+
+		time.Sleep(time.Millisecond * 1000)
+	})
 }
 
 /*
  * Serial port primitives
  */
 
-// Read one byte from RXQueue
+// Read one byte from RXQueue. If the command in progress is cancelled, or its
+// deadline expires, the read is aborted.
 func (board *Board) read() byte {
+	var done <-chan struct{}
+
+	ctx := board.context()
+	if ctx != nil {
+		done = ctx.Done()
+	}
+
 	if board.timeoutVal != math.MaxInt32 {
 		for {
 			select {
 			case c := <-board.RXQueue:
 				return c
 			case <-time.After(time.Millisecond * time.Duration(board.timeoutVal)):
-				panic(errors.New("timeout"))
+				panic(errTimeout)
+			case <-done:
+				panic(ctx.Err())
 			}
 		}
 	} else {
-		return <-board.RXQueue
+		select {
+		case c := <-board.RXQueue:
+			return c
+		case <-done:
+			panic(ctx.Err())
+		}
 	}
 }
 
@@ -438,40 +538,47 @@ func (board *Board) waitForReady() bool {
 
 	line := ""
 
-	vendorId, productId, _ := board.devInfo.USBVIDPID()
+	var vendorId, productId int
+	if board.devInfo != nil {
+		vendorId, productId, _ = board.devInfo.USBVIDPID()
+	}
 
 	board.timeout(4000)
 
 	for {
 		select {
 		case <-time.After(time.Millisecond * time.Duration(board.timeoutVal)):
-			panic(errors.New("timeout"))
+			panic(errTimeout)
 		default:
 			line = board.readLineCRLF()
 
 			if regexp.MustCompile(`^.*formatting\s{0,1}\.\.\.$`).MatchString(line) {
 				log.Println("board is formatting the file system, setting time out to 120 seconds")
 				board.timeout(120000)
-				notify("boardUpdate", "Board is formatting the file system, please, wait ...")
+				board.setState(BoardFormatting, "")
+				board.notifyUpdate("Board is formatting the file system, please, wait ...")
 			}
 
 			if regexp.MustCompile(`^.*formating\s{0,1}\.\.\.$`).MatchString(line) {
 				log.Println("board is formatting the file system, setting time out to 80 seconds")
 				board.timeout(120000)
-				notify("boardUpdate", "Board is formatting the file system, please, wait ...")
+				board.setState(BoardFormatting, "")
+				board.notifyUpdate("Board is formatting the file system, please, wait ...")
 			}
 
 			if regexp.MustCompile(`^.*boot: Failed to verify app image.*$`).MatchString(line) {
 				board.validFirmware = false
 				board.validPrerequisites = false
-				notify("invalidFirmware", "")
+				board.setState(BoardError, errInvalidFirmware.Error())
+				board.notify("invalidFirmware", nil)
 				return false
 			}
 
 			if regexp.MustCompile(`^.*boot: No bootable app partitions in the partition table.*$`).MatchString(line) {
 				board.validFirmware = false
 				board.validPrerequisites = false
-				notify("invalidFirmware", "")
+				board.setState(BoardError, errInvalidFirmware.Error())
+				board.notify("invalidFirmware", nil)
 				return false
 			}
 
@@ -480,7 +587,8 @@ func (board *Board) waitForReady() bool {
 				if failingBack > 4 {
 					board.validFirmware = false
 					board.validPrerequisites = false
-					notify("invalidFirmware", "")
+					board.setState(BoardError, errInvalidFirmware.Error())
+					board.notify("invalidFirmware", nil)
 					return false
 				}
 			}
@@ -490,7 +598,8 @@ func (board *Board) waitForReady() bool {
 				if failingBack > 4 {
 					board.validFirmware = false
 					board.validPrerequisites = false
-					notify("invalidFirmware", "")
+					board.setState(BoardError, errInvalidFirmware.Error())
+					board.notify("invalidFirmware", nil)
 					return false
 				}
 			}
@@ -513,9 +622,9 @@ func (board *Board) waitForReady() bool {
 					}
 					if whitecat {
 						// Send Ctrl-D
-						board.port.Write([]byte{4})
+						board.transport.Write([]byte{4})
 					}
-					board.consoleOut = true
+					board.consoleOut.Store(true)
 				} else {
 					if regexp.MustCompile(`^Lua RTOS-boot-scripts-aborted-ESP32$`).MatchString(line) {
 						return true
@@ -526,19 +635,40 @@ func (board *Board) waitForReady() bool {
 	}
 }
 
+// Wait until a board that hasn't been rebooted shows the prompt
+func (board *Board) waitForPrompt() {
+	line := ""
+
+	board.timeout(4000)
+
+	for {
+		switch c := board.read(); c {
+		case '\n':
+			line = ""
+		case '\r':
+		default:
+			line = line + string(c)
+		}
+
+		if strings.HasSuffix(line, "> ") && isPrompt(line) {
+			return
+		}
+	}
+}
+
 // Test if line corresponds to Lua RTOS prompt
 func isPrompt(line string) bool {
 	return regexp.MustCompile("^/.*>.*$").MatchString(line)
 }
 
 func (board *Board) getInfo() string {
-	board.consoleOut = false
-	board.consoleIn = true
+	board.consoleOut.Store(false)
+	board.consoleIn.Store(true)
 	board.timeout(2000)
 	info := board.sendCommand("dofile(\"/_info.lua\")")
 	board.noTimeout()
-	board.consoleOut = true
-	board.consoleIn = false
+	board.consoleOut.Store(true)
+	board.consoleIn.Store(false)
 
 	info = strings.Replace(info, ",}", "}", -1)
 	info = strings.Replace(info, ",]", "]", -1)
@@ -557,12 +687,12 @@ func (board *Board) sendCommand(command string) string {
 
 	// Disable shell
 	if board.info != "" {
-		board.port.Write([]byte("os.shell(false)\r\n"))
+		board.transport.Write([]byte("os.shell(false)\r\n"))
 		board.consume()
 	}
 
 	// Send command. We must append the \r\n chars at the end
-	board.port.Write([]byte(command + "\r\n"))
+	board.transport.Write([]byte(command + "\r\n"))
 
 	// Read response, that it must be the send command.
 	line := board.readLineCRLF()
@@ -574,7 +704,7 @@ func (board *Board) sendCommand(command string) string {
 			if isPrompt(line) {
 				// Reenable shell
 				if board.info != "" {
-					board.port.Write([]byte("os.shell(" + prevShell + ")\r\n"))
+					board.transport.Write([]byte("os.shell(" + prevShell + ")\r\n"))
 					board.consume()
 				}
 
@@ -589,7 +719,7 @@ func (board *Board) sendCommand(command string) string {
 	} else {
 		// Reenable shell
 		if board.info != "" {
-			board.port.Write([]byte("os.shell(" + prevShell + ")\r\n"))
+			board.transport.Write([]byte("os.shell(" + prevShell + ")\r\n"))
 			board.consume()
 		}
 
@@ -598,7 +728,7 @@ func (board *Board) sendCommand(command string) string {
 
 	// Reenable shell
 	if board.info != "" {
-		board.port.Write([]byte("os.shell(" + prevShell + ")\r\n"))
+		board.transport.Write([]byte("os.shell(" + prevShell + ")\r\n"))
 		board.consume()
 	}
 
@@ -608,79 +738,76 @@ func (board *Board) sendCommand(command string) string {
 func (board *Board) reset(prerequisites bool) {
 	defer func() {
 		board.noTimeout()
-		board.consoleOut = true
-		board.consoleIn = false
+		board.consoleOut.Store(true)
+		board.consoleIn.Store(false)
 
 		if err := recover(); err != nil {
+			board.setState(BoardError, fmt.Sprint(err))
 			panic(err)
 		}
 	}()
 
+	board.setState(BoardBooting, "")
+
 	board.consume()
 
+	board.infoMutex.Lock()
 	board.shell = false
 	prevInfo := board.info
 	board.info = ""
+	board.infoMutex.Unlock()
 
-	board.consoleOut = false
-	board.consoleIn = true
+	board.consoleOut.Store(false)
+	board.consoleIn.Store(true)
 
 	// Reset board
-	options := serial.RawOptions
-	options.BitRate = 115200
-	options.Mode = serial.MODE_READ_WRITE
-
-	options.RTS = serial.RTS_OFF
-	board.port.Apply(&options)
-
-	time.Sleep(time.Millisecond * 10)
-
-	options.RTS = serial.RTS_ON
-	board.port.Apply(&options)
-
-	time.Sleep(time.Millisecond * 10)
-
-	options.RTS = serial.RTS_OFF
-	board.port.Apply(&options)
+	rebooted, err := board.transport.Reset()
+	if err != nil {
+		panic(err)
+	}
 
-	if !board.waitForReady() {
-		return
+	if rebooted {
+		if !board.waitForReady() {
+			return
+		}
+	} else {
+		board.waitForPrompt()
 	}
 
 	board.consume()
 
 	log.Println("board is ready ...")
 
-	if runtime.GOOS != "linux" {
+	if setter, ok := board.transport.(bitRateSetter); ok && runtime.GOOS != "linux" {
 		if board.maxBauds != 115200 {
 			log.Println("changing baud rate to " + strconv.Itoa(board.maxBauds) + " ...")
 
-			board.consoleOut = false
-			board.consoleIn = true
+			board.consoleOut.Store(false)
+			board.consoleIn.Store(true)
 
-			board.port.Write([]byte("uart.attach(uart.UART0, " + strconv.Itoa(board.maxBauds) + ", 8, uart.PARNONE, uart.STOP1)\r\n"))
+			board.transport.Write([]byte("uart.attach(uart.UART0, " + strconv.Itoa(board.maxBauds) + ", 8, uart.PARNONE, uart.STOP1)\r\n"))
 			time.Sleep(time.Millisecond * 10)
-			options.BitRate = board.maxBauds
-			board.port.Apply(&options)
+			setter.SetBitRate(board.maxBauds)
 			time.Sleep(time.Millisecond * 10)
 			board.consume()
 
-			board.consoleOut = false
-			board.consoleIn = true
+			board.consoleOut.Store(false)
+			board.consoleIn.Store(true)
 		}
 	}
 
 	if prerequisites {
-		notify("boardUpdate", "Downloading prerequisites")
+		board.setState(BoardUploadingPrerequisites, "")
+		board.notifyUpdate("Downloading prerequisites")
 
 		// Clean
-		os.RemoveAll(path.Join(AppDataTmpFolder, "*"))
+		os.RemoveAll(path.Join(board.agent.tmpFolder(), "*"))
 
 		// Upgrade prerequisites
 		exists := ""
 		prerequisitesSource := NoSource
 
-		url := BaseIdeURL + "/boards/prerequisites.zip"
+		url := board.agent.config.BaseIdeURL + "/boards/prerequisites.zip"
 
 		log.Println("Downloading prerequisites from " + url + " ...")
 
@@ -699,10 +826,13 @@ func (board *Board) reset(prerequisites bool) {
 
 				body, err := ioutil.ReadAll(resp.Body)
 				if err == nil {
-					err = ioutil.WriteFile(path.Join(AppDataTmpFolder, "prerequisites.zip"), body, 0777)
+					err = ioutil.WriteFile(path.Join(board.agent.tmpFolder(), "prerequisites.zip"), body, 0777)
 					if err == nil {
-						unzip(path.Join(AppDataTmpFolder, "prerequisites.zip"), path.Join(AppDataTmpFolder, "prerequisites_files"))
-						prerequisitesSource = CloudSource
+						if err := unzip(path.Join(board.agent.tmpFolder(), "prerequisites.zip"), path.Join(board.agent.tmpFolder(), "prerequisites_files")); err == nil {
+							prerequisitesSource = CloudSource
+						} else {
+							log.Println("unpack error", err)
+						}
 					} else {
 						panic(err)
 					}
@@ -730,8 +860,8 @@ func (board *Board) reset(prerequisites bool) {
 
 		if prerequisitesSource == NoSource {
 			// Check if we can use last downloaded prerrequisites
-			if _, err := os.Stat(path.Join(AppDataTmpFolder, "prerequisites_files", "lua", "board-info.lua")); !os.IsNotExist(err) {
-				if _, err := os.Stat(path.Join(AppDataTmpFolder, "prerequisites_files", "lua", "lib", "block.lua")); !os.IsNotExist(err) {
+			if _, err := os.Stat(path.Join(board.agent.tmpFolder(), "prerequisites_files", "lua", "board-info.lua")); !os.IsNotExist(err) {
+				if _, err := os.Stat(path.Join(board.agent.tmpFolder(), "prerequisites_files", "lua", "lib", "block.lua")); !os.IsNotExist(err) {
 					prerequisitesSource = DesktopSource
 					log.Println("using last downloaded prerequisites")
 				}
@@ -742,7 +872,8 @@ func (board *Board) reset(prerequisites bool) {
 			board.validPrerequisites = false
 
 			log.Println("alternative prerequisites don't found")
-			notify("invalidPrerequisites", "")
+			board.setState(BoardError, errInvalidPrerequisites.Error())
+			board.notify("invalidPrerequisites", nil)
 			return
 		}
 
@@ -760,8 +891,8 @@ func (board *Board) reset(prerequisites bool) {
 
 		if prerequisitesSource == NoSource {
 			// Check if we can use last downloaded prerrequisites
-			if _, err := os.Stat(path.Join(AppDataTmpFolder, "prerequisites_files", "lua", "board-info.lua")); !os.IsNotExist(err) {
-				if _, err := os.Stat(path.Join(AppDataTmpFolder, "prerequisites_files", "lua", "lib", "block.lua")); !os.IsNotExist(err) {
+			if _, err := os.Stat(path.Join(board.agent.tmpFolder(), "prerequisites_files", "lua", "board-info.lua")); !os.IsNotExist(err) {
+				if _, err := os.Stat(path.Join(board.agent.tmpFolder(), "prerequisites_files", "lua", "lib", "block.lua")); !os.IsNotExist(err) {
 					prerequisitesSource = DesktopSource
 					log.Println("using last downloaded prerequisites")
 				}
@@ -770,14 +901,15 @@ func (board *Board) reset(prerequisites bool) {
 
 		if prerequisitesSource == NoSource {
 			log.Println("alternative prerequisites don't found")
-			notify("invalidPrerequisites", "")
+			board.setState(BoardError, errInvalidPrerequisites.Error())
+			board.notify("invalidPrerequisites", nil)
 			return
 		}
 
-		notify("boardUpdate", "Uploading framework")
+		board.notifyUpdate("Uploading framework")
 
-		board.consoleOut = false
-		board.consoleIn = true
+		board.consoleOut.Store(false)
+		board.consoleIn.Store(true)
 
 		// Test for lib/lua
 		if prerequisitesSource != BoardSource {
@@ -801,25 +933,25 @@ func (board *Board) reset(prerequisites bool) {
 		}
 
 		if (prerequisitesSource == CloudSource) || (prerequisitesSource == DesktopSource) {
-			buffer, err := ioutil.ReadFile(path.Join(AppDataTmpFolder, "prerequisites_files", "lua", "board-info.lua"))
+			buffer, err := ioutil.ReadFile(path.Join(board.agent.tmpFolder(), "prerequisites_files", "lua", "board-info.lua"))
 			if err == nil {
 				resp := board.writeFile("/_info.lua", buffer)
 				if resp == "" {
-					panic(errors.New("timeout"))
+					panic(errTimeout)
 				}
 			} else {
 				panic(err)
 			}
 
-			files, err := ioutil.ReadDir(path.Join(AppDataTmpFolder, "prerequisites_files", "lua", "lib"))
+			files, err := ioutil.ReadDir(path.Join(board.agent.tmpFolder(), "prerequisites_files", "lua", "lib"))
 			if err == nil {
 				for _, finfo := range files {
 					if regexp.MustCompile(`.*\.lua`).MatchString(finfo.Name()) {
-						file, _ := ioutil.ReadFile(path.Join(AppDataTmpFolder, "prerequisites_files", "lua", "lib", finfo.Name()))
+						file, _ := ioutil.ReadFile(path.Join(board.agent.tmpFolder(), "prerequisites_files", "lua", "lib", finfo.Name()))
 						log.Println("Sending ", "/lib/lua/"+finfo.Name(), " ...")
 						resp := board.writeFile("/lib/lua/"+finfo.Name(), file)
 						if resp == "" {
-							panic(errors.New("timeout"))
+							panic(errTimeout)
 						}
 						board.consume()
 					}
@@ -829,7 +961,7 @@ func (board *Board) reset(prerequisites bool) {
 			}
 		}
 
-		board.consoleOut = true
+		board.consoleOut.Store(true)
 
 		// Get board info
 		info := board.getInfo()
@@ -839,6 +971,8 @@ func (board *Board) reset(prerequisites bool) {
 
 		json.Unmarshal([]byte(info), &boardInfo)
 
+		board.infoMutex.Lock()
+
 		// Test for a newer software build
 		board.newBuild = false
 
@@ -864,16 +998,21 @@ func (board *Board) reset(prerequisites bool) {
 
 		board.firmware = firmware
 
-		log.Println("Check for new firmware at ", LastBuildURL+"?firmware="+board.firmware)
+		board.infoMutex.Unlock()
 
-		resp, err = client.Get(LastBuildURL + "?firmware=" + board.firmware)
+		log.Println("Check for new firmware at ", board.agent.config.lastBuildURL()+"?firmware="+board.firmware)
+
+		resp, err = client.Get(board.agent.config.lastBuildURL() + "?firmware=" + board.firmware)
 		if err == nil {
 			body, err := ioutil.ReadAll(resp.Body)
 			if err == nil {
 				lastCommit := string(body)
 
 				if (boardInfo.Commit != lastCommit) && (lastCommit != "") {
+					board.infoMutex.Lock()
 					board.newBuild = true
+					board.infoMutex.Unlock()
+
 					log.Println("new firmware available: ", lastCommit)
 				}
 			} else {
@@ -885,27 +1024,30 @@ func (board *Board) reset(prerequisites bool) {
 
 		board.consume()
 	} else {
+		board.infoMutex.Lock()
 		board.info = prevInfo
 		board.newBuild = false
+		board.infoMutex.Unlock()
 	}
-}
 
-func (board *Board) getDirContent(path string) string {
-	var content string
+	board.setState(BoardReady, "")
+}
 
+func (board *Board) getDirContent(path string) (content []DirEntry) {
 	defer func() {
 		board.noTimeout()
-		board.consoleOut = true
-		board.consoleIn = false
+		board.consoleOut.Store(true)
+		board.consoleIn.Store(false)
 
 		if err := recover(); err != nil {
+			content = nil
 		}
 	}()
 
-	content = ""
+	content = []DirEntry{}
 
-	board.consoleOut = false
-	board.consoleIn = true
+	board.consoleOut.Store(false)
+	board.consoleIn.Store(true)
 
 	board.timeout(1000)
 	response := board.sendCommand("os.ls(\"" + path + "\")")
@@ -913,47 +1055,52 @@ func (board *Board) getDirContent(path string) string {
 		element := strings.Split(strings.Replace(line, "\r", "", -1), "\t")
 
 		if len(element) == 4 {
-			if content != "" {
-				content = content + ","
-			}
-
-			content = content + "{" +
-				"\"type\": \"" + element[0] + "\"," +
-				"\"size\": \"" + element[1] + "\"," +
-				"\"date\": \"" + element[2] + "\"," +
-				"\"name\": \"" + element[3] + "\"" +
-				"}"
+			content = append(content, DirEntry{
+				Type: element[0],
+				Size: element[1],
+				Date: element[2],
+				Name: element[3],
+			})
 		}
 	}
 
-	board.consoleOut = true
+	board.consoleOut.Store(true)
 
-	return "[" + content + "]"
+	return content
 }
 
-func (board *Board) removeFile(path string) {
-	board.consoleOut = false
-	board.consoleIn = true
+func (board *Board) removeFile(path string) (ok bool) {
+	defer func() {
+		board.noTimeout()
+		board.consoleOut.Store(true)
+		board.consoleIn.Store(false)
+
+		if err := recover(); err != nil {
+			ok = false
+		}
+	}()
+
+	board.consoleOut.Store(false)
+	board.consoleIn.Store(true)
 	board.timeout(2000)
 	board.sendCommand("os.remove(\"" + path + "\")")
-	board.noTimeout()
-	board.consoleOut = true
-	board.consoleIn = false
+
+	return true
 }
 
 func (board *Board) writeFile(path string, buffer []byte) string {
 	defer func() {
 		board.noTimeout()
-		board.consoleOut = true
-		board.consoleIn = false
+		board.consoleOut.Store(true)
+		board.consoleIn.Store(false)
 
 		if err := recover(); err != nil {
 		}
 	}()
 
 	board.timeout(2000)
-	board.consoleOut = false
-	board.consoleIn = true
+	board.consoleOut.Store(false)
+	board.consoleIn.Store(true)
 
 	writeCommand := "io.receive(\"" + path + "\")"
 
@@ -963,7 +1110,7 @@ func (board *Board) writeFile(path string, buffer []byte) string {
 	board.consume()
 
 	// Send command and test for echo
-	board.port.Write([]byte(writeCommand + "\r"))
+	board.transport.Write([]byte(writeCommand + "\r"))
 	if board.readLineCR() == writeCommand {
 		for {
 			// Wait for chunk
@@ -980,11 +1127,11 @@ func (board *Board) writeFile(path string, buffer []byte) string {
 				}
 
 				// Send chunk length
-				board.port.Write([]byte{byte(outLen)})
+				board.transport.Write([]byte{byte(outLen)})
 
 				if outLen > 0 {
 					// Send chunk
-					board.port.Write(buffer[outIndex : outIndex+outLen])
+					board.transport.Write(buffer[outIndex : outIndex+outLen])
 				} else {
 					break
 				}
@@ -1010,8 +1157,8 @@ func (board *Board) runCode(buffer []byte) {
 	outLen := 0
 	outIndex := 0
 
-	board.consoleOut = false
-	board.consoleIn = true
+	board.consoleOut.Store(false)
+	board.consoleIn.Store(true)
 
 	if board.shell {
 		prevShell = "true"
@@ -1019,12 +1166,12 @@ func (board *Board) runCode(buffer []byte) {
 
 	// Disable shell
 	if board.info != "" {
-		board.port.Write([]byte("os.shell(false)\r\n"))
+		board.transport.Write([]byte("os.shell(false)\r\n"))
 		board.consume()
 	}
 
 	// Send command
-	board.port.Write([]byte(writeCommand + "\r"))
+	board.transport.Write([]byte(writeCommand + "\r"))
 	for {
 		// Wait for chunk
 		if board.readLineCRLF() == "C" {
@@ -1040,11 +1187,11 @@ func (board *Board) runCode(buffer []byte) {
 			}
 
 			// Send chunk length
-			board.port.Write([]byte{byte(outLen)})
+			board.transport.Write([]byte{byte(outLen)})
 
 			if outLen > 0 {
 				// Send chunk
-				board.port.Write(buffer[outIndex : outIndex+outLen])
+				board.transport.Write(buffer[outIndex : outIndex+outLen])
 			} else {
 				break
 			}
@@ -1057,20 +1204,20 @@ func (board *Board) runCode(buffer []byte) {
 
 	// Reenable shell
 	if board.info != "" {
-		board.consoleOut = false
-		board.port.Write([]byte("os.shell(" + prevShell + ")\r\n"))
+		board.consoleOut.Store(false)
+		board.transport.Write([]byte("os.shell(" + prevShell + ")\r\n"))
 		board.consume()
 	}
 
-	board.consoleOut = true
-	board.consoleOut = false
+	board.consoleOut.Store(true)
+	board.consoleOut.Store(false)
 }
 
 func (board *Board) readFile(path string) []byte {
 	defer func() {
 		board.noTimeout()
-		board.consoleOut = true
-		board.consoleIn = false
+		board.consoleOut.Store(true)
+		board.consoleIn.Store(false)
 
 		if err := recover(); err != nil {
 		}
@@ -1080,18 +1227,18 @@ func (board *Board) readFile(path string) []byte {
 	var inLen byte
 
 	board.timeout(2000)
-	board.consoleOut = false
-	board.consoleIn = true
+	board.consoleOut.Store(false)
+	board.consoleIn.Store(true)
 
 	// Command for read file
 	readCommand := "io.send(\"" + path + "\")"
 
 	// Send command and test for echo
-	board.port.Write([]byte(readCommand + "\r"))
+	board.transport.Write([]byte(readCommand + "\r"))
 	if board.readLineCRLF() == readCommand {
 		for {
 			// Wait for chunk
-			board.port.Write([]byte("C\n"))
+			board.transport.Write([]byte("C\n"))
 
 			// Read chunk size
 			inLen = board.read()
@@ -1119,16 +1266,16 @@ func (board *Board) readFile(path string) []byte {
 
 func (board *Board) runProgram(path string, code []byte) {
 	var prevShell string = "false"
-	board.disableInspectorBootNotify = true
+	board.disableInspectorBootNotify.Store(true)
 
-	board.consoleOut = false
+	board.consoleOut.Store(false)
 
 	// Reset board
 	board.reset(false)
-	board.disableInspectorBootNotify = false
+	board.disableInspectorBootNotify.Store(false)
 
-	board.consoleOut = false
-	board.consoleIn = true
+	board.consoleOut.Store(false)
+	board.consoleIn.Store(true)
 
 	if board.shell {
 		prevShell = "true"
@@ -1136,7 +1283,7 @@ func (board *Board) runProgram(path string, code []byte) {
 
 	// Disable shell
 	if board.info != "" {
-		board.port.Write([]byte("os.shell(false)\r\n"))
+		board.transport.Write([]byte("os.shell(false)\r\n"))
 		board.consume()
 	}
 
@@ -1147,28 +1294,29 @@ func (board *Board) runProgram(path string, code []byte) {
 	board.writeFile(path, code)
 
 	// Run the target file
-	board.port.Write([]byte("require(\"block\");wcBlock.delevepMode=true;dofile(\"" + path + "\")\r"))
+	board.transport.Write([]byte("require(\"block\");wcBlock.delevepMode=true;dofile(\"" + path + "\")\r"))
+	board.setState(BoardRunning, "")
 
 	board.consume()
 
 	// Reenable shell
 	if board.info != "" {
-		board.consoleOut = false
-		board.port.Write([]byte("os.shell(" + prevShell + ")\r\n"))
+		board.consoleOut.Store(false)
+		board.transport.Write([]byte("os.shell(" + prevShell + ")\r\n"))
 		board.consume()
 	}
 
-	board.consoleOut = true
-	board.consoleIn = false
+	board.consoleOut.Store(true)
+	board.consoleIn.Store(false)
 }
 
 func (board *Board) runCommand(code []byte) string {
-	board.consoleOut = false
-	board.consoleIn = true
+	board.consoleOut.Store(false)
+	board.consoleIn.Store(true)
 	result := board.sendCommand(string(code))
 	board.consume()
-	board.consoleOut = true
-	board.consoleIn = false
+	board.consoleOut.Store(true)
+	board.consoleIn.Store(false)
 
 	return result
 }
@@ -1184,17 +1332,15 @@ func exec_cmd(cmd string, wg *sync.WaitGroup) {
 	wg.Done()
 }
 
-func (board *Board) flash(argument_file string) {
+func (board *Board) flash(folder string, argument_file string) error {
 	var out string = ""
 	var re *regexp.Regexp
 
 	// Read flash arguments
-	b, err := ioutil.ReadFile(AppDataTmpFolder + "/firmware_files/" + argument_file)
+	b, err := ioutil.ReadFile(folder + "/" + argument_file)
 	if err != nil {
-		notify("boardUpdate", err.Error())
-		time.Sleep(time.Millisecond * 1000)
-		Upgrading = false
-		return
+		board.notifyUpdate(err.Error())
+		return err
 	}
 
 	flash_args := string(b)
@@ -1205,7 +1351,7 @@ func (board *Board) flash(argument_file string) {
 	for _, arg := range args {
 		re = regexp.MustCompile(`^.*\.bin$`)
 		if re.MatchString(arg) {
-			flash_args = strings.Replace(flash_args, arg, "\""+AppDataTmpFolder+"/firmware_files/"+arg+"\"", -1)
+			flash_args = strings.Replace(flash_args, arg, "\""+folder+"/"+arg+"\"", -1)
 		}
 	}
 
@@ -1226,15 +1372,18 @@ func (board *Board) flash(argument_file string) {
 	}
 
 	// Prepare for execution
-	cmd := exec.Command(AppDataTmpFolder+"/utils/esptool/esptool", cmdArgs...)
+	cmd := exec.Command(board.agent.tmpFolder()+"/utils/esptool/esptool", cmdArgs...)
 
-	log.Println("executing: ", "\""+AppDataTmpFolder+"/utils/esptool/esptool\"")
+	log.Println("executing: ", "\""+board.agent.tmpFolder()+"/utils/esptool/esptool\"")
 
 	// We need to read command stdout for show the progress in the IDE
 	stdout, _ := cmd.StdoutPipe()
 
 	// Start
-	cmd.Start()
+	if err := cmd.Start(); err != nil {
+		board.notifyUpdate(err.Error())
+		return err
+	}
 
 	// Read stdout until EOF
 	c := make([]byte, 1)
@@ -1247,61 +1396,96 @@ func (board *Board) flash(argument_file string) {
 		if c[0] == '\r' || c[0] == '\n' {
 			out = strings.Replace(out, "...", "", -1)
 			if out != "" {
-				notify("boardUpdate", out)
+				board.notifyUpdate(out)
 			}
 			out = ""
 		} else {
 			out = out + string(c)
 		}
 	}
+
+	return cmd.Wait()
 }
 
-func (board *Board) upgrade(install bool, firmware string) {
-	Upgrading = true
+// Upgrade the board firmware. If custom is true the firmware uploaded by the IDE
+// is flashed, instead of downloading it.
+func (board *Board) upgrade(install bool, firmware string, custom bool) (err error) {
+	// The firmware is flashed through the serial port
+	if _, ok := board.transport.(*serialTransport); !ok {
+		return errNoSerial
+	}
+
+	if custom && !board.agent.hasCustomFirmware() {
+		return errNoCustomFirmware
+	}
 
-	// First detach board for free serial port
-	board.detach()
+	board.setState(BoardUpgrading, "")
+
+	// The board is detached when the upgrade ends, and it is attached again
+	// by the monitor
+	defer func() {
+		if err != nil {
+			board.setState(BoardError, err.Error())
+		}
+
+		board.detach()
+	}()
+
+	// First close the transport for free serial port. The board is not
+	// detached yet, so the monitor doesn't open the port.
+	board.close()
 
 	// Download tool for flashing
-	err := downloadEsptool()
+	err = board.agent.downloadEsptool()
 	if err != nil {
-		notify("boardUpdate", err.Error())
-		time.Sleep(time.Millisecond * 1000)
-		Upgrading = false
-		return
+		board.notifyUpdate(err.Error())
+		return err
 	}
 
-	// Download firmware
-	if install {
-		err = downloadFirmware(firmware)
+	// Download firmware, unless the IDE has uploaded a custom firmware. A
+	// custom firmware being uploaded when the upgrade started is waited for,
+	// and no other can be uploaded until the upgrade ends.
+	folder := path.Join(board.agent.tmpFolder(), "firmware_files")
+
+	if custom {
+		if !board.agent.hasCustomFirmware() {
+			return errNoCustomFirmware
+		}
+
+		folder = board.agent.customFirmwareFolder()
 	} else {
-		err = downloadFirmware(board.firmware)
-	}
+		if install {
+			err = board.agent.downloadFirmware(firmware)
+		} else {
+			err = board.agent.downloadFirmware(board.firmware)
+		}
 
-	if err != nil {
-		notify("boardUpdate", err.Error())
-		time.Sleep(time.Millisecond * 1000)
-		Upgrading = false
-		return
+		if err != nil {
+			board.notifyUpdate(err.Error())
+			return err
+		}
 	}
 
-	board.flash("flash_args")
+	if err = board.flash(folder, "flash_args"); err != nil {
+		return errInvalidFirmware
+	}
 
 	if install {
-		board.flash("flashfs_args")
+		if err = board.flash(folder, "flashfs_args"); err != nil {
+			return errInvalidFirmware
+		}
 	}
 
 	log.Println("Upgraded")
 
-	time.Sleep(time.Millisecond * 1000)
-	Upgrading = false
+	return nil
 }
 
 func (board *Board) getFirmwareName() string {
 	var supportedBoards SupportedBoards
 
 	// Get supported boards
-	resp, err := http.Get(SupportedBoardsURL)
+	resp, err := http.Get(board.agent.config.supportedBoardsURL())
 	if err == nil {
 		body, err := ioutil.ReadAll(resp.Body)
 		if err == nil {
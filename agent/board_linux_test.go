@@ -0,0 +1,224 @@
+//go:build linux
+// +build linux
+
+/*
+ * Whitecat Blocky Environment, board tests with the Lua RTOS emulator
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jyex/whitecat-create-agent/emulator"
+)
+
+// A client of the board commands, holding the lease, with a console up
+// connection for all the boards
+func emulatorClient(t *testing.T, board *Board) *client {
+	c := testClient()
+	c.upOut = make(chan consoleOutput, consoleClientQueue)
+
+	board.agent.hub.register(c)
+
+	if granted, holder := board.agent.hub.requestLease(c, board.id, false); !granted {
+		t.Fatalf("lease hold by %s", holder)
+	}
+
+	return c
+}
+
+// Execute a board command, and get its reply. The info of the reply is
+// decoded into info, if it isn't nil.
+func boardCommand(t *testing.T, c *client, board *Board, name string, arguments interface{}, content []byte, info interface{}) Notification {
+	command := CommandMessage{Id: newClientId(), Command: name, Board: board.id}
+
+	if !board.agent.queueCommand(c, command, arguments, content) {
+		t.Fatalf("%s not queued", name)
+	}
+
+	reply := commandReply(t, c, command.Id)
+	if reply.Status != "ok" {
+		t.Fatalf("%s failed: %s", name, reply.Error)
+	}
+
+	if info != nil {
+		data, _ := json.Marshal(reply.Info)
+
+		if err := json.Unmarshal(data, info); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	return reply
+}
+
+// Wait until the console output sent to a client has text
+func waitConsole(t *testing.T, c *client, text string) []byte {
+	var output []byte
+	timeout := time.After(10 * time.Second)
+
+	for !bytes.Contains(output, []byte(text)) {
+		select {
+		case data := <-c.upOut:
+			output = append(output, data.data...)
+
+		case <-timeout:
+			t.Fatalf("%q not in console output %q", text, output)
+		}
+	}
+
+	return output
+}
+
+func TestEmulatorAttach(t *testing.T) {
+	board, emu := newEmulatedBoard(t)
+
+	board.infoMutex.Lock()
+	brand, model := board.brand, board.model
+	board.infoMutex.Unlock()
+
+	if brand != "WHITECAT" || model != "EMULATOR" {
+		t.Fatalf("board %s %s, expected WHITECAT EMULATOR", brand, model)
+	}
+
+	// The prerequisites are uploaded when the board is attached
+	for _, name := range []string{"/_info.lua", "/lib/lua/block.lua"} {
+		if _, ok := emu.ReadFile(name); !ok {
+			t.Fatalf("%s not uploaded", name)
+		}
+	}
+
+	c := emulatorClient(t, board)
+
+	var info BoardInfo
+	boardCommand(t, c, board, "boardInfo", nil, nil, &info)
+
+	if info.Board != "EMULATOR" || info.Brand != "WHITECAT" || info.Build != "emulator" {
+		t.Fatalf("unexpected board info %+v", info)
+	}
+
+	var entries []DirEntry
+	boardCommand(t, c, board, "boardGetDirContent", &PathArguments{Path: "/"}, nil, &entries)
+
+	names := make(map[string]string)
+	for _, entry := range entries {
+		names[entry.Name] = entry.Type
+	}
+
+	if names["_info.lua"] != "f" || names["lib"] != "d" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+}
+
+func TestEmulatorFiles(t *testing.T) {
+	board, emu := newEmulatedBoard(t)
+
+	c := emulatorClient(t, board)
+
+	// Several chunks of the io.receive and io.send transfers
+	content := make([]byte, 3*BoardChunkSize+100)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	boardCommand(t, c, board, "boardWriteFile", &WriteFileArguments{Path: "/data.bin"}, content, nil)
+
+	if written, _ := emu.ReadFile("/data.bin"); !bytes.Equal(written, content) {
+		t.Fatalf("written %d bytes, expected %d", len(written), len(content))
+	}
+
+	// A file written to the board by other means is read
+	emu.WriteFile("/other.txt", []byte("other\n"))
+
+	for name, expected := range map[string][]byte{"/data.bin": content, "/other.txt": []byte("other\n")} {
+		var file FileContentInfo
+		boardCommand(t, c, board, "boardReadFile", &ReadFileArguments{Path: name}, nil, &file)
+
+		if !bytes.Equal(file.Content, expected) {
+			t.Fatalf("%s: read %d bytes, expected %d", name, len(file.Content), len(expected))
+		}
+	}
+
+	path := base64.StdEncoding.EncodeToString([]byte("/data.bin"))
+	boardCommand(t, c, board, "boardRemoveFile", &PathArguments{Path: path}, nil, nil)
+
+	if _, ok := emu.ReadFile("/data.bin"); ok {
+		t.Fatal("data.bin not removed")
+	}
+}
+
+func TestEmulatorRunProgram(t *testing.T) {
+	board, emu := newEmulatedBoard(t)
+
+	c := emulatorClient(t, board)
+
+	program := []byte("print(\"program output\")\n")
+	boardCommand(t, c, board, "boardRunProgram", &RunProgramArguments{Path: "/main.lua"}, program, nil)
+
+	if written, _ := emu.ReadFile("/main.lua"); !bytes.Equal(written, program) {
+		t.Fatalf("program %q, expected %q", written, program)
+	}
+
+	// The program is run when the board boots
+	if autorun, _ := emu.ReadFile("/autorun.lua"); !strings.Contains(string(autorun), "dofile(\"/main.lua\")") {
+		t.Fatalf("autorun.lua %q doesn't run the program", autorun)
+	}
+
+	waitConsole(t, c, "program output")
+
+	var command RunCommandInfo
+	code := base64.StdEncoding.EncodeToString([]byte("print(\"cmd\", 42)"))
+	boardCommand(t, c, board, "boardRunCommand", &RunCommandArguments{Code: code}, nil, &command)
+
+	if string(command.Response) != "cmd\t42" {
+		t.Fatalf("response %q", command.Response)
+	}
+}
+
+func TestEmulatorConsole(t *testing.T) {
+	board, _ := newEmulatedBoard(t)
+
+	c := emulatorClient(t, board)
+
+	if errCode := board.writeConsole([]byte("print(\"typed\")\r")); errCode != "" {
+		t.Fatalf("console input rejected: %s", errCode)
+	}
+
+	// The command is echoed, and then its output and the prompt are printed
+	output := waitConsole(t, c, "\ntyped\r\n"+emulator.Prompt)
+
+	if !bytes.Contains(output, []byte("print(\"typed\")")) {
+		t.Fatalf("console input not echoed in %q", output)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * Whitecat Blocky Environment, board registry
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+Several boards can be attached at once. Each board has an id, that is the serial number of its USB
+adapter, the serial port if the adapter has no serial number, or the address of a network board.
+The notifications sent by a board carry its id in the board field:
+
+{"notify": "boardAttached", "board": "A50285BI", "info": {"id": "A50285BI", "info": {}, "newBuild": false}}
+{"notify": "boardDetached", "board": "A50285BI", "info": {"id": "A50285BI"}}
+{"notify": "boardRuntimeError", "board": "A50285BI", "info": {"where": "xx", ...}}
+
+The board of a command is selected with the board field of the command. Commands without board are
+executed by the default board, that is the first attached board, so IDEs that only handle one
+board work as before:
+
+{"command": "boardReadFile", "id": "xx", "board": "A50285BI", "arguments": {"path": "xxxx"}}
+
+The console of a board is selected with the board query parameter of /up and /down:
+
+/up?client=xx&board=A50285BI
+
+Without it /up receives the output of all the boards, and /down sends the input to the default
+board. The REST API and /events also have the board query parameter, and the gRPC calls the board
+metadata. The console output replayed to resumed sessions and to reconnected /events listeners is
+only sent when no board is selected, because it has the output of all the boards.
+
+*/
+
+// Get an attached board by its id, or the default board if id is empty.
+// Returns nil if there is no such board.
+func (agent *Agent) findBoard(id string) *Board {
+	agent.boardsMutex.Lock()
+	defer agent.boardsMutex.Unlock()
+
+	for _, board := range agent.boards {
+		if id == "" || board.id == id {
+			return board
+		}
+	}
+
+	return nil
+}
+
+// Get the board attached to a serial port, or to a network address
+func (agent *Agent) boardOnDevice(dev string) *Board {
+	agent.boardsMutex.Lock()
+	defer agent.boardsMutex.Unlock()
+
+	for _, board := range agent.boards {
+		if board.dev == dev {
+			return board
+		}
+	}
+
+	return nil
+}
+
+// Get the attached boards, in attach order
+func (agent *Agent) attachedBoards() []*Board {
+	agent.boardsMutex.Lock()
+	defer agent.boardsMutex.Unlock()
+
+	return append([]*Board(nil), agent.boards...)
+}
+
+func (agent *Agent) addBoard(board *Board) {
+	agent.boardsMutex.Lock()
+	defer agent.boardsMutex.Unlock()
+
+	for _, attached := range agent.boards {
+		if attached == board {
+			return
+		}
+	}
+
+	agent.boards = append(agent.boards, board)
+}
+
+func (agent *Agent) removeBoard(board *Board) {
+	agent.boardsMutex.Lock()
+	defer agent.boardsMutex.Unlock()
+
+	for i, attached := range agent.boards {
+		if attached == board {
+			agent.boards = append(agent.boards[:i:i], agent.boards[i+1:]...)
+			break
+		}
+	}
+}
+
+// Get the id for a board attached to dev. The serial number of the adapter is
+// used if it is not the id of other board, for example in adapters with two
+// serial ports.
+func (agent *Agent) boardId(serialNumber string, dev string) string {
+	if serialNumber != "" && agent.findBoard(serialNumber) == nil {
+		return serialNumber
+	}
+
+	return dev
+}
+
+// Detach the boards that are not connected anymore, and inform the IDE
+func (agent *Agent) checkBoards() {
+	for _, board := range agent.attachedBoards() {
+		// The transport of a board is closed while it is upgraded
+		if board.upgrading() {
+			continue
+		}
+
+		if !board.transport.Connected() {
+			board.detach()
+			board.notify("boardDetached", BoardDetachedInfo{Id: board.id})
+		}
+	}
+}
+
+// Detach all the boards
+func (agent *Agent) detachBoards() {
+	for _, board := range agent.attachedBoards() {
+		board.detach()
+	}
+}
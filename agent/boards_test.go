@@ -0,0 +1,190 @@
+/*
+ * Whitecat Blocky Environment, board tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"context"
+	"testing"
+)
+
+// Attach a ready board to an agent, with its command queue
+func attachTestBoard(t *testing.T, agent *Agent, id string, transport Transport) *Board {
+	board := &Board{agent: agent, id: id, transport: transport, RXQueue: make(chan byte, 10*1024)}
+	board.setState(BoardOpening, "")
+	board.setState(BoardBooting, "")
+	board.setState(BoardReady, "")
+
+	agent.addBoard(board)
+	board.startCommands()
+
+	t.Cleanup(func() {
+		board.stopCommands()
+		agent.removeBoard(board)
+	})
+
+	return board
+}
+
+// Transport of a board whose reset fails at once
+func failingTransport() *stuckTransport {
+	transport := newStuckTransport()
+	close(transport.release)
+
+	return transport
+}
+
+func TestFindBoard(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir()})
+
+	if agent.findBoard("") != nil {
+		t.Fatal("default board found without boards")
+	}
+
+	a := attachTestBoard(t, agent, "A", failingTransport())
+	b := attachTestBoard(t, agent, "B", failingTransport())
+
+	// The default board is the first attached board
+	if board := agent.findBoard(""); board != a {
+		t.Errorf("default board %v, want A", board)
+	}
+
+	if board := agent.findBoard("B"); board != b {
+		t.Errorf("board %v, want B", board)
+	}
+
+	if board := agent.findBoard("C"); board != nil {
+		t.Errorf("board %s found, want none", board.id)
+	}
+}
+
+func TestBoardQueues(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir()})
+	t.Cleanup(agent.Stop)
+
+	stuck := newStuckTransport()
+	attachTestBoard(t, agent, "A", stuck)
+	attachTestBoard(t, agent, "B", failingTransport())
+
+	c := testClient()
+
+	agent.queueCommand(c, CommandMessage{Id: "1", Command: "boardStop", Board: "A"}, nil, nil)
+	<-stuck.resetting
+
+	agent.queueCommand(c, CommandMessage{Id: "2", Command: "boardStop", Board: "A"}, nil, nil)
+
+	// A stuck board doesn't block the commands of other board
+	agent.queueCommand(c, CommandMessage{Id: "3", Command: "boardStop", Board: "B"}, nil, nil)
+
+	if reply := commandReply(t, c, "3"); reply.Status != "error" || reply.Error == ErrCancelled {
+		t.Errorf("got %s %s, want the reset error", reply.Status, reply.Error)
+	}
+
+	// A command queued for a board is cancelled, whatever board it is for
+	if errCode := agent.cancelCommand(c, "2"); errCode != "" {
+		t.Fatalf("cancel failed with %s", errCode)
+	}
+
+	if errCode := agent.cancelCommand(c, "3"); errCode != ErrNotFound {
+		t.Fatalf("replied command cancelled with %q, want %s", errCode, ErrNotFound)
+	}
+
+	close(stuck.release)
+
+	commandReply(t, c, "1")
+
+	if reply := commandReply(t, c, "2"); reply.Error != ErrCancelled {
+		t.Errorf("got %s %s, want error %s", reply.Status, reply.Error, ErrCancelled)
+	}
+}
+
+func TestDetachedBoardQueue(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir()})
+	t.Cleanup(agent.Stop)
+
+	stuck := newStuckTransport()
+	board := attachTestBoard(t, agent, "A", stuck)
+
+	c := testClient()
+
+	agent.queueCommand(c, CommandMessage{Id: "1", Command: "boardStop", Board: "A"}, nil, nil)
+	<-stuck.resetting
+
+	agent.queueCommand(c, CommandMessage{Id: "2", Command: "boardStop", Board: "A"}, nil, nil)
+
+	// The commands left in the queue of a detached board get the no-board error,
+	// as the ones queued after it is detached
+	board.stopCommands()
+	board.queueCommand(&queuedCommand{agent: agent, c: c, command: CommandMessage{Id: "3", Command: "boardStop"}, ctx: context.Background(), cancel: func() {}, board: board})
+	close(stuck.release)
+
+	commandReply(t, c, "1")
+
+	for _, id := range []string{"2", "3"} {
+		if reply := commandReply(t, c, id); reply.Error != ErrNoBoard {
+			t.Errorf("%s: got %s %s, want error %s", id, reply.Status, reply.Error, ErrNoBoard)
+		}
+	}
+}
+
+func TestBoardLeases(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir()})
+	t.Cleanup(agent.Stop)
+
+	attachTestBoard(t, agent, "A", failingTransport())
+	attachTestBoard(t, agent, "B", failingTransport())
+
+	holder, other := testClient(), testClient()
+	agent.hub.register(holder)
+	agent.hub.register(other)
+
+	if granted, _ := agent.hub.requestLease(holder, "A", false); !granted {
+		t.Fatal("free lease not granted")
+	}
+
+	// The lease of a board doesn't hold the other boards
+	agent.queueCommand(other, CommandMessage{Id: "1", Command: "boardStop", Board: "A"}, nil, nil)
+	agent.queueCommand(other, CommandMessage{Id: "2", Command: "boardStop", Board: "B"}, nil, nil)
+
+	if reply := commandReply(t, other, "1"); reply.Error != ErrNoLease {
+		t.Errorf("got %s %s, want error %s", reply.Status, reply.Error, ErrNoLease)
+	}
+
+	if reply := commandReply(t, other, "2"); reply.Error == ErrNoLease {
+		t.Errorf("got error %s on a free board", reply.Error)
+	}
+
+	if id := agent.hub.leaseHolderId("B"); id != other.id {
+		t.Errorf("lease of B held by %q, want %s", id, other.id)
+	}
+
+	if id := agent.hub.leaseHolderId("A"); id != holder.id {
+		t.Errorf("lease of A held by %q, want %s", id, holder.id)
+	}
+}
@@ -0,0 +1,334 @@
+/*
+ * Whitecat Blocky Environment, event bus
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+Notifications and console output are published on an internal event bus. The hub, that sends them
+to the IDE clients, to the /events stream and to the gRPC service, is one of its sinks. Other sinks
+can be subscribed from code, with Agent.Subscribe, or configured in the EventSinks setting of
+wccagent.json:
+
+"EventSinks": [
+  {"type": "log", "events": ["boardAttached", "boardRuntimeError"]},
+  {"type": "file", "path": "/tmp/wccagent-events.json"},
+  {"type": "webhook", "url": "http://localhost:9000/events", "events": ["boardRuntimeError"]}
+]
+
+events are the event types that are sent to the sink, all if it is empty. The event type is the
+notification type, or console for the console output.
+
+The log sink writes the events to the agent log, the file sink appends them to a file, one JSON
+event per line, and the webhook sink posts each event to an URL:
+
+{"type": "boardRuntimeError", "time": "2017-01-01T00:00:00Z", "board": "xx", "info": {"where": "xx", ...}}
+
+The configured sinks receive the events in their own goroutine. If a sink is slow, events are
+dropped for it.
+
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// An event published on the bus. Info has the type of the notification's info,
+// or ConsoleInfo for the console output.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	// Id of the board that has sent the event, if any, see boards.go
+	Board string `json:"board,omitempty"`
+
+	Info interface{} `json:"info"`
+}
+
+type ConsoleInfo struct {
+	Data []byte `json:"data"`
+}
+
+// A sink of the bus events
+type EventSink interface {
+	Handle(event Event)
+}
+
+// Configuration of an event sink
+type EventSinkConfig struct {
+	Type   string   `json:"type"`
+	Events []string `json:"events"`
+	Path   string   `json:"path"`
+	URL    string   `json:"url"`
+}
+
+// Constructors of the sinks that can be configured
+var eventSinkTypes = map[string]func(config EventSinkConfig) (EventSink, error){
+	"log":     newLogSink,
+	"file":    newFileSink,
+	"webhook": newWebhookSink,
+}
+
+// Size of the queue of events waiting for a configured sink
+const eventSinkQueueSize = 256
+
+type subscription struct {
+	sink EventSink
+
+	// Event types sent to the sink, nil for all
+	types map[string]bool
+}
+
+type eventBus struct {
+	mutex         sync.Mutex
+	subscriptions []*subscription
+}
+
+// Subscribe a sink to the events of the given types, or to all the events if
+// no type is given. Returns a function that unsubscribes the sink.
+func (bus *eventBus) subscribe(sink EventSink, types ...string) (unsubscribe func()) {
+	s := &subscription{sink: sink}
+
+	for _, eventType := range types {
+		if s.types == nil {
+			s.types = make(map[string]bool)
+		}
+
+		s.types[eventType] = true
+	}
+
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	// The subscriptions are copied, so publish can use them without lock
+	bus.subscriptions = append(bus.subscriptions[:len(bus.subscriptions):len(bus.subscriptions)], s)
+
+	return func() {
+		bus.mutex.Lock()
+		defer bus.mutex.Unlock()
+
+		for i, subscribed := range bus.subscriptions {
+			if subscribed == s {
+				subscriptions := make([]*subscription, 0, len(bus.subscriptions)-1)
+				subscriptions = append(subscriptions, bus.subscriptions[:i]...)
+				bus.subscriptions = append(subscriptions, bus.subscriptions[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Publish an event, sent by a board if board is not empty. The sinks are called
+// in the caller goroutine, so they must not block.
+func (bus *eventBus) publish(board string, eventType string, info interface{}) {
+	if info == nil {
+		info = struct{}{}
+	}
+
+	event := Event{Type: eventType, Time: time.Now(), Board: board, Info: info}
+
+	bus.mutex.Lock()
+	subscriptions := bus.subscriptions
+	bus.mutex.Unlock()
+
+	for _, s := range subscriptions {
+		if s.types == nil || s.types[eventType] {
+			s.sink.Handle(event)
+		}
+	}
+}
+
+// A sink that receives the events in its own goroutine
+type asyncSink struct {
+	name   string
+	sink   EventSink
+	events chan Event
+
+	mutex   sync.Mutex
+	dropped int
+	closed  bool
+}
+
+func newAsyncSink(name string, sink EventSink) *asyncSink {
+	s := &asyncSink{
+		name:   name,
+		sink:   sink,
+		events: make(chan Event, eventSinkQueueSize),
+	}
+
+	go func() {
+		for event := range s.events {
+			s.sink.Handle(event)
+		}
+
+		if closer, ok := s.sink.(io.Closer); ok {
+			closer.Close()
+		}
+	}()
+
+	return s
+}
+
+func (s *asyncSink) Handle(event Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	select {
+	case s.events <- event:
+		if s.dropped > 0 {
+			log.Println("event sink ", s.name, " was too slow, ", s.dropped, " events dropped")
+			s.dropped = 0
+		}
+
+	default:
+		s.dropped++
+	}
+}
+
+// Stop sending events to the sink. The events already queued are sent.
+func (s *asyncSink) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+}
+
+// Create and subscribe the configured sinks
+func (agent *Agent) startEventSinks() {
+	for _, config := range agent.config.EventSinks {
+		create, ok := eventSinkTypes[config.Type]
+		if !ok {
+			log.Println("unknown event sink type ", config.Type)
+			continue
+		}
+
+		sink, err := create(config)
+		if err != nil {
+			log.Println("can't create event sink ", config.Type, ": ", err)
+			continue
+		}
+
+		async := newAsyncSink(config.Type, sink)
+		agent.bus.subscribe(async, config.Events...)
+
+		agent.serversMutex.Lock()
+		agent.sinks = append(agent.sinks, async)
+		agent.serversMutex.Unlock()
+	}
+}
+
+// Sink that writes the events to the agent log
+type logSink struct{}
+
+func newLogSink(config EventSinkConfig) (EventSink, error) {
+	return logSink{}, nil
+}
+
+func (logSink) Handle(event Event) {
+	if data, err := json.Marshal(event); err == nil {
+		log.Println("event: ", string(data))
+	}
+}
+
+// Sink that appends the events to a file, one JSON event per line
+type fileSink struct {
+	file *os.File
+}
+
+func newFileSink(config EventSinkConfig) (EventSink, error) {
+	if config.Path == "" {
+		return nil, errors.New("path is required")
+	}
+
+	file, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSink{file: file}, nil
+}
+
+func (sink *fileSink) Handle(event Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	if _, err := sink.file.Write(append(data, '\n')); err != nil {
+		log.Println("can't write event: ", err)
+	}
+}
+
+func (sink *fileSink) Close() error {
+	return sink.file.Close()
+}
+
+// Sink that posts the events to an URL
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookSink(config EventSinkConfig) (EventSink, error) {
+	if config.URL == "" {
+		return nil, errors.New("url is required")
+	}
+
+	return &webhookSink{url: config.URL, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (sink *webhookSink) Handle(event Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	response, err := sink.client.Post(sink.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Println("can't post event: ", err)
+		return
+	}
+
+	response.Body.Close()
+}
@@ -0,0 +1,173 @@
+/*
+ * Whitecat Blocky Environment, event bus tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Receive an event from a recorder
+func recordedEvent(t *testing.T, recorder eventRecorder) Event {
+	select {
+	case event := <-recorder:
+		return event
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not received")
+		return Event{}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir()})
+
+	all, errors := make(eventRecorder, 16), make(eventRecorder, 16)
+	defer agent.Subscribe(all)()
+	unsubscribe := agent.Subscribe(errors, "boardRuntimeError")
+
+	agent.notifyUpdate("Scanning boards")
+	agent.bus.publish("board", "boardRuntimeError", RuntimeErrorInfo{Where: "main.lua"})
+
+	if event := recordedEvent(t, all); event.Type != "boardUpdate" {
+		t.Fatalf("event %s, expected boardUpdate", event.Type)
+	}
+
+	if event := recordedEvent(t, all); event.Type != "boardRuntimeError" || event.Board != "board" {
+		t.Fatalf("event %s of %s, expected boardRuntimeError of board", event.Type, event.Board)
+	}
+
+	if event := recordedEvent(t, errors); event.Type != "boardRuntimeError" {
+		t.Fatalf("event %s, expected boardRuntimeError", event.Type)
+	}
+
+	// An unsubscribed sink doesn't receive events
+	unsubscribe()
+	agent.bus.publish("board", "boardRuntimeError", RuntimeErrorInfo{})
+
+	recordedEvent(t, all)
+	if len(errors) != 0 {
+		t.Fatal("event sent to an unsubscribed sink")
+	}
+}
+
+func TestConfiguredSinks(t *testing.T) {
+	posted := make(chan Event, 16)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		json.NewDecoder(r.Body).Decode(&event)
+		posted <- event
+	}))
+	defer webhook.Close()
+
+	file := filepath.Join(t.TempDir(), "events.json")
+
+	agent := New(Config{DataFolder: t.TempDir(), EventSinks: []EventSinkConfig{
+		{Type: "file", Path: file},
+		{Type: "webhook", URL: webhook.URL, Events: []string{"boardRuntimeError"}},
+		{Type: "unknown"},
+		{Type: "file"},
+	}})
+
+	agent.startEventSinks()
+	if len(agent.sinks) != 2 {
+		t.Fatalf("%d sinks started, expected 2", len(agent.sinks))
+	}
+
+	agent.notifyUpdate("Scanning boards")
+	agent.bus.publish("board", "boardRuntimeError", RuntimeErrorInfo{Where: "main.lua"})
+
+	select {
+	case event := <-posted:
+		if event.Type != "boardRuntimeError" || event.Board != "board" {
+			t.Fatalf("posted %s of %s, expected boardRuntimeError of board", event.Type, event.Board)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not posted")
+	}
+
+	// The file sink writes the queued events when the agent is stopped
+	agent.Stop()
+
+	var types []string
+	for deadline := time.Now().Add(5 * time.Second); len(types) < 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		types = nil
+		for scanner := bufio.NewScanner(f); scanner.Scan(); {
+			var event Event
+			json.Unmarshal(scanner.Bytes(), &event)
+			types = append(types, event.Type)
+		}
+
+		f.Close()
+	}
+
+	if len(types) != 2 || types[0] != "boardUpdate" || types[1] != "boardRuntimeError" {
+		t.Fatalf("events %v written to the file", types)
+	}
+}
+
+// A sink that blocks until it is released
+type blockedSink chan struct{}
+
+func (sink blockedSink) Handle(event Event) {
+	<-sink
+}
+
+func TestSlowSinkDropsEvents(t *testing.T) {
+	sink := make(blockedSink)
+	async := newAsyncSink("blocked", sink)
+	defer async.close()
+	defer close(sink)
+
+	for i := 0; i < eventSinkQueueSize+10; i++ {
+		async.Handle(Event{Type: "boardUpdate"})
+	}
+
+	async.mutex.Lock()
+	dropped := async.dropped
+	async.mutex.Unlock()
+
+	// The first event is being handled, so it is not in the queue
+	if dropped < 9 || dropped > 10 {
+		t.Fatalf("%d events dropped, expected 9 or 10", dropped)
+	}
+}
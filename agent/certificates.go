@@ -0,0 +1,402 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Generate the certificates of the secure websocket server: a certification authority,
+// that browsers must trust (see wccagent cert install), and a certificate for the local
+// addresses signed by it. Outputs to the certificates folder in the agent's DataFolder.
+//
+// The certificate is renewed before it expires, and when it isn't valid for all the
+// local addresses. The certification authority is only renewed before it expires, as
+// it must be installed again.
+
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// Settings of the generated certificates
+type CertificateOptions struct {
+	// Host names and addresses of the certificate
+	Hosts []string
+
+	// Start of the validity, in "Jan 2 15:04:05 2006" format. Empty for now.
+	ValidFrom string
+
+	// Validity of the certificate, and of the certification authority
+	ValidFor   time.Duration
+	CAValidFor time.Duration
+
+	// The certificates are renewed when they expire in less than RenewBefore
+	RenewBefore time.Duration
+
+	// Size of the RSA keys
+	RSABits int
+}
+
+// Get the default certificate settings
+func DefaultCertificateOptions() CertificateOptions {
+	return CertificateOptions{
+		Hosts:       []string{"localhost", "127.0.0.1", "::1"},
+		ValidFor:    365 * 24 * time.Hour,      // 1 year
+		CAValidFor:  10 * 365 * 24 * time.Hour, // 10 years
+		RenewBefore: 30 * 24 * time.Hour,       // 30 days
+		RSABits:     2048,
+	}
+}
+
+// Get the options with the missing settings set to their default value
+func (options CertificateOptions) withDefaults() CertificateOptions {
+	defaults := DefaultCertificateOptions()
+
+	if len(options.Hosts) == 0 {
+		options.Hosts = defaults.Hosts
+	}
+
+	if options.ValidFor == 0 {
+		options.ValidFor = defaults.ValidFor
+	}
+
+	if options.CAValidFor == 0 {
+		options.CAValidFor = defaults.CAValidFor
+	}
+
+	if options.RenewBefore == 0 {
+		options.RenewBefore = defaults.RenewBefore
+	}
+
+	if options.RSABits == 0 {
+		options.RSABits = defaults.RSABits
+	}
+
+	return options
+}
+
+// Files in the certificates folder
+const (
+	caCertFile = "ca.cert.pem"
+	caCerFile  = "ca.cert.cer"
+	caKeyFile  = "ca.key.pem"
+	certFile   = "cert.pem"
+	cerFile    = "cert.cer"
+	keyFile    = "key.pem"
+)
+
+var certificateFiles = []string{caCertFile, caCerFile, caKeyFile, certFile, cerFile, keyFile}
+
+// Get the folder of the certificates of an agent, in its DataFolder
+func CertificatesFolder(dataFolder string) string {
+	return path.Join(dataFolder, "certificates")
+}
+
+// Get the certificate of the certification authority of an agent, in PEM format
+func CACertificate(dataFolder string) string {
+	return path.Join(CertificatesFolder(dataFolder), caCertFile)
+}
+
+func publicKey(priv interface{}) interface{} {
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		return &k.PublicKey
+	case *ecdsa.PrivateKey:
+		return &k.PublicKey
+	default:
+		return nil
+	}
+}
+
+func pemBlockForKey(priv interface{}) *pem.Block {
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	case *ecdsa.PrivateKey:
+		b, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to marshal ECDSA private key: %v", err)
+			os.Exit(2)
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
+	default:
+		return nil
+	}
+}
+
+func (options *CertificateOptions) generateKey(ecdsaCurve string) (interface{}, error) {
+	switch ecdsaCurve {
+	case "":
+		return rsa.GenerateKey(rand.Reader, options.RSABits)
+	case "P224":
+		return ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	case "P256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "P384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "P521":
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("Unrecognized elliptic curve: %q", ecdsaCurve)
+	}
+}
+
+func (options *CertificateOptions) generateSingleCertificate(isCa bool) (*x509.Certificate, error) {
+	var notBefore time.Time
+	var err error
+	if len(options.ValidFrom) == 0 {
+		notBefore = time.Now()
+	} else {
+		notBefore, err = time.Parse("Jan 2 15:04:05 2006", options.ValidFrom)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse creation date: %s\n", err.Error())
+		}
+	}
+
+	notAfter := notBefore.Add(options.ValidFor)
+	if isCa {
+		notAfter = notBefore.Add(options.CAValidFor)
+	}
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %s\n", err.Error())
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization:       []string{"whitecatboard.org"},
+			Country:            []string{"ES"},
+			CommonName:         "localhost",
+			OrganizationalUnit: []string{"ES"},
+		},
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	if isCa {
+		template.IsCA = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.Subject.CommonName = "Whitecatboard"
+	} else {
+		for _, h := range options.Hosts {
+			if ip := net.ParseIP(h); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, h)
+			}
+		}
+	}
+
+	return &template, nil
+}
+
+// Write a key in PEM format, a certificate in PEM and DER formats
+func writeCertificate(folder string, certFile string, cerFile string, keyFile string, derBytes []byte, key interface{}) error {
+	if err := ioutil.WriteFile(path.Join(folder, keyFile), pem.EncodeToMemory(pemBlockForKey(key)), 0600); err != nil {
+		return err
+	}
+	log.Println("written ", keyFile)
+
+	if err := ioutil.WriteFile(path.Join(folder, certFile), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}), 0644); err != nil {
+		return err
+	}
+	log.Println("written ", certFile)
+
+	if err := ioutil.WriteFile(path.Join(folder, cerFile), derBytes, 0644); err != nil {
+		return err
+	}
+	log.Println("written ", cerFile)
+
+	return nil
+}
+
+// Load a certificate and its key
+func loadCertificate(folder string, certFile string, keyFile string) (*tls.Certificate, error) {
+	certificate, err := tls.LoadX509KeyPair(path.Join(folder, certFile), path.Join(folder, keyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	if certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+		return nil, err
+	}
+
+	return &certificate, nil
+}
+
+// Test if a certificate must be renewed
+func (options *CertificateOptions) expiring(certificate *x509.Certificate) bool {
+	return time.Now().Add(options.RenewBefore).After(certificate.NotAfter)
+}
+
+// Test if the certificate is signed by the certification authority, is valid
+// for all the local addresses, and isn't about to expire
+func (options *CertificateOptions) validCertificate(certificate *x509.Certificate, ca *x509.Certificate) bool {
+	if options.expiring(certificate) || certificate.CheckSignatureFrom(ca) != nil {
+		return false
+	}
+
+	for _, h := range options.Hosts {
+		if certificate.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Create the certification authority
+func (options *CertificateOptions) generateCA(folder string) (*tls.Certificate, error) {
+	log.Println("Generating certification authority ...")
+
+	caKey, err := options.generateKey("P256")
+	if err != nil {
+		return nil, err
+	}
+
+	caTemplate, err := options.generateSingleCertificate(true)
+	if err != nil {
+		return nil, err
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, publicKey(caKey), caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeCertificate(folder, caCertFile, caCerFile, caKeyFile, derBytes, caKey); err != nil {
+		return nil, err
+	}
+
+	log.Println("The certification authority has changed, it must be installed again with wccagent cert install")
+
+	return loadCertificate(folder, caCertFile, caKeyFile)
+}
+
+// Create the final certificate, signed by the certification authority. It
+// doesn't outlive the certification authority.
+func (options *CertificateOptions) generateCertificate(folder string, ca *tls.Certificate) (*tls.Certificate, error) {
+	log.Println("Generating certificates ...")
+
+	key, err := options.generateKey("P256")
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := options.generateSingleCertificate(false)
+	if err != nil {
+		return nil, err
+	}
+
+	if template.NotAfter.After(ca.Leaf.NotAfter) {
+		template.NotAfter = ca.Leaf.NotAfter
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, publicKey(key), ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeCertificate(folder, certFile, cerFile, keyFile, derBytes, key); err != nil {
+		return nil, err
+	}
+
+	return loadCertificate(folder, certFile, keyFile)
+}
+
+// Get the certificate of the secure websocket server, generating the certificates
+// that don't exist or must be renewed. Missing options get their default value.
+func GenerateCertificates(dataFolder string, options CertificateOptions) (*tls.Certificate, error) {
+	options = options.withDefaults()
+	folder := CertificatesFolder(dataFolder)
+
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return nil, err
+	}
+
+	ca, err := loadCertificate(folder, caCertFile, caKeyFile)
+	if err != nil || options.expiring(ca.Leaf) {
+		if ca, err = options.generateCA(folder); err != nil {
+			return nil, err
+		}
+	}
+
+	certificate, err := loadCertificate(folder, certFile, keyFile)
+	if err == nil && options.validCertificate(certificate.Leaf, ca.Leaf) {
+		return certificate, nil
+	}
+
+	return options.generateCertificate(folder, ca)
+}
+
+// Get the certificate of the secure websocket server, in each TLS handshake, renewing
+// it when it is about to expire. If it can't be renewed the current one is used until
+// it expires.
+func (agent *Agent) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	agent.certificateMutex.Lock()
+	defer agent.certificateMutex.Unlock()
+
+	options := &agent.config.Certificates
+
+	if agent.certificate == nil || options.expiring(agent.certificate.Leaf) {
+		certificate, err := GenerateCertificates(agent.config.DataFolder, *options)
+		if err != nil {
+			if agent.certificate == nil {
+				return nil, err
+			}
+
+			log.Println("can't renew the certificates: ", err)
+		} else {
+			agent.certificate = certificate
+		}
+	}
+
+	return agent.certificate, nil
+}
+
+// Get the TLS settings of the secure websocket server
+func (agent *Agent) serverTLSConfig() (*tls.Config, error) {
+	// Fail on start if the certificates can't be generated
+	if _, err := agent.getCertificate(nil); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{GetCertificate: agent.getCertificate}, nil
+}
+
+func (agent *Agent) deleteCertHandler(c *gin.Context) {
+	agent.certificateMutex.Lock()
+	defer agent.certificateMutex.Unlock()
+
+	DeleteCertificates(agent.config.DataFolder)
+	agent.certificate = nil
+}
+
+// Delete all the certificates of an agent, they are generated again when needed
+func DeleteCertificates(dataFolder string) {
+	for _, file := range certificateFiles {
+		os.Remove(path.Join(CertificatesFolder(dataFolder), file))
+	}
+}
@@ -0,0 +1,234 @@
+/*
+ * Whitecat Blocky Environment, certificate tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateCertificatesOptions(t *testing.T) {
+	folder := t.TempDir()
+
+	options := CertificateOptions{
+		Hosts:       []string{"localhost", "wccagent.local", "127.0.0.1"},
+		ValidFor:    time.Hour,
+		RenewBefore: 10 * time.Minute,
+	}
+
+	certificate, err := GenerateCertificates(folder, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range options.Hosts {
+		if err := certificate.Leaf.VerifyHostname(host); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if validity := certificate.Leaf.NotAfter.Sub(certificate.Leaf.NotBefore); validity != time.Hour {
+		t.Errorf("certificate valid for %s, want 1h", validity)
+	}
+
+	// A valid certificate is kept
+	same, err := GenerateCertificates(folder, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if same.Leaf.SerialNumber.Cmp(certificate.Leaf.SerialNumber) != 0 {
+		t.Error("valid certificate renewed")
+	}
+
+	// It is renewed when it expires before RenewBefore
+	options.RenewBefore = 2 * time.Hour
+
+	renewed, err := GenerateCertificates(folder, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if renewed.Leaf.SerialNumber.Cmp(certificate.Leaf.SerialNumber) == 0 {
+		t.Error("expiring certificate not renewed")
+	}
+}
+
+func TestAgentCertificateOptions(t *testing.T) {
+	agent := New(Config{
+		DataFolder:   t.TempDir(),
+		Certificates: CertificateOptions{Hosts: []string{"wccagent.local"}},
+	})
+
+	certificate, err := agent.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := certificate.Leaf.VerifyHostname("wccagent.local"); err != nil {
+		t.Error(err)
+	}
+
+	if certificate.Leaf.VerifyHostname("localhost") == nil {
+		t.Error("certificate valid for a host that isn't in the options")
+	}
+
+	if got, want := agent.Config().Certificates.RenewBefore, DefaultCertificateOptions().RenewBefore; got != want {
+		t.Errorf("RenewBefore %s, want the default %s", got, want)
+	}
+}
+
+func TestCertificatesStored(t *testing.T) {
+	dataFolder := t.TempDir()
+
+	certificate, err := GenerateCertificates(dataFolder, CertificateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range certificateFiles {
+		info, err := os.Stat(path.Join(CertificatesFolder(dataFolder), file))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The keys are only readable by the user
+		if strings.HasSuffix(file, "key.pem") && info.Mode().Perm() != 0600 {
+			t.Errorf("%s has mode %s", file, info.Mode().Perm())
+		}
+	}
+
+	ca, err := loadCertificate(CertificatesFolder(dataFolder), caCertFile, caKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := certificate.Leaf.CheckSignatureFrom(ca.Leaf); err != nil {
+		t.Error(err)
+	}
+
+	// Deleted certificates are generated again, with a new certification authority
+	DeleteCertificates(dataFolder)
+
+	if _, err := os.Stat(CACertificate(dataFolder)); !os.IsNotExist(err) {
+		t.Fatal("certification authority not deleted")
+	}
+
+	if _, err := GenerateCertificates(dataFolder, CertificateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	newCa, err := loadCertificate(CertificatesFolder(dataFolder), caCertFile, caKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if newCa.Leaf.SerialNumber.Cmp(ca.Leaf.SerialNumber) == 0 {
+		t.Error("certification authority not generated again")
+	}
+}
+
+func TestCertificationAuthorityRenewed(t *testing.T) {
+	dataFolder := t.TempDir()
+	folder := CertificatesFolder(dataFolder)
+
+	options := CertificateOptions{
+		ValidFor:    5 * time.Hour,
+		CAValidFor:  3 * time.Hour,
+		RenewBefore: 10 * time.Minute,
+	}
+
+	certificate, err := GenerateCertificates(dataFolder, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := loadCertificate(folder, caCertFile, caKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate doesn't outlive the certification authority
+	if certificate.Leaf.NotAfter.After(ca.Leaf.NotAfter) {
+		t.Errorf("certificate valid until %s, after the certification authority %s", certificate.Leaf.NotAfter, ca.Leaf.NotAfter)
+	}
+
+	// When the certification authority expires both are renewed
+	options.RenewBefore = 4 * time.Hour
+
+	renewed, err := GenerateCertificates(dataFolder, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renewedCa, err := loadCertificate(folder, caCertFile, caKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if renewedCa.Leaf.SerialNumber.Cmp(ca.Leaf.SerialNumber) == 0 {
+		t.Error("expiring certification authority not renewed")
+	}
+
+	if err := renewed.Leaf.CheckSignatureFrom(renewedCa.Leaf); err != nil {
+		t.Errorf("certificate not signed by the renewed certification authority: %v", err)
+	}
+}
+
+func TestAgentRenewsCertificate(t *testing.T) {
+	agent := New(Config{
+		DataFolder:   t.TempDir(),
+		Certificates: CertificateOptions{ValidFor: time.Hour, RenewBefore: 10 * time.Minute},
+	})
+
+	certificate, err := agent.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate is kept until it is about to expire
+	if same, _ := agent.getCertificate(nil); same != certificate {
+		t.Error("valid certificate renewed")
+	}
+
+	agent.config.Certificates.RenewBefore = 2 * time.Hour
+
+	renewed, err := agent.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if renewed.Leaf.SerialNumber.Cmp(certificate.Leaf.SerialNumber) == 0 {
+		t.Error("expiring certificate not renewed")
+	}
+}
@@ -0,0 +1,579 @@
+/*
+ * Whitecat Blocky Environment, board command queue
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+Board commands are executed in order by the command queue of their board, so a long operation
+doesn't block the control connection. Each attached board has its own queue, and a long operation
+on a board, such as an upgrade, doesn't delay the commands of the other boards. If the queue is
+full, or the board is being upgraded, the command is rejected immediately with the board-busy
+error. Commands for a board that is not attached are replied with the no-board error.
+
+Each board command has a deadline. If it is not finished before the deadline it is aborted, and
+the reply has the timeout error. The IDE can set the deadline of a command, in milliseconds:
+
+{"command": "boardReadFile", "id": "xx", "timeout": 5000, "arguments": {"path": "xxxx"}}
+
+A queued or running command can be cancelled using its id. The cancelled command is replied with
+the cancelled error:
+
+{"command": "cancel", "id": "yy", "arguments": {"id": "xx"}}
+{"notify": "boardReadFile", "id": "xx", "status": "error", "error": "cancelled", "info": {"content": ""}}
+{"notify": "cancel", "id": "yy", "status": "ok", "info": {"id": "xx"}}
+
+Firmware upgrades can't be cancelled once they are started.
+
+*/
+
+import (
+	"context"
+	"encoding/base64"
+	"time"
+)
+
+// Max number of commands waiting in the queue
+const commandQueueSize = 32
+
+// Default deadline of the board commands. Commands that are not listed don't
+// have a deadline.
+var commandDeadlines = map[string]time.Duration{
+	"boardReset":         30 * time.Second,
+	"boardStop":          30 * time.Second,
+	"boardGetDirContent": 30 * time.Second,
+	"boardReadFile":      60 * time.Second,
+	"boardWriteFile":     60 * time.Second,
+	"boardRemoveFile":    30 * time.Second,
+	"boardRunProgram":    60 * time.Second,
+	"boardRunCommand":    30 * time.Second,
+}
+
+// Commands that can't be cancelled once started
+var uncancellableCommands = map[string]bool{
+	"boardUpgrade": true,
+	"boardInstall": true,
+}
+
+type CancelArguments struct {
+	Id string `json:"id"`
+}
+
+type CancelInfo struct {
+	Id string `json:"id"`
+}
+
+// A command waiting in the queue, or running
+type queuedCommand struct {
+	agent     *Agent
+	c         *client
+	command   CommandMessage
+	arguments interface{}
+
+	// Content of the command, received before queue it
+	content []byte
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	started bool
+
+	// Board that executes the command, got when the command is queued
+	board *Board
+}
+
+// Get the error code for a command aborted by its context
+func contextErrorCode(err error) string {
+	if err == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+
+	return ErrCancelled
+}
+
+// Queue a board command in the queue of its board. Returns false if the queue
+// is full.
+func (agent *Agent) queueCommand(c *client, command CommandMessage, arguments interface{}, content []byte) bool {
+	q := &queuedCommand{
+		agent:     agent,
+		c:         c,
+		command:   command,
+		arguments: arguments,
+		content:   content,
+		board:     agent.findBoard(command.Board),
+	}
+
+	deadline := commandDeadlines[command.Command]
+	if command.Timeout > 0 {
+		deadline = time.Duration(command.Timeout) * time.Millisecond
+	}
+
+	if deadline > 0 {
+		q.ctx, q.cancel = context.WithTimeout(context.Background(), deadline)
+	} else {
+		q.ctx, q.cancel = context.WithCancel(context.Background())
+	}
+
+	if q.board == nil {
+		// There is no board to wait for, the command is replied at once
+		go agent.runCommand(q)
+		return true
+	}
+
+	return q.board.queueCommand(q)
+}
+
+// Queue a command in the queue of the board. Returns false if the queue is
+// full. If the board has been detached the command is replied at once.
+func (board *Board) queueCommand(q *queuedCommand) bool {
+	board.commandsMutex.Lock()
+	defer board.commandsMutex.Unlock()
+
+	if board.commandsStopped {
+		q.board = nil
+		go board.agent.runCommand(q)
+		return true
+	}
+
+	select {
+	case board.commands <- q:
+		board.pendingCommands = append(board.pendingCommands, q)
+		return true
+	default:
+		q.cancel()
+		return false
+	}
+}
+
+// Remove a command from the pending commands of its board
+func (q *queuedCommand) done() {
+	q.cancel()
+
+	if q.board == nil {
+		return
+	}
+
+	q.board.commandsMutex.Lock()
+	defer q.board.commandsMutex.Unlock()
+
+	for i, pending := range q.board.pendingCommands {
+		if pending == q {
+			q.board.pendingCommands = append(q.board.pendingCommands[:i], q.board.pendingCommands[i+1:]...)
+			break
+		}
+	}
+}
+
+// Test if the command has been aborted. If so, the command is replied with
+// the corresponding error, and the data that the board was sending is
+// discarded.
+func (q *queuedCommand) aborted(notification string, info interface{}) bool {
+	err := q.ctx.Err()
+	if err == nil {
+		return false
+	}
+
+	reply(q.c, q.command.Id, notification, contextErrorCode(err), info)
+
+	if q.board != nil {
+		q.board.setContext(nil)
+		q.board.consume()
+	}
+
+	return true
+}
+
+// Get the error code of a failed board operation. If the command has been
+// cancelled, or its deadline has expired, the operation has been aborted by the
+// command's context, whatever the error of the board is.
+func (q *queuedCommand) errorCode(errCode string) string {
+	if err := q.ctx.Err(); errCode != "" && err != nil {
+		return contextErrorCode(err)
+	}
+
+	return errCode
+}
+
+// Reply a command that has failed again after stop the program. The command
+// has timed out, unless it has been aborted by its context during the retry.
+func (q *queuedCommand) retryFailed(notification string, info interface{}) {
+	if q.aborted(notification, info) {
+		return
+	}
+
+	// Ooops, something is wrong
+	reply(q.c, q.command.Id, notification, ErrTimeout, info)
+	q.board.notify("boardTimeout", nil)
+}
+
+// Cancel a command sent by a client, searching it in the queues of the
+// attached boards. Returns the error code, or "" if the command is cancelled.
+func (agent *Agent) cancelCommand(c *client, id string) string {
+	for _, board := range agent.attachedBoards() {
+		if errCode, found := board.cancelCommand(c, id); found {
+			return errCode
+		}
+	}
+
+	return ErrNotFound
+}
+
+// Cancel a command of the board sent by a client
+func (board *Board) cancelCommand(c *client, id string) (errCode string, found bool) {
+	board.commandsMutex.Lock()
+	defer board.commandsMutex.Unlock()
+
+	for _, q := range board.pendingCommands {
+		if q.c == c && q.command.Id == id {
+			if q.started && uncancellableCommands[q.command.Command] {
+				return ErrNotAllowed, true
+			}
+
+			q.cancel()
+			return "", true
+		}
+	}
+
+	return "", false
+}
+
+// Cancel all the commands sent by a client that has gone
+func (agent *Agent) cancelCommands(c *client) {
+	for _, board := range agent.attachedBoards() {
+		board.commandsMutex.Lock()
+
+		for _, q := range board.pendingCommands {
+			if q.c == c && !(q.started && uncancellableCommands[q.command.Command]) {
+				q.cancel()
+			}
+		}
+
+		board.commandsMutex.Unlock()
+	}
+}
+
+// Start the command queue of the board, when it is attached
+func (board *Board) startCommands() {
+	board.commands = make(chan *queuedCommand, commandQueueSize)
+	board.detached = make(chan struct{})
+
+	go board.commandWorker()
+}
+
+// Stop the command queue of the board, when it is detached
+func (board *Board) stopCommands() {
+	board.commandsMutex.Lock()
+	defer board.commandsMutex.Unlock()
+
+	if board.detached != nil && !board.commandsStopped {
+		board.commandsStopped = true
+		close(board.detached)
+	}
+}
+
+// Test if the command queue of the board is stopped
+func (board *Board) commandsDetached() bool {
+	board.commandsMutex.Lock()
+	defer board.commandsMutex.Unlock()
+
+	return board.commandsStopped
+}
+
+// Execute the commands queued for the board, until the board is detached. The
+// commands left in the queue are replied with the no-board error.
+func (board *Board) commandWorker() {
+	for {
+		select {
+		case q := <-board.commands:
+			if board.commandsDetached() {
+				reply(q.c, q.command.Id, q.command.Command, ErrNoBoard, nil)
+				q.done()
+				continue
+			}
+
+			board.agent.runCommand(q)
+
+		case <-board.detached:
+			for {
+				select {
+				case q := <-board.commands:
+					reply(q.c, q.command.Id, q.command.Command, ErrNoBoard, nil)
+					q.done()
+
+				default:
+					return
+				}
+			}
+
+		case <-board.agent.done:
+			return
+		}
+	}
+}
+
+func (agent *Agent) runCommand(q *queuedCommand) {
+	defer q.done()
+
+	// The command can be cancelled, or the lease lost, while it is queued
+	if err := q.ctx.Err(); err != nil {
+		reply(q.c, q.command.Id, q.command.Command, contextErrorCode(err), nil)
+		return
+	}
+
+	if q.board != nil && q.board.upgrading() {
+		reply(q.c, q.command.Id, q.command.Command, ErrBoardBusy, nil)
+		return
+	}
+
+	if q.board != nil && leasedCommands[q.command.Command] {
+		if granted, holder := agent.hub.checkLease(q.c, q.board.id); !granted {
+			reply(q.c, q.command.Id, q.command.Command, ErrNoLease, LeaseInfo{Holder: holder, Board: q.board.id})
+			return
+		}
+	}
+
+	if q.board != nil {
+		q.board.commandsMutex.Lock()
+		q.started = true
+		q.board.commandsMutex.Unlock()
+
+		q.board.beginSession()
+		defer q.board.endSession()
+
+		q.board.setContext(q.ctx)
+		defer q.board.setContext(nil)
+	}
+
+	agent.executeCommand(q)
+}
+
+// Execute a board command
+func (agent *Agent) executeCommand(q *queuedCommand) {
+	c := q.c
+	command := q.command
+	arguments := q.arguments
+	board := q.board
+
+	switch command.Command {
+	case "boardReset", "boardStop":
+		if board == nil {
+			reply(c, command.Id, "boardReset", ErrNoBoard, nil)
+			return
+		}
+
+		if command.Command == "boardReset" {
+			board.notifyUpdate("Reseting board")
+		} else {
+			board.notifyUpdate("Stopping program")
+		}
+
+		errCode := q.errorCode(boardCall(func() {
+			board.reset(false)
+		}))
+		reply(c, command.Id, "boardReset", errCode, nil)
+		board.notifyAttached()
+
+	case "boardInfo":
+		if !agent.boardReady(c, command, board) {
+			return
+		}
+
+		reply(c, command.Id, "boardInfo", "", board.boardInfo())
+
+	case "boardGetDirContent":
+		if !agent.boardReady(c, command, board) {
+			return
+		}
+
+		path := arguments.(*PathArguments).Path
+
+		dirContent := board.getDirContent(path)
+		if dirContent == nil {
+			if q.aborted("boardGetDirContent", []DirEntry{}) {
+				return
+			}
+
+			// getDirContent has failed, stop program, and retry
+			if errCode := q.errorCode(board.stopProgram()); errCode != "" {
+				reply(c, command.Id, "boardGetDirContent", errCode, []DirEntry{})
+				return
+			}
+
+			dirContent = board.getDirContent(path)
+			if dirContent == nil {
+				q.retryFailed("boardGetDirContent", []DirEntry{})
+				return
+			}
+		}
+
+		reply(c, command.Id, "boardGetDirContent", "", dirContent)
+
+	case "boardReadFile":
+		if !agent.boardReady(c, command, board) {
+			return
+		}
+
+		readArguments := arguments.(*ReadFileArguments)
+		path := readArguments.Path
+
+		fileContent := board.readFile(path)
+		if fileContent == nil {
+			if q.aborted("boardReadFile", FileContentInfo{Content: []byte{}}) {
+				return
+			}
+
+			// readFile has failed, stop program, and retry
+			if errCode := q.errorCode(board.stopProgram()); errCode != "" {
+				reply(c, command.Id, "boardReadFile", errCode, FileContentInfo{Content: []byte{}})
+				return
+			}
+
+			fileContent = board.readFile(path)
+			if fileContent == nil {
+				q.retryFailed("boardReadFile", FileContentInfo{Content: []byte{}})
+				return
+			}
+		}
+
+		if readArguments.Transfer == BinaryTransfer {
+			reply(c, command.Id, "boardReadFile", "", BinaryTransferInfo{Transfer: BinaryTransfer, Size: len(fileContent)})
+			sendBinary(c, fileContent)
+		} else {
+			reply(c, command.Id, "boardReadFile", "", FileContentInfo{Content: fileContent})
+		}
+
+	case "boardWriteFile":
+		if !agent.boardReady(c, command, board) {
+			return
+		}
+
+		path := arguments.(*WriteFileArguments).Path
+
+		ret := board.writeFile(path, q.content)
+		if ret == "" {
+			if q.aborted("boardWriteFile", nil) {
+				return
+			}
+
+			// writeFile has failed, stop program, and retry
+			if errCode := q.errorCode(board.stopProgram()); errCode != "" {
+				reply(c, command.Id, "boardWriteFile", errCode, nil)
+				return
+			}
+
+			ret = board.writeFile(path, q.content)
+			if ret == "" {
+				q.retryFailed("boardWriteFile", nil)
+				return
+			}
+		}
+
+		reply(c, command.Id, "boardWriteFile", "", nil)
+
+	case "boardRemoveFile":
+		if !agent.boardReady(c, command, board) {
+			return
+		}
+
+		path, err := base64.StdEncoding.DecodeString(arguments.(*PathArguments).Path)
+		if err != nil {
+			reply(c, command.Id, "boardRemoveFile", ErrDecode, nil)
+			return
+		}
+
+		if !board.removeFile(string(path)) {
+			if !q.aborted("boardRemoveFile", nil) {
+				reply(c, command.Id, "boardRemoveFile", ErrTimeout, nil)
+			}
+			return
+		}
+
+		reply(c, command.Id, "boardRemoveFile", "", nil)
+
+	case "boardRunProgram":
+		if !agent.boardReady(c, command, board) {
+			return
+		}
+
+		path := arguments.(*RunProgramArguments).Path
+
+		errCode := boardCall(func() {
+			board.runProgram(path, q.content)
+		})
+		reply(c, command.Id, "boardRunProgram", errCode, nil)
+
+	case "boardRunCommand":
+		if !agent.boardReady(c, command, board) {
+			return
+		}
+
+		code, err := base64.StdEncoding.DecodeString(arguments.(*RunCommandArguments).Code)
+		if err != nil {
+			reply(c, command.Id, "boardRunCommand", ErrDecode, nil)
+			return
+		}
+
+		response := ""
+		errCode := boardCall(func() {
+			board.runCode(code)
+			response = board.runCommand([]byte("_code()"))
+		})
+		reply(c, command.Id, "boardRunCommand", errCode, RunCommandInfo{Response: []byte(response)})
+
+	case "boardUpgrade":
+		if board == nil {
+			reply(c, command.Id, "boardUpgraded", ErrNoBoard, nil)
+			return
+		}
+
+		custom := arguments.(*UpgradeArguments).Custom
+
+		reply(c, command.Id, "boardUpgraded", upgradeErrorCode(board.upgrade(false, "", custom)), nil)
+
+	case "boardInstall":
+		if board == nil {
+			reply(c, command.Id, "boardUpgraded", ErrNoBoard, nil)
+			return
+		}
+
+		if board.validFirmware {
+			// Board has a valid firmware, use boardUpgrade instead
+			reply(c, command.Id, "boardUpgraded", ErrNotAllowed, nil)
+			return
+		}
+
+		installArguments := arguments.(*InstallArguments)
+		if installArguments.Firmware == "" && !installArguments.Custom {
+			reply(c, command.Id, "commandRejected", ErrInvalidCommand, CommandRejectedInfo{Command: command.Command, Reason: "arguments: firmware failed on required"})
+			return
+		}
+
+		reply(c, command.Id, "boardUpgraded", upgradeErrorCode(board.upgrade(true, installArguments.Firmware, installArguments.Custom)), nil)
+
+	}
+}
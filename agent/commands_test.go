@@ -0,0 +1,156 @@
+/*
+ * Whitecat Blocky Environment, command queue tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Transport of a board that doesn't answer. Reset waits until the test
+// releases it, and then fails.
+type stuckTransport struct {
+	resetting chan struct{}
+	release   chan struct{}
+}
+
+func newStuckTransport() *stuckTransport {
+	return &stuckTransport{resetting: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (t *stuckTransport) Read(b []byte) (int, error)  { select {} }
+func (t *stuckTransport) Write(b []byte) (int, error) { return len(b), nil }
+func (t *stuckTransport) Connected() bool             { return true }
+func (t *stuckTransport) Close() error                { return nil }
+
+func (t *stuckTransport) Reset() (bool, error) {
+	t.resetting <- struct{}{}
+	<-t.release
+
+	return false, errors.New("reset failed")
+}
+
+func testBoard(t *testing.T, transport Transport) *Board {
+	agent := New(Config{DataFolder: t.TempDir()})
+
+	board := &Board{agent: agent, id: "test", transport: transport, RXQueue: make(chan byte, 10*1024)}
+	board.setState(BoardOpening, "")
+	board.setState(BoardBooting, "")
+	board.setState(BoardReady, "")
+
+	return board
+}
+
+// Get the reply of a command from the frames sent to a client
+func commandReply(t *testing.T, c *client, id string) Notification {
+	for {
+		select {
+		case f := <-c.out:
+			var notification Notification
+			json.Unmarshal(f.data, &notification)
+
+			if notification.Id == id {
+				return notification
+			}
+
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no reply for %s", id)
+		}
+	}
+}
+
+func TestStopAbortedByContext(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		abort   func(cancel context.CancelFunc)
+		timeout time.Duration
+		errCode string
+	}{
+		{"cancelled", func(cancel context.CancelFunc) { cancel() }, time.Minute, ErrCancelled},
+		{"deadline", func(cancel context.CancelFunc) {}, 50 * time.Millisecond, ErrTimeout},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			transport := newStuckTransport()
+			board := testBoard(t, transport)
+
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+
+			c := testClient()
+			q := &queuedCommand{
+				agent:   board.agent,
+				c:       c,
+				command: CommandMessage{Id: "1", Command: "boardStop"},
+				ctx:     ctx,
+				cancel:  cancel,
+				board:   board,
+			}
+
+			board.setContext(ctx)
+			go board.agent.executeCommand(q)
+
+			// The reset fails after the command is aborted
+			<-transport.resetting
+			test.abort(cancel)
+			<-ctx.Done()
+			close(transport.release)
+
+			if reply := commandReply(t, c, "1"); reply.Status != "error" || reply.Error != test.errCode {
+				t.Errorf("got %s %s, want error %s", reply.Status, reply.Error, test.errCode)
+			}
+		})
+	}
+}
+
+func TestStopFailed(t *testing.T) {
+	transport := newStuckTransport()
+	board := testBoard(t, transport)
+
+	c := testClient()
+	q := &queuedCommand{
+		agent:   board.agent,
+		c:       c,
+		command: CommandMessage{Id: "1", Command: "boardStop"},
+		ctx:     context.Background(),
+		board:   board,
+	}
+
+	go board.agent.executeCommand(q)
+
+	<-transport.resetting
+	close(transport.release)
+
+	if reply := commandReply(t, c, "1"); reply.Error != ErrNoBoard {
+		t.Errorf("got %s, want %s", reply.Error, ErrNoBoard)
+	}
+}
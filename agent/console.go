@@ -0,0 +1,200 @@
+/*
+ * Whitecat Blocky Environment, batched console output
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+The console output of the board is sent to the /up connections in batches. A batch is sent
+consoleBatchInterval after the first byte is received, or as soon as it has consoleBatchSize bytes.
+
+The board reader is never blocked by the console. If the output can't be sent as fast as the board
+sends it, it is dropped, and the clients receive a notification with the number of dropped bytes:
+
+{"notify": "consoleOverflow", "info": {"dropped": 1024}}
+
+When a client is slow, the output is only dropped for this client.
+
+Each board has its own console output, see boards.go.
+
+*/
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	consoleBatchSize     = 4 * 1024
+	consoleBatchInterval = 20 * time.Millisecond
+
+	// Max console output waiting to be batched
+	consoleBufferSize = 64 * 1024
+
+	// Max batches waiting to be sent to a client
+	consoleClientQueue = 64
+)
+
+// A batch of console output queued for a client, and the console offset after it
+type consoleOutput struct {
+	data   []byte
+	offset uint64
+}
+
+type ConsoleOverflowInfo struct {
+	Dropped int `json:"dropped"`
+}
+
+// Console output waiting to be sent
+type consoleBuffer struct {
+	mutex   sync.Mutex
+	data    []byte
+	dropped int
+
+	// Signaled when the buffer is not empty, and when a batch is full
+	ready chan struct{}
+	full  chan struct{}
+}
+
+func newConsoleBuffer() *consoleBuffer {
+	return &consoleBuffer{
+		ready: make(chan struct{}, 1),
+		full:  make(chan struct{}, 1),
+	}
+}
+
+// Signal a channel, if it is not already signaled
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Write a byte of console output. If the buffer is full the byte is dropped.
+func (console *consoleBuffer) write(b byte) {
+	console.mutex.Lock()
+	defer console.mutex.Unlock()
+
+	if len(console.data) >= consoleBufferSize {
+		console.dropped++
+		return
+	}
+
+	console.data = append(console.data, b)
+
+	if len(console.data) == 1 {
+		wake(console.ready)
+	}
+
+	if len(console.data) >= consoleBatchSize {
+		wake(console.full)
+	}
+}
+
+// Get the console output waiting to be sent, and the number of dropped bytes
+func (console *consoleBuffer) take() (data []byte, dropped int) {
+	console.mutex.Lock()
+	defer console.mutex.Unlock()
+
+	data, dropped = console.data, console.dropped
+	console.data, console.dropped = nil, 0
+
+	return data, dropped
+}
+
+// Send the console output of a board to the clients, until the board is detached
+func (board *Board) consoleBroadcast() {
+	agent := board.agent
+	console := board.console
+
+	for {
+		select {
+		case <-console.ready:
+		case <-board.quit:
+			return
+		case <-agent.done:
+			return
+		}
+
+		select {
+		case <-time.After(consoleBatchInterval):
+		case <-console.full:
+		}
+
+		data, dropped := console.take()
+
+		if board.upgrading() {
+			continue
+		}
+
+		if dropped > 0 {
+			board.notify("consoleOverflow", ConsoleOverflowInfo{Dropped: dropped})
+		}
+
+		if len(data) > 0 {
+			agent.bus.publish(board.id, "console", ConsoleInfo{Data: data})
+		}
+	}
+}
+
+// Queue a batch of console output for a client. If the client is slow the batch
+// is dropped, and the client is notified when it can receive output again.
+// Must be called with the hub locked.
+func (c *client) sendConsole(output consoleOutput) {
+	select {
+	case c.upOut <- output:
+		if c.upDropped > 0 {
+			c.trySend(frame{data: marshalNotification(Notification{
+				Notify: "consoleOverflow",
+				Info:   ConsoleOverflowInfo{Dropped: c.upDropped},
+			})})
+
+			c.upDropped = 0
+		}
+
+	default:
+		c.upDropped += len(output.data)
+	}
+}
+
+// Send the queued console output to a console connection, and keep in written
+// the console offset after the last output sent
+func upWriter(ws *websocket.Conn, out chan consoleOutput, written *atomic.Uint64) {
+	for output := range out {
+		if err := websocket.Message.Send(ws, string(output.data)); err != nil {
+			ws.Close()
+		} else {
+			written.Store(output.offset)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Whitecat Blocky Environment, console streaming tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// A sink that records the events of the bus
+type eventRecorder chan Event
+
+func (recorder eventRecorder) Handle(event Event) {
+	recorder <- event
+}
+
+func TestConsoleBufferDropsWhenFull(t *testing.T) {
+	console := newConsoleBuffer()
+
+	for i := 0; i < consoleBufferSize+10; i++ {
+		console.write('x')
+	}
+
+	select {
+	case <-console.full:
+	default:
+		t.Fatal("full batch not signaled")
+	}
+
+	data, dropped := console.take()
+	if len(data) != consoleBufferSize || dropped != 10 {
+		t.Fatalf("took %d bytes, %d dropped", len(data), dropped)
+	}
+
+	if data, dropped = console.take(); len(data) != 0 || dropped != 0 {
+		t.Fatalf("took %d bytes, %d dropped after the buffer is emptied", len(data), dropped)
+	}
+}
+
+func TestConsoleBatches(t *testing.T) {
+	board := testBoard(t, nil)
+	board.console = newConsoleBuffer()
+	board.quit = make(chan bool)
+	defer close(board.quit)
+
+	recorder := make(eventRecorder, 16)
+	defer board.agent.Subscribe(recorder, "console", "consoleOverflow")()
+
+	go board.consoleBroadcast()
+
+	// The output written before the batch is sent goes in one batch
+	for _, b := range []byte("Lua RTOS") {
+		board.console.write(b)
+	}
+
+	select {
+	case event := <-recorder:
+		if data := string(event.Info.(ConsoleInfo).Data); event.Type != "console" || event.Board != board.id || data != "Lua RTOS" {
+			t.Fatalf("unexpected event %s %s %q", event.Type, event.Board, data)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("console output not sent")
+	}
+}
+
+func TestSlowConsoleClient(t *testing.T) {
+	c := testClient()
+	c.upOut = make(chan consoleOutput, 1)
+
+	c.sendConsole(consoleOutput{data: []byte("first")})
+	c.sendConsole(consoleOutput{data: []byte("dropped")})
+
+	if c.upDropped != len("dropped") {
+		t.Fatalf("%d bytes dropped, expected %d", c.upDropped, len("dropped"))
+	}
+
+	// The client is notified of the dropped output when it can receive output
+	// again
+	<-c.upOut
+	c.sendConsole(consoleOutput{data: []byte("last")})
+
+	var overflow struct {
+		Notify string              `json:"notify"`
+		Info   ConsoleOverflowInfo `json:"info"`
+	}
+
+	json.Unmarshal((<-c.out).data, &overflow)
+	if overflow.Notify != "consoleOverflow" || overflow.Info.Dropped != len("dropped") {
+		t.Fatalf("unexpected notification %+v", overflow)
+	}
+
+	if output := <-c.upOut; string(output.data) != "last" {
+		t.Fatalf("output %q, expected last", output.data)
+	}
+}
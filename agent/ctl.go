@@ -0,0 +1,124 @@
+/*
+ * Whitecat Blocky Environment, local control socket
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+The agent listens on a Unix socket in its DataFolder (control/wccagent.sock) for scripts running in
+the same computer. Only the user that runs the agent can connect to it: the socket is created in a
+folder that only this user can access. The socket serves the REST API and the /events stream, see
+api.go and events.go, without the token.
+
+wccagent ctl is a client for the socket:
+
+wccagent ctl status
+wccagent ctl ls /examples
+wccagent ctl get /examples/blink.lua blink.lua
+wccagent ctl put blink.lua /examples/blink.lua
+wccagent ctl reset
+wccagent ctl console
+
+*/
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+)
+
+type ctlKey struct{}
+
+// Get the path of the control socket of the agent that uses a data folder
+func ControlSocket(dataFolder string) string {
+	return path.Join(dataFolder, "control", "wccagent.sock")
+}
+
+// Test if a request has been received on the control socket
+func trustedRequest(r *http.Request) bool {
+	trusted, _ := r.Context().Value(ctlKey{}).(bool)
+
+	return trusted
+}
+
+// Listen on the control socket
+func (agent *Agent) ctlStart() {
+	socket := ControlSocket(agent.config.DataFolder)
+
+	// The socket is only accessible through its folder, so other users can't
+	// connect to it between its creation and its chmod
+	folder := path.Dir(socket)
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		log.Println("can't create control socket folder: ", err)
+		return
+	}
+
+	if err := os.Chmod(folder, 0700); err != nil {
+		log.Println("can't restrict control socket folder: ", err)
+		return
+	}
+
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		log.Println("control socket is in use by other agent")
+		return
+	}
+
+	// Remove the socket of a previous run
+	os.Remove(socket)
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		log.Println("can't listen on control socket: ", err)
+		return
+	}
+
+	if err := os.Chmod(socket, 0600); err != nil {
+		log.Println("can't restrict control socket: ", err)
+		listener.Close()
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", agent.apiRouter())
+	mux.HandleFunc("/events", agent.events)
+
+	server := &http.Server{
+		Handler: mux,
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), ctlKey{}, true)
+		},
+	}
+
+	log.Println("Starting control socket on ", socket, " ...")
+	agent.serve(server, listener, "control socket")
+}
@@ -0,0 +1,89 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * Whitecat Blocky Environment, control socket tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestControlSocketFolder(t *testing.T) {
+	folder := t.TempDir()
+
+	// A folder left by a previous run, that other users can access
+	if err := os.Mkdir(path.Join(folder, "control"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	agent := New(Config{DataFolder: folder})
+	defer agent.Stop()
+
+	go agent.ctlStart()
+
+	socket := ControlSocket(folder)
+
+	var conn net.Conn
+	var err error
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if conn, err = net.Dial("unix", socket); err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Close()
+
+	info, err := os.Stat(path.Dir(socket))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mode := info.Mode().Perm(); mode != 0700 {
+		t.Errorf("control socket folder mode %o, want 700", mode)
+	}
+
+	info, err = os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mode := info.Mode().Perm(); mode&0077 != 0 {
+		t.Errorf("control socket mode %o, accessible by other users", mode)
+	}
+}
@@ -27,10 +27,11 @@
  * this software.
  */
 
-package main
+package agent
 
 import (
 	"archive/zip"
+	"errors"
 	"io"
 	"io/ioutil"
 	"log"
@@ -42,6 +43,10 @@ import (
 	"strings"
 )
 
+// Zip entries that would be written outside the destination folder, or that
+// are symbolic links, are rejected
+var errInvalidZipEntry = errors.New("invalid zip entry")
+
 func unzip(src, dest string) error {
 	r, err := zip.OpenReader(src)
 	if err != nil {
@@ -49,36 +54,28 @@ func unzip(src, dest string) error {
 	}
 	defer r.Close()
 
+	root := filepath.Clean(dest) + string(os.PathSeparator)
+
 	for _, f := range r.File {
-		rc, err := f.Open()
-		if err != nil {
-			return err
+		fpath := filepath.Join(dest, f.Name)
+		if !strings.HasPrefix(fpath, root) {
+			return errInvalidZipEntry
 		}
-		defer rc.Close()
 
-		fpath := filepath.Join(dest, f.Name)
-		if f.FileInfo().IsDir() {
-			os.MkdirAll(fpath, 0777)
-		} else {
-			var fdir string
-			if lastIndex := strings.LastIndex(fpath, string(os.PathSeparator)); lastIndex > -1 {
-				fdir = fpath[:lastIndex]
-			}
+		if f.Mode()&os.ModeSymlink != 0 {
+			return errInvalidZipEntry
+		}
 
-			err = os.MkdirAll(fdir, 0777)
-			if err != nil {
-				log.Fatal(err)
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(fpath, 0777); err != nil {
 				return err
 			}
-			f, err := os.OpenFile(
-				fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-			if err != nil {
+		} else {
+			if err := os.MkdirAll(filepath.Dir(fpath), 0777); err != nil {
 				return err
 			}
-			defer f.Close()
 
-			_, err = io.Copy(f, rc)
-			if err != nil {
+			if err := unzipFile(f, fpath); err != nil {
 				return err
 			}
 		}
@@ -87,10 +84,27 @@ func unzip(src, dest string) error {
 	return nil
 }
 
-func downloadEsptool() error {
-	notify("boardUpdate", "Downloading esptool")
+func unzipFile(f *zip.File, fpath string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	out, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, rc)
+	return err
+}
+
+func (agent *Agent) downloadEsptool() error {
+	agent.notifyUpdate("Downloading esptool")
 
-	url := BaseDownloadURL + "/esptool/esptool-" + runtime.GOOS + ".zip"
+	url := agent.config.DownloadURL + "/esptool/esptool-" + runtime.GOOS + ".zip"
 
 	log.Println("downloading esptool from " + url + " ...")
 
@@ -101,13 +115,15 @@ func downloadEsptool() error {
 		if err == nil {
 			log.Println("downloaded")
 
-			err = ioutil.WriteFile(path.Join(AppDataTmpFolder, "esptool.zip"), body, 0777)
+			err = ioutil.WriteFile(path.Join(agent.tmpFolder(), "esptool.zip"), body, 0777)
 			if err == nil {
-				notify("boardUpdate", "Unpacking esptool")
+				agent.notifyUpdate("Unpacking esptool")
 
 				log.Println("unpacking esptool ...")
 
-				unzip(path.Join(AppDataTmpFolder, "esptool.zip"), path.Join(AppDataTmpFolder, "utils"))
+				if err := unzip(path.Join(agent.tmpFolder(), "esptool.zip"), path.Join(agent.tmpFolder(), "utils")); err != nil {
+					return err
+				}
 			} else {
 				return err
 			}
@@ -121,10 +137,10 @@ func downloadEsptool() error {
 	return nil
 }
 
-func downloadFirmware(firmware string) error {
-	notify("boardUpdate", "Downloading firmware")
+func (agent *Agent) downloadFirmware(firmware string) error {
+	agent.notifyUpdate("Downloading firmware")
 
-	url := FirmwareURL + "?firmware=" + firmware
+	url := agent.config.firmwareURL() + "?firmware=" + firmware
 
 	log.Println("downloading firmware from " + url + "...")
 
@@ -133,13 +149,15 @@ func downloadFirmware(firmware string) error {
 		defer resp.Body.Close()
 		body, err := ioutil.ReadAll(resp.Body)
 		if err == nil {
-			err = ioutil.WriteFile(path.Join(AppDataTmpFolder, "firmware.zip"), body, 0777)
+			err = ioutil.WriteFile(path.Join(agent.tmpFolder(), "firmware.zip"), body, 0777)
 			if err == nil {
-				notify("boardUpdate", "Unpacking firmware")
+				agent.notifyUpdate("Unpacking firmware")
 
 				log.Println("unpacking firmware ...")
 
-				unzip(path.Join(AppDataTmpFolder, "firmware.zip"), path.Join(AppDataTmpFolder, "firmware_files"))
+				if err := unzip(path.Join(agent.tmpFolder(), "firmware.zip"), path.Join(agent.tmpFolder(), "firmware_files")); err != nil {
+					return err
+				}
 			} else {
 				return err
 			}
@@ -0,0 +1,133 @@
+/*
+ * Whitecat Blocky Environment, zip extraction tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type zipEntry struct {
+	name string
+	mode os.FileMode
+	body string
+}
+
+func writeZip(t *testing.T, entries []zipEntry) string {
+	file := filepath.Join(t.TempDir(), "test.zip")
+
+	out, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	w := zip.NewWriter(out)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		header.SetMode(entry.mode)
+
+		f, err := w.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := f.Write([]byte(entry.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func TestUnzip(t *testing.T) {
+	src := writeZip(t, []zipEntry{
+		{name: "firmware/", mode: os.ModeDir | 0755},
+		{name: "firmware/flash_args", mode: 0644, body: "--flash_mode dio"},
+		{name: "bootloader.bin", mode: 0644, body: "boot"},
+	})
+	dest := t.TempDir()
+
+	if err := unzip(src, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, body := range map[string]string{
+		"firmware/flash_args": "--flash_mode dio",
+		"bootloader.bin":      "boot",
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(content) != body {
+			t.Errorf("%s: got %q, want %q", name, content, body)
+		}
+	}
+}
+
+func TestUnzipRejectsInvalidEntries(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		entry zipEntry
+	}{
+		{"parent", zipEntry{name: "../evil", mode: 0644, body: "x"}},
+		{"nested parent", zipEntry{name: "firmware/../../evil", mode: 0644, body: "x"}},
+		{"sibling prefix", zipEntry{name: "../dest-evil/x", mode: 0644, body: "x"}},
+		{"symlink", zipEntry{name: "link", mode: os.ModeSymlink | 0777, body: "/etc/passwd"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			src := writeZip(t, []zipEntry{test.entry})
+			parent := t.TempDir()
+			dest := filepath.Join(parent, "dest")
+
+			if err := unzip(src, dest); err != errInvalidZipEntry {
+				t.Fatalf("got %v, want %v", err, errInvalidZipEntry)
+			}
+
+			files, err := ioutil.ReadDir(parent)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(files) != 0 {
+				t.Errorf("unzip wrote %d entries next to the destination", len(files))
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+//go:build linux
+// +build linux
+
+/*
+ * Whitecat Blocky Environment, Lua RTOS emulator tests helpers
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jyex/whitecat-create-agent/emulator"
+)
+
+// Prerequisites uploaded to the emulated boards. The emulator prints its own
+// board info, whatever board-info.lua has.
+var emulatorPrerequisites = map[string]string{
+	"lua/board-info.lua": "print(\"{}\")\n",
+	"lua/lib/block.lua":  "-- block\n",
+}
+
+// Attach a board emulated on a pseudo-terminal to a new agent. The IDE server
+// doesn't have the prerequisites, so the last downloaded ones are uploaded.
+// The agent runs the command worker, and it is stopped when the test ends.
+func newEmulatedBoard(t *testing.T) (*Board, *emulator.Emulator) {
+	folder := t.TempDir()
+
+	for name, content := range emulatorPrerequisites {
+		file := path.Join(folder, "tmp", "prerequisites_files", name)
+
+		if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ide := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(ide.Close)
+
+	agent := New(Config{DataFolder: folder, BaseIdeURL: ide.URL, BaseURL: ide.URL, EmulatorDevices: true})
+
+	emu := emulator.New()
+
+	pty, err := emulator.OpenPty()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go emu.RunPty(pty)
+
+	transport, err := agent.openTransport(pty.Name)
+	if err != nil {
+		pty.Close()
+		t.Fatal(err)
+	}
+
+	board := &Board{agent: agent, id: pty.Name}
+	board.setState(BoardOpening, "")
+	board.attach(transport, pty.Name)
+
+	t.Cleanup(func() {
+		agent.Stop()
+		pty.Close()
+	})
+
+	if state := board.getState(); state != BoardReady {
+		t.Fatalf("board %s, expected %s", state, BoardReady)
+	}
+
+	return board, emu
+}
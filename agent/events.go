@@ -0,0 +1,368 @@
+/*
+ * Whitecat Blocky Environment, Server-Sent Events stream
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+Notifications and console output are also sent as Server-Sent Events on /events, for dashboards
+and tools that only follow the board. The event type is the notification type, and the data is
+the notification, as sent to the IDE:
+
+event:boardRuntimeError
+id:12.3456
+data:{"notify":"boardRuntimeError","info":{"where":"xx","line":"xx","exception":"xx","message":"xx"}}
+
+The console output is sent in console events. The data is a JSON string, because the output can
+have any character:
+
+event:console
+id:12.3470
+data:"Lua RTOS\r\n"
+
+The stream can be filtered by event type, with one or more type query parameters:
+
+/events?type=boardAttached,boardDetached&type=console
+
+and by board, with the board query parameter (/events?board=xx), see boards.go.
+
+As in the REST API the token is sent in the Authorization header, or in the token query parameter
+for browsers (/events?token=xxxx).
+
+The event id is the position of the event in the replay buffer of the agent. When the browser
+reconnects it sends the Last-Event-ID header, and the agent sends the events that were missed, and
+the console output of the selected board. If some of them are no longer in the replay buffer, an
+eventsMissed event is sent first, whatever the selected types are:
+
+event:eventsMissed
+id:530.70000
+data:{"notify":"eventsMissed","info":{"notifications":18,"console":5904}}
+
+A listener that can't receive the events as fast as they are generated, or the replayed events, is
+disconnected, and it can resume the stream in the same way.
+
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/manucorporat/sse"
+)
+
+// Size of the queue of events waiting to be sent to a listener
+const eventQueueSize = 256
+
+// A notification, or console output, as sent to the event listeners. For
+// console events data is the raw output.
+type agentEvent struct {
+	Type  string
+	Id    string
+	Board string
+	Data  []byte
+}
+
+// Events that a listener has missed when it resumes the stream, because they are
+// no longer in the replay buffer: notifications, and bytes of console output
+type EventsMissedInfo struct {
+	Notifications int `json:"notifications"`
+	Console       int `json:"console"`
+}
+
+// An events listener
+type eventListener struct {
+	// Event types sent to the listener, nil for all
+	types map[string]bool
+
+	// Board whose events are sent to the listener, empty for all
+	board string
+
+	events chan agentEvent
+
+	// Closed when the listener is too slow
+	overflow chan struct{}
+}
+
+func newEventListener(types map[string]bool, board string) *eventListener {
+	return &eventListener{
+		types:    types,
+		board:    board,
+		events:   make(chan agentEvent, eventQueueSize),
+		overflow: make(chan struct{}),
+	}
+}
+
+func (l *eventListener) wants(event agentEvent) bool {
+	// Events that are not sent by a board are sent to all the listeners
+	return (l.types == nil || l.types[event.Type]) && (l.board == "" || event.Board == "" || l.board == event.Board)
+}
+
+// Get the type of a notification, and the board that has sent it
+func notificationType(msg []byte) (notify string, board string) {
+	var notification struct {
+		Notify string `json:"notify"`
+		Board  string `json:"board"`
+	}
+
+	json.Unmarshal(msg, &notification)
+
+	return notification.Notify, notification.Board
+}
+
+// Id of an event, from its position in the replay buffer
+func eventId(seq uint64, offset uint64) string {
+	return fmt.Sprintf("%d.%d", seq, offset)
+}
+
+func parseEventId(id string) (seq uint64, offset uint64, ok bool) {
+	if _, err := fmt.Sscanf(id, "%d.%d", &seq, &offset); err != nil {
+		return 0, 0, false
+	}
+
+	return seq, offset, true
+}
+
+func notificationEvent(msg []byte, seq uint64, offset uint64) agentEvent {
+	notify, board := notificationType(msg)
+
+	return agentEvent{Type: notify, Id: eventId(seq, offset), Board: board, Data: msg}
+}
+
+func consoleEvent(board string, data []byte, seq uint64, offset uint64) agentEvent {
+	return agentEvent{Type: "console", Id: eventId(seq, offset), Board: board, Data: data}
+}
+
+// Get the Server-Sent Event of an event. Console output is sent as a JSON string.
+func (event agentEvent) sse() sse.Event {
+	data := event.Data
+	if event.Type == "console" {
+		data, _ = json.Marshal(string(event.Data))
+	}
+
+	return sse.Event{Event: event.Type, Id: event.Id, Data: string(data)}
+}
+
+// Send an event to the listeners that want it. Slow listeners are removed. Must
+// be called with the hub locked.
+func (hub *Hub) sendEvent(event agentEvent) {
+	for i := 0; i < len(hub.listeners); i++ {
+		l := hub.listeners[i]
+		if !l.wants(event) {
+			continue
+		}
+
+		select {
+		case l.events <- event:
+		default:
+			log.Println("events listener is too slow, disconnecting")
+
+			close(l.overflow)
+			hub.listeners = append(hub.listeners[:i], hub.listeners[i+1:]...)
+			i--
+		}
+	}
+}
+
+// Add a listener. If lastId is not empty, the events after lastId that are in
+// the replay buffer are queued for the listener.
+func (hub *Hub) addListener(l *eventListener, lastId string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.listeners = append(hub.listeners, l)
+
+	seq, offset, ok := parseEventId(lastId)
+	if !ok || seq > hub.replay.seq || offset > hub.replay.consoleOffset {
+		// New listener, or the agent has been restarted
+		return
+	}
+
+	// The listener is disconnected if the replayed events don't fit in its
+	// queue, and it resumes the stream from the last event it has received
+	queue := func(event agentEvent) bool {
+		select {
+		case l.events <- event:
+			return true
+		default:
+			log.Println("events listener can't receive the replayed events, disconnecting")
+
+			close(l.overflow)
+			hub.listeners = hub.listeners[:len(hub.listeners)-1]
+			return false
+		}
+	}
+
+	msgs, missed := hub.replay.notificationsBetween(seq, hub.replay.seq)
+	console, consoleMissed := hub.replay.consoleSince(offset, l.board)
+
+	if missed > 0 || consoleMissed > 0 {
+		// The events are no longer in the replay buffer
+		seq += uint64(missed)
+		offset += uint64(consoleMissed)
+
+		msg := marshalNotification(Notification{
+			Notify: "eventsMissed",
+			Info:   EventsMissedInfo{Notifications: missed, Console: consoleMissed},
+		})
+		if !queue(agentEvent{Type: "eventsMissed", Id: eventId(seq, offset), Data: msg}) {
+			return
+		}
+	}
+
+	for _, msg := range msgs {
+		seq++
+
+		if event := notificationEvent(msg, seq, offset); l.wants(event) && !queue(event) {
+			return
+		}
+	}
+
+	event := consoleEvent(l.board, console, hub.replay.seq, hub.replay.consoleOffset)
+	if len(event.Data) > 0 && l.wants(event) {
+		queue(event)
+	}
+}
+
+func (hub *Hub) removeListener(l *eventListener) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	for i, listener := range hub.listeners {
+		if listener == l {
+			hub.listeners = append(hub.listeners[:i], hub.listeners[i+1:]...)
+			break
+		}
+	}
+}
+
+// Get the event types requested in the type query parameters
+func eventTypes(r *http.Request) map[string]bool {
+	var types map[string]bool
+
+	for _, param := range r.URL.Query()["type"] {
+		for _, event := range strings.Split(param, ",") {
+			if event = strings.TrimSpace(event); event != "" {
+				if types == nil {
+					types = make(map[string]bool)
+				}
+
+				types[event] = true
+			}
+		}
+	}
+
+	return types
+}
+
+// Handler of the /events stream
+func (agent *Agent) events(w http.ResponseWriter, r *http.Request) {
+	token := bearerToken(r)
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+
+	if status, errCode := agent.checkApiRequest(r, token); errCode != "" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "{\"error\":%q}\n", errCode)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	l := newEventListener(eventTypes(r), r.URL.Query().Get("board"))
+
+	lastId := r.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = r.URL.Query().Get("lastEventId")
+	}
+
+	agent.hub.addListener(l, lastId)
+	defer agent.hub.removeListener(l)
+
+	w.Header().Set("Content-Type", sse.ContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Comments are sent when there are no events, so dead connections are
+	// detected
+	interval := time.Duration(agent.config.HeartbeatInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	keepAlive := time.NewTicker(interval)
+	defer keepAlive.Stop()
+
+	for {
+		var err error
+
+		select {
+		case event := <-l.events:
+			err = sse.Encode(w, event.sse())
+
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ":\n\n")
+
+		case <-l.overflow:
+			// The events queued before the overflow are sent, so the stream
+			// is resumed after them
+			for {
+				select {
+				case event := <-l.events:
+					if sse.Encode(w, event.sse()) != nil {
+						return
+					}
+
+				default:
+					flusher.Flush()
+					return
+				}
+			}
+
+		case <-r.Context().Done():
+			return
+		}
+
+		if err != nil {
+			return
+		}
+
+		flusher.Flush()
+	}
+}
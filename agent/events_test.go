@@ -0,0 +1,142 @@
+/*
+ * Whitecat Blocky Environment, event stream tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// Broadcast n notifications
+func broadcastUpdates(hub *Hub, n int) {
+	for i := 0; i < n; i++ {
+		hub.broadcast(marshalNotification(Notification{Notify: "boardUpdate", Info: UpdateInfo{What: []byte(fmt.Sprint(i))}}))
+	}
+}
+
+// Get the events queued for a listener
+func queuedEvents(l *eventListener) []agentEvent {
+	var events []agentEvent
+
+	for {
+		select {
+		case event := <-l.events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestEventsReplayConsoleOfBoard(t *testing.T) {
+	hub := &Hub{}
+
+	hub.broadcastConsole("a", []byte("a1 "))
+	hub.broadcastConsole("b", []byte("b1 "))
+	hub.broadcastConsole("a", []byte("a2 "))
+
+	l := newEventListener(map[string]bool{"console": true}, "a")
+	hub.addListener(l, eventId(0, 0))
+
+	events := queuedEvents(l)
+	if len(events) != 1 || events[0].Board != "a" || string(events[0].Data) != "a1 a2 " {
+		t.Fatalf("unexpected events %+v", events)
+	}
+
+	l = newEventListener(map[string]bool{"console": true}, "")
+	hub.addListener(l, eventId(0, 3))
+
+	events = queuedEvents(l)
+	if len(events) != 1 || string(events[0].Data) != "b1 a2 " {
+		t.Fatalf("unexpected events %+v", events)
+	}
+}
+
+func TestEventsReplayMissed(t *testing.T) {
+	hub := &Hub{}
+
+	broadcastUpdates(hub, replayNotifications+10)
+	hub.broadcastConsole("a", make([]byte, replayConsole+20))
+
+	l := newEventListener(map[string]bool{"boardUpdate": true}, "")
+	hub.addListener(l, eventId(0, 0))
+
+	events := queuedEvents(l)
+	if len(events) < 2 || events[0].Type != "eventsMissed" {
+		t.Fatalf("unexpected events %+v", events)
+	}
+
+	var missed struct {
+		Info EventsMissedInfo `json:"info"`
+	}
+	json.Unmarshal(events[0].Data, &missed)
+
+	if missed.Info.Notifications != 10 || missed.Info.Console != 20 {
+		t.Fatalf("missed %+v, expected 10 notifications and 20 console bytes", missed.Info)
+	}
+
+	// Resuming from the missed event replays the events after it
+	if events[0].Id != eventId(10, 20) || events[1].Id != eventId(11, 20) {
+		t.Fatalf("ids %s %s", events[0].Id, events[1].Id)
+	}
+}
+
+func TestEventsReplayOverflow(t *testing.T) {
+	hub := &Hub{}
+
+	broadcastUpdates(hub, eventQueueSize+10)
+
+	l := newEventListener(nil, "")
+	hub.addListener(l, eventId(0, 0))
+
+	select {
+	case <-l.overflow:
+	default:
+		t.Fatal("listener not disconnected")
+	}
+
+	if len(hub.listeners) != 0 {
+		t.Fatal("listener not removed")
+	}
+
+	// The listener resumes from the last event it has received
+	events := queuedEvents(l)
+	if len(events) != eventQueueSize {
+		t.Fatalf("%d events, expected %d", len(events), eventQueueSize)
+	}
+
+	l = newEventListener(nil, "")
+	hub.addListener(l, events[len(events)-1].Id)
+
+	if events = queuedEvents(l); len(events) != 10 {
+		t.Fatalf("%d events after resume, expected 10", len(events))
+	}
+}
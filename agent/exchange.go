@@ -0,0 +1,114 @@
+/*
+ * Whitecat Blocky Environment, exclusive access to the board port
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+The board operations that talk with Lua RTOS through its console (reset, sendCommand, writeFile,
+readFile, runProgram, ...) are done in an exclusive session on the port of the board. Only one
+session can be in progress for a board, so the command queue, the attach of the board and the
+reset done when the IDE is attached don't mix their exchanges.
+
+While a session is in progress the console input sent by the IDE, the REST API or gRPC isn't
+written to the port, because it would corrupt the exchange. It is queued, and it is written when
+the session ends. If more than consoleInputQueueSize bytes are waiting, the input is rejected:
+
+{"notify": "boardConsoleIn", "status": "error", "error": "board-busy"}
+
+*/
+
+// Max number of console input bytes queued while a session is in progress
+const consoleInputQueueSize = 4096
+
+// Start an exclusive session on the port of the board. Blocks until the
+// session in progress, if any, ends.
+func (board *Board) beginSession() {
+	board.sessionMutex.Lock()
+
+	board.inputMutex.Lock()
+	board.inSession = true
+	board.inputMutex.Unlock()
+}
+
+// End the session in progress, and write the console input queued while it
+// was in progress
+func (board *Board) endSession() {
+	board.inputMutex.Lock()
+	input := board.pendingInput
+	board.pendingInput = nil
+	board.inSession = false
+
+	if len(input) > 0 && !board.closed() {
+		board.transport.Write(input)
+	}
+	board.inputMutex.Unlock()
+
+	board.sessionMutex.Unlock()
+}
+
+// Execute a board operation in an exclusive session on the port
+func (board *Board) exclusive(operation func()) {
+	board.beginSession()
+	defer board.endSession()
+
+	operation()
+}
+
+// Write console input to the board. If a session is in progress the input
+// is queued. Returns the error code, or "" if the input is accepted.
+func (board *Board) writeConsole(data []byte) string {
+	board.inputMutex.Lock()
+	defer board.inputMutex.Unlock()
+
+	if board.inSession {
+		if len(board.pendingInput)+len(data) > consoleInputQueueSize {
+			return ErrBoardBusy
+		}
+
+		board.pendingInput = append(board.pendingInput, data...)
+		return ""
+	}
+
+	if !board.closed() {
+		board.transport.Write(data)
+	}
+
+	return ""
+}
+
+// Test if the transport of the board is closed
+func (board *Board) closed() bool {
+	select {
+	case <-board.quit:
+		return true
+	default:
+		return false
+	}
+}
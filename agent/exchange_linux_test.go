@@ -0,0 +1,125 @@
+//go:build linux
+// +build linux
+
+/*
+ * Whitecat Blocky Environment, exclusive port sessions tests with the Lua RTOS emulator
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Commands queued concurrently are executed one at a time, and their
+// transfers are not corrupted
+func TestConcurrentCommands(t *testing.T) {
+	board, emu := newEmulatedBoard(t)
+
+	c := emulatorClient(t, board)
+
+	files := make(map[string][]byte)
+	for i := 0; i < 4; i++ {
+		files[fmt.Sprintf("/file%d.bin", i)] = bytes.Repeat([]byte{byte(i)}, BoardChunkSize+i*100)
+	}
+
+	var wg sync.WaitGroup
+	ids := make(chan string, len(files))
+
+	for name, content := range files {
+		wg.Add(1)
+
+		go func(name string, content []byte) {
+			defer wg.Done()
+
+			command := CommandMessage{Id: name, Command: "boardWriteFile", Board: board.id}
+			if !board.agent.queueCommand(c, command, &WriteFileArguments{Path: name}, content) {
+				t.Errorf("%s not queued", name)
+			}
+
+			ids <- name
+		}(name, content)
+	}
+
+	wg.Wait()
+	close(ids)
+
+	for id := range ids {
+		if reply := commandReply(t, c, id); reply.Status != "ok" {
+			t.Fatalf("%s not written: %s", id, reply.Error)
+		}
+	}
+
+	for name, content := range files {
+		if written, _ := emu.ReadFile(name); !bytes.Equal(written, content) {
+			t.Fatalf("%s: written %d bytes, expected %d", name, len(written), len(content))
+		}
+	}
+}
+
+// Console input typed during a file transfer is written to the board when the
+// transfer ends
+func TestConsoleInputDuringTransfer(t *testing.T) {
+	board, emu := newEmulatedBoard(t)
+
+	c := emulatorClient(t, board)
+
+	content := bytes.Repeat([]byte("0123456789"), 2*BoardChunkSize)
+
+	command := CommandMessage{Id: "write", Command: "boardWriteFile", Board: board.id}
+	if !board.agent.queueCommand(c, command, &WriteFileArguments{Path: "/data.txt"}, content) {
+		t.Fatal("command not queued")
+	}
+
+	// Wait for the session of the transfer
+	for inSession := false; !inSession; {
+		board.inputMutex.Lock()
+		inSession = board.inSession
+		board.inputMutex.Unlock()
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if errCode := board.writeConsole([]byte("print(\"typed\")\r")); errCode != "" {
+		t.Fatalf("input rejected: %s", errCode)
+	}
+
+	if reply := commandReply(t, c, "write"); reply.Status != "ok" {
+		t.Fatalf("file not written: %s", reply.Error)
+	}
+
+	if written, _ := emu.ReadFile("/data.txt"); !bytes.Equal(written, content) {
+		t.Fatalf("written %d bytes, expected %d", len(written), len(content))
+	}
+
+	waitConsole(t, c, "\ntyped\r\n")
+}
@@ -0,0 +1,179 @@
+/*
+ * Whitecat Blocky Environment, exclusive port sessions tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Transport that records the bytes written to the board
+type recordingTransport struct {
+	mutex   sync.Mutex
+	written []byte
+}
+
+func (t *recordingTransport) Read(b []byte) (int, error) { select {} }
+func (t *recordingTransport) Connected() bool            { return true }
+func (t *recordingTransport) Close() error               { return nil }
+func (t *recordingTransport) Reset() (bool, error)       { return true, nil }
+
+func (t *recordingTransport) Write(b []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.written = append(t.written, b...)
+
+	return len(b), nil
+}
+
+func (t *recordingTransport) output() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return string(t.written)
+}
+
+func TestConsoleInputQueuedDuringSession(t *testing.T) {
+	transport := &recordingTransport{}
+	board := testBoard(t, transport)
+
+	board.beginSession()
+
+	for _, input := range []string{"print(", "1)\r"} {
+		if errCode := board.writeConsole([]byte(input)); errCode != "" {
+			t.Fatalf("input rejected: %s", errCode)
+		}
+	}
+
+	if output := transport.output(); output != "" {
+		t.Fatalf("input %q written during the session", output)
+	}
+
+	board.endSession()
+
+	if output := transport.output(); output != "print(1)\r" {
+		t.Fatalf("written %q after the session, expected the queued input", output)
+	}
+
+	// Without a session the input is written at once
+	board.writeConsole([]byte("x"))
+
+	if output := transport.output(); output != "print(1)\rx" {
+		t.Fatalf("written %q", output)
+	}
+}
+
+func TestConsoleInputQueueFull(t *testing.T) {
+	transport := &recordingTransport{}
+	board := testBoard(t, transport)
+
+	board.beginSession()
+
+	if errCode := board.writeConsole(bytes.Repeat([]byte("a"), consoleInputQueueSize-1)); errCode != "" {
+		t.Fatalf("input rejected: %s", errCode)
+	}
+
+	if errCode := board.writeConsole([]byte("b")); errCode != "" {
+		t.Fatalf("input filling the queue rejected: %s", errCode)
+	}
+
+	if errCode := board.writeConsole([]byte("c")); errCode != ErrBoardBusy {
+		t.Fatalf("error %q with the queue full, expected %s", errCode, ErrBoardBusy)
+	}
+
+	board.endSession()
+
+	// The rejected input is lost, and the queue is empty again
+	expected := strings.Repeat("a", consoleInputQueueSize-1) + "b"
+	if output := transport.output(); output != expected {
+		t.Fatalf("written %d bytes, expected %d", len(output), len(expected))
+	}
+
+	board.beginSession()
+	defer board.endSession()
+
+	if errCode := board.writeConsole(bytes.Repeat([]byte("d"), consoleInputQueueSize)); errCode != "" {
+		t.Fatalf("input rejected after the queue is written: %s", errCode)
+	}
+}
+
+// Concurrent operations and console input don't mix their bytes in the port
+func TestExclusiveSessions(t *testing.T) {
+	transport := &recordingTransport{}
+	board := testBoard(t, transport)
+
+	var active atomic.Int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				board.exclusive(func() {
+					if n := active.Add(1); n != 1 {
+						t.Errorf("%d sessions in progress", n)
+					}
+
+					transport.Write([]byte("["))
+					time.Sleep(time.Millisecond / 10)
+					transport.Write([]byte("]"))
+
+					active.Add(-1)
+				})
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				if errCode := board.writeConsole([]byte("x")); errCode != "" {
+					t.Errorf("input rejected: %s", errCode)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	output := transport.output()
+
+	if strings.Count(output, "x") != 8*20 || strings.Count(output, "[]") != 8*20 {
+		t.Fatalf("console input written inside a session: %q", output)
+	}
+}
@@ -0,0 +1,681 @@
+/*
+ * Whitecat Blocky Environment, gRPC service
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+The agent serves the gRPC service defined in agent.proto on GrpcAddress, for test harnesses that
+want typed clients generated from the service definition. GrpcAddress can be a local TCP address
+(localhost:8083), or a Unix socket (unix:/path/to/socket). The service is disabled if GrpcAddress
+is empty.
+
+The service is served with HTTP/2 without TLS, as the gRPC clients do for insecure channels. The
+messages must not be compressed.
+
+Calls must send a paired token, or a token created with wccagent -token, in the authorization
+metadata. The board commands are executed as the REST API commands, see api.go. The board of a
+call is selected with the board metadata, the default board if it is not sent, see boards.go.
+
+*/
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const grpcServicePath = "/whitecat.agent.v1.Agent/"
+
+// gRPC status codes
+const (
+	grpcOK                 = 0
+	grpcCancelled          = 1
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// gRPC status code for each error code
+var grpcCodes = map[string]int{
+	ErrTimeout:         grpcDeadlineExceeded,
+	ErrBoardBusy:       grpcUnavailable,
+	ErrDecode:          grpcInvalidArgument,
+	ErrNoBoard:         grpcUnavailable,
+	ErrInvalidFirmware: grpcFailedPrecondition,
+	ErrDownload:        grpcUnavailable,
+	ErrNotAllowed:      grpcPermissionDenied,
+	ErrInvalidCommand:  grpcInvalidArgument,
+	ErrFileTooLarge:    grpcResourceExhausted,
+	ErrTransfer:        grpcInternal,
+	ErrNoLease:         grpcFailedPrecondition,
+	ErrCancelled:       grpcCancelled,
+	ErrNotFound:        grpcNotFound,
+	ErrNotPaired:       grpcUnauthenticated,
+}
+
+// A gRPC status
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (err *grpcError) Error() string {
+	return err.message
+}
+
+func grpcFailed(errCode string) error {
+	code, ok := grpcCodes[errCode]
+	if !ok {
+		code = grpcUnknown
+	}
+
+	return &grpcError{code: code, message: errCode}
+}
+
+// A gRPC call
+type grpcCall struct {
+	agent *Agent
+
+	w   http.ResponseWriter
+	r   *http.Request
+	ctx context.Context
+
+	// Deadline of the board commands, in milliseconds
+	timeout int
+
+	// Board of the call, from the board metadata, empty for the default board
+	board string
+
+	sendMutex sync.Mutex
+}
+
+// Handler of a gRPC method
+type grpcMethod func(call *grpcCall) error
+
+var grpcMethods = map[string]grpcMethod{
+	"ListBoards":    grpcListBoards,
+	"GetDirContent": grpcGetDirContent,
+	"ReadFile":      grpcReadFile,
+	"WriteFile":     grpcWriteFile,
+	"RemoveFile":    grpcRemoveFile,
+	"RunProgram":    grpcRunProgram,
+	"RunCommand":    grpcRunCommand,
+	"Stop":          grpcSimpleCommand("boardStop"),
+	"Reset":         grpcSimpleCommand("boardReset"),
+	"Upgrade":       grpcUpgrade,
+	"Console":       grpcConsole,
+	"Notifications": grpcNotifications,
+}
+
+// Receive a message. Returns io.EOF when the client has sent all its messages.
+func (call *grpcCall) recv(m proto.Message) error {
+	var header [5]byte
+
+	if _, err := io.ReadFull(call.r.Body, header[:]); err != nil {
+		return err
+	}
+
+	if header[0] != 0 {
+		return &grpcError{code: grpcUnimplemented, message: "compression not supported"}
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > MaxFileSize+1024 {
+		return grpcFailed(ErrFileTooLarge)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(call.r.Body, data); err != nil {
+		return err
+	}
+
+	if err := proto.Unmarshal(data, m); err != nil {
+		return grpcFailed(ErrDecode)
+	}
+
+	return nil
+}
+
+// Send a message
+func (call *grpcCall) send(m proto.Message) error {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+
+	call.sendMutex.Lock()
+	defer call.sendMutex.Unlock()
+
+	if _, err := call.w.Write(append(header[:], data...)); err != nil {
+		return err
+	}
+
+	call.w.(http.Flusher).Flush()
+
+	return nil
+}
+
+// Execute a board command for the call
+func (call *grpcCall) command(name string, arguments interface{}, content []byte) (apiReply, []byte, error) {
+	reply, data, errCode := call.agent.apiExecute(call.ctx, call.board, name, call.timeout, arguments, content)
+	if errCode != "" {
+		return reply, nil, grpcFailed(errCode)
+	}
+
+	return reply, data, nil
+}
+
+func grpcListBoards(call *grpcCall) error {
+	if err := call.recv(&pbListBoardsRequest{}); err != nil {
+		return err
+	}
+
+	reply := &pbListBoardsReply{}
+
+	for _, board := range call.agent.attachedBoards() {
+		info := board.attachedInfo()
+
+		board.infoMutex.Lock()
+		reply.Boards = append(reply.Boards, &pbBoard{
+			Id:       board.id,
+			Device:   board.dev,
+			Brand:    board.brand,
+			Model:    board.model,
+			Subtype:  board.subtype,
+			Firmware: board.firmware,
+			Info:     string(info.Info),
+			NewBuild: info.NewBuild,
+		})
+		board.infoMutex.Unlock()
+	}
+
+	return call.send(reply)
+}
+
+func grpcGetDirContent(call *grpcCall) error {
+	var request pbPathRequest
+	if err := call.recv(&request); err != nil {
+		return err
+	}
+
+	reply, _, err := call.command("boardGetDirContent", &PathArguments{Path: request.Path}, nil)
+	if err != nil {
+		return err
+	}
+
+	var entries []DirEntry
+	json.Unmarshal(reply.Info, &entries)
+
+	content := &pbDirContent{}
+	for _, entry := range entries {
+		content.Entries = append(content.Entries, &pbDirEntry{Type: entry.Type, Size: entry.Size, Date: entry.Date, Name: entry.Name})
+	}
+
+	return call.send(content)
+}
+
+func grpcReadFile(call *grpcCall) error {
+	var request pbPathRequest
+	if err := call.recv(&request); err != nil {
+		return err
+	}
+
+	_, data, err := call.command("boardReadFile", &ReadFileArguments{Path: request.Path, Transfer: BinaryTransfer}, nil)
+	if err != nil {
+		return err
+	}
+
+	return call.send(&pbFileContent{Content: data})
+}
+
+func grpcWriteFile(call *grpcCall) error {
+	var request pbWriteFileRequest
+	if err := call.recv(&request); err != nil {
+		return err
+	}
+
+	if len(request.Content) > MaxFileSize {
+		return grpcFailed(ErrFileTooLarge)
+	}
+
+	arguments := &WriteFileArguments{Path: request.Path, Transfer: BinaryTransfer, Size: len(request.Content)}
+	if _, _, err := call.command("boardWriteFile", arguments, request.Content); err != nil {
+		return err
+	}
+
+	return call.send(&pbEmpty{})
+}
+
+func grpcRemoveFile(call *grpcCall) error {
+	var request pbPathRequest
+	if err := call.recv(&request); err != nil {
+		return err
+	}
+
+	// The path of boardRemoveFile is base64 encoded
+	path := base64.StdEncoding.EncodeToString([]byte(request.Path))
+
+	if _, _, err := call.command("boardRemoveFile", &PathArguments{Path: path}, nil); err != nil {
+		return err
+	}
+
+	return call.send(&pbEmpty{})
+}
+
+func grpcRunProgram(call *grpcCall) error {
+	var request pbRunProgramRequest
+	if err := call.recv(&request); err != nil {
+		return err
+	}
+
+	if len(request.Code) > MaxFileSize {
+		return grpcFailed(ErrFileTooLarge)
+	}
+
+	arguments := &RunProgramArguments{Path: request.Path, Transfer: BinaryTransfer, Size: len(request.Code)}
+	if _, _, err := call.command("boardRunProgram", arguments, request.Code); err != nil {
+		return err
+	}
+
+	return call.send(&pbEmpty{})
+}
+
+func grpcRunCommand(call *grpcCall) error {
+	var request pbRunCommandRequest
+	if err := call.recv(&request); err != nil {
+		return err
+	}
+
+	arguments := &RunCommandArguments{Code: base64.StdEncoding.EncodeToString([]byte(request.Code))}
+
+	reply, _, err := call.command("boardRunCommand", arguments, nil)
+	if err != nil {
+		return err
+	}
+
+	var info RunCommandInfo
+	json.Unmarshal(reply.Info, &info)
+
+	return call.send(&pbRunCommandReply{Response: info.Response})
+}
+
+// Handler for the board commands without arguments
+func grpcSimpleCommand(name string) grpcMethod {
+	return func(call *grpcCall) error {
+		if err := call.recv(&pbEmpty{}); err != nil {
+			return err
+		}
+
+		if _, _, err := call.command(name, nil, nil); err != nil {
+			return err
+		}
+
+		return call.send(&pbEmpty{})
+	}
+}
+
+func grpcUpgrade(call *grpcCall) error {
+	var request pbUpgradeRequest
+	if err := call.recv(&request); err != nil {
+		return err
+	}
+
+	// The progress is sent by the agent in boardUpdate notifications
+	l := newEventListener(map[string]bool{"boardUpdate": true}, call.board)
+	call.agent.hub.addListener(l, "")
+	defer call.agent.hub.removeListener(l)
+
+	overflow := l.overflow
+	result := make(chan error, 1)
+
+	go func() {
+		var err error
+
+		if request.Install {
+			_, _, err = call.command("boardInstall", &InstallArguments{Firmware: request.Firmware, Custom: request.Custom}, nil)
+		} else {
+			_, _, err = call.command("boardUpgrade", &UpgradeArguments{Custom: request.Custom}, nil)
+		}
+
+		result <- err
+	}()
+
+	for {
+		select {
+		case event := <-l.events:
+			var update struct {
+				Info UpdateInfo `json:"info"`
+			}
+
+			json.Unmarshal(event.Data, &update)
+
+			if err := call.send(&pbUpgradeProgress{Message: string(update.Info.What)}); err != nil {
+				return err
+			}
+
+		case <-overflow:
+			// Progress is lost, but the upgrade goes on
+			overflow = nil
+
+		case err := <-result:
+			return err
+		}
+	}
+}
+
+func grpcConsole(call *grpcCall) error {
+	// The client of the call, for hold the board lease
+	c := &client{
+		id:  "grpc-" + newClientId(),
+		out: make(chan frame, clientQueueSize),
+	}
+
+	go func() {
+		for range c.out {
+		}
+	}()
+
+	defer c.close()
+	defer call.agent.hub.releaseLeases(c)
+
+	l := newEventListener(map[string]bool{"console": true, "consoleOverflow": true}, call.board)
+	call.agent.hub.addListener(l, "")
+	defer call.agent.hub.removeListener(l)
+
+	input := make(chan error, 1)
+
+	go func() {
+		for {
+			var in pbConsoleInput
+			if err := call.recv(&in); err != nil {
+				input <- err
+				return
+			}
+
+			if call.agent.boardUpgrading(call.board) {
+				continue
+			}
+
+			board := call.agent.findBoard(call.board)
+			if board == nil {
+				continue
+			}
+
+			if granted, _ := call.agent.hub.checkLease(c, board.id); !granted {
+				input <- grpcFailed(ErrNoLease)
+				return
+			}
+
+			if errCode := board.writeConsole(in.Data); errCode != "" {
+				input <- grpcFailed(errCode)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case event := <-l.events:
+			output := &pbConsoleOutput{Data: event.Data}
+
+			if event.Type == "consoleOverflow" {
+				var overflow struct {
+					Info ConsoleOverflowInfo `json:"info"`
+				}
+
+				json.Unmarshal(event.Data, &overflow)
+				output = &pbConsoleOutput{Dropped: int32(overflow.Info.Dropped)}
+			}
+
+			if err := call.send(output); err != nil {
+				return err
+			}
+
+		case <-l.overflow:
+			return &grpcError{code: grpcResourceExhausted, message: "console output is too fast"}
+
+		case err := <-input:
+			if err != io.EOF {
+				return err
+			}
+
+			// The client has closed its side, but the output is still sent
+			input = nil
+
+		case <-call.ctx.Done():
+			return nil
+		}
+	}
+}
+
+func grpcNotifications(call *grpcCall) error {
+	var request pbNotificationsRequest
+	if err := call.recv(&request); err != nil {
+		return err
+	}
+
+	var types map[string]bool
+	for _, notification := range request.Types {
+		if types == nil {
+			types = make(map[string]bool)
+		}
+
+		types[notification] = true
+	}
+
+	l := newEventListener(types, call.board)
+	call.agent.hub.addListener(l, request.LastId)
+	defer call.agent.hub.removeListener(l)
+
+	send := func(event agentEvent) error {
+		if event.Type == "console" {
+			return nil
+		}
+
+		return call.send(&pbNotification{Type: event.Type, Id: event.Id, Json: string(event.Data)})
+	}
+
+	for {
+		select {
+		case event := <-l.events:
+			if err := send(event); err != nil {
+				return err
+			}
+
+		case <-l.overflow:
+			// The notifications queued before the overflow are sent, so the
+			// client resumes after them
+			for {
+				select {
+				case event := <-l.events:
+					if err := send(event); err != nil {
+						return err
+					}
+
+				default:
+					return &grpcError{code: grpcResourceExhausted, message: "notifications are too fast"}
+				}
+			}
+
+		case <-call.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Parse the grpc-timeout header
+func grpcTimeout(value string) (time.Duration, bool) {
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+
+	if len(value) < 2 {
+		return 0, false
+	}
+
+	unit, ok := units[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Duration(n) * unit, true
+}
+
+func (server grpcServer) serveCall(w http.ResponseWriter, r *http.Request) error {
+	if _, errCode := server.agent.checkApiRequest(r, bearerToken(r)); errCode != "" {
+		return grpcFailed(errCode)
+	}
+
+	method, ok := grpcMethods[strings.TrimPrefix(r.URL.Path, grpcServicePath)]
+	if !ok || !strings.HasPrefix(r.URL.Path, grpcServicePath) {
+		return &grpcError{code: grpcUnimplemented, message: "unknown method " + r.URL.Path}
+	}
+
+	call := &grpcCall{agent: server.agent, w: w, r: r, ctx: r.Context(), board: r.Header.Get("Board")}
+
+	if timeout, ok := grpcTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		var cancel context.CancelFunc
+
+		call.ctx, cancel = context.WithTimeout(call.ctx, timeout)
+		defer cancel()
+
+		call.timeout = int(timeout / time.Millisecond)
+		if call.timeout == 0 {
+			call.timeout = 1
+		}
+	}
+
+	return method(call)
+}
+
+// Handler of the gRPC calls
+type grpcServer struct {
+	agent *Agent
+}
+
+func (server grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "only gRPC calls are supported", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	// Streaming clients wait for the headers before sending
+	w.(http.Flusher).Flush()
+
+	code, message := grpcOK, ""
+
+	if err := server.serveCall(w, r); err != nil {
+		if status, ok := err.(*grpcError); ok {
+			code, message = status.code, status.message
+		} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+			code, message = grpcInvalidArgument, "missing request message"
+		} else {
+			code, message = grpcInternal, err.Error()
+		}
+
+		log.Println("gRPC call ", r.URL.Path, " failed: ", message)
+	}
+
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", message)
+}
+
+// Start the gRPC service, if it is enabled
+func (agent *Agent) grpcStart() {
+	if agent.config.GrpcAddress == "" {
+		return
+	}
+
+	network, address := "tcp", agent.config.GrpcAddress
+	if strings.HasPrefix(agent.config.GrpcAddress, "unix:") {
+		network, address = "unix", strings.TrimPrefix(agent.config.GrpcAddress, "unix:")
+
+		// Remove the socket of a previous run
+		os.Remove(address)
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		log.Println("can't start gRPC service: ", err)
+		return
+	}
+
+	if network == "unix" {
+		os.Chmod(address, 0600)
+	}
+
+	log.Println("Starting gRPC service on ", agent.config.GrpcAddress, " ...")
+	agent.serve(newGrpcServer(agent), listener, "gRPC service")
+}
+
+// Create the HTTP/2 server of the gRPC service
+func newGrpcServer(agent *Agent) *http.Server {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+
+	return &http.Server{Handler: grpcServer{agent: agent}, Protocols: &protocols}
+}
@@ -0,0 +1,162 @@
+//go:build linux
+// +build linux
+
+/*
+ * Whitecat Blocky Environment, gRPC service tests with an emulated board
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGrpcBoardCalls(t *testing.T) {
+	board, emu := newEmulatedBoard(t)
+
+	server := startGrpcServer(t, board.agent)
+
+	var boards pbListBoardsReply
+	if code, message := server.unary(t, "ListBoards", "", &pbListBoardsRequest{}, &boards); code != grpcOK {
+		t.Fatalf("ListBoards failed: %d %s", code, message)
+	}
+
+	if len(boards.Boards) != 1 || boards.Boards[0].Id != board.id || boards.Boards[0].Model != "EMULATOR" || boards.Boards[0].Brand != "WHITECAT" {
+		t.Fatalf("unexpected boards %v", boards.Boards)
+	}
+
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	if code, message := server.unary(t, "WriteFile", board.id, &pbWriteFileRequest{Path: "/data.bin", Content: content}, &pbEmpty{}); code != grpcOK {
+		t.Fatalf("WriteFile failed: %d %s", code, message)
+	}
+
+	if written, _ := emu.ReadFile("/data.bin"); !bytes.Equal(written, content) {
+		t.Fatalf("written %d bytes, expected %d", len(written), len(content))
+	}
+
+	var file pbFileContent
+	if code, message := server.unary(t, "ReadFile", board.id, &pbPathRequest{Path: "/data.bin"}, &file); code != grpcOK {
+		t.Fatalf("ReadFile failed: %d %s", code, message)
+	}
+
+	if !bytes.Equal(file.Content, content) {
+		t.Fatalf("read %d bytes, expected %d", len(file.Content), len(content))
+	}
+
+	var dir pbDirContent
+	if code, message := server.unary(t, "GetDirContent", board.id, &pbPathRequest{Path: "/"}, &dir); code != grpcOK {
+		t.Fatalf("GetDirContent failed: %d %s", code, message)
+	}
+
+	listed := false
+	for _, entry := range dir.Entries {
+		listed = listed || entry.Name == "data.bin"
+	}
+
+	if !listed {
+		t.Fatalf("data.bin not listed in %v", dir.Entries)
+	}
+
+	var command pbRunCommandReply
+	if code, message := server.unary(t, "RunCommand", board.id, &pbRunCommandRequest{Code: "print(\"cmd\", 42)"}, &command); code != grpcOK {
+		t.Fatalf("RunCommand failed: %d %s", code, message)
+	}
+
+	if string(command.Response) != "cmd\t42" {
+		t.Fatalf("response %q", command.Response)
+	}
+
+	if code, message := server.unary(t, "RemoveFile", board.id, &pbPathRequest{Path: "/data.bin"}, &pbEmpty{}); code != grpcOK {
+		t.Fatalf("RemoveFile failed: %d %s", code, message)
+	}
+
+	if _, ok := emu.ReadFile("/data.bin"); ok {
+		t.Fatal("data.bin not removed")
+	}
+
+	program := []byte("print(\"program output\")\n")
+	if code, message := server.unary(t, "RunProgram", board.id, &pbRunProgramRequest{Path: "/main.lua", Code: program}, &pbEmpty{}); code != grpcOK {
+		t.Fatalf("RunProgram failed: %d %s", code, message)
+	}
+
+	if written, _ := emu.ReadFile("/main.lua"); !bytes.Equal(written, program) {
+		t.Fatalf("program %q, expected %q", written, program)
+	}
+
+	code, message := server.unary(t, "ReadFile", "unknown", &pbPathRequest{Path: "/main.lua"}, &pbFileContent{})
+	if code != grpcUnavailable || message != ErrNoBoard {
+		t.Fatalf("status %d %s for an unknown board, expected %d %s", code, message, grpcUnavailable, ErrNoBoard)
+	}
+}
+
+func TestGrpcConsole(t *testing.T) {
+	board, _ := newEmulatedBoard(t)
+
+	server := startGrpcServer(t, board.agent)
+
+	call := server.call(t, "Console", board.id)
+	waitListeners(t, board.agent, 1)
+
+	call.send(&pbConsoleInput{Data: []byte("print(\"typed\")\r")})
+
+	var output []byte
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !strings.Contains(string(output), "\ntyped\r\n") {
+		if time.Now().After(deadline) {
+			t.Fatalf("console output %q", output)
+		}
+
+		var message pbConsoleOutput
+		if !call.recv(&message) {
+			t.Fatalf("console closed, output %q", output)
+		}
+
+		output = append(output, message.Data...)
+	}
+
+	// The console input takes the board lease, and it is released when the
+	// call ends
+	if holder := board.agent.hub.leaseHolderId(board.id); !strings.HasPrefix(holder, "grpc-") {
+		t.Fatalf("lease holder %q, expected the console call", holder)
+	}
+
+	call.close()
+	waitListeners(t, board.agent, 0)
+
+	if holder := board.agent.hub.leaseHolderId(board.id); holder != "" {
+		t.Fatalf("lease holder %q after the call", holder)
+	}
+}
@@ -0,0 +1,371 @@
+/*
+ * Whitecat Blocky Environment, gRPC service tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// The gRPC service of an agent, served on a loopback listener
+type grpcTestServer struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func startGrpcServer(t *testing.T, agent *Agent) *grpcTestServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newGrpcServer(agent)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	token, err := agent.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+
+	return &grpcTestServer{
+		url:    "http://" + listener.Addr().String() + grpcServicePath,
+		token:  token,
+		client: &http.Client{Transport: &http.Transport{Protocols: &protocols}},
+	}
+}
+
+// A gRPC call in progress. The request messages are streamed through in.
+type grpcTestCall struct {
+	t      *testing.T
+	in     *io.PipeWriter
+	resp   *http.Response
+	cancel context.CancelFunc
+}
+
+// Start a call of a method, to the board selected with the board metadata
+func (server *grpcTestServer) call(t *testing.T, method string, board string) *grpcTestCall {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	body, in := io.Pipe()
+
+	r, err := http.NewRequestWithContext(ctx, "POST", server.url+method, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("Te", "trailers")
+	r.Header.Set("Grpc-Timeout", "10S")
+
+	if server.token != "" {
+		r.Header.Set("Authorization", "Bearer "+server.token)
+	}
+
+	if board != "" {
+		r.Header.Set("Board", board)
+	}
+
+	resp, err := server.client.Do(r)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+
+	call := &grpcTestCall{t: t, in: in, resp: resp, cancel: cancel}
+	t.Cleanup(call.close)
+
+	return call
+}
+
+// Cancel the call
+func (call *grpcTestCall) close() {
+	call.cancel()
+	call.in.Close()
+	call.resp.Body.Close()
+}
+
+func (call *grpcTestCall) send(m proto.Message) {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		call.t.Fatal(err)
+	}
+
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+
+	// The server can end the call before reading the request
+	if _, err := call.in.Write(append(header[:], data...)); err != nil && err != io.ErrClosedPipe {
+		call.t.Fatal(err)
+	}
+}
+
+// Send the end of the request messages
+func (call *grpcTestCall) closeSend() {
+	call.in.Close()
+}
+
+// Receive a message. Returns false when the server has sent all its messages.
+func (call *grpcTestCall) recv(m proto.Message) bool {
+	var header [5]byte
+
+	if _, err := io.ReadFull(call.resp.Body, header[:]); err == io.EOF {
+		return false
+	} else if err != nil {
+		call.t.Fatal(err)
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(call.resp.Body, data); err != nil {
+		call.t.Fatal(err)
+	}
+
+	if err := proto.Unmarshal(data, m); err != nil {
+		call.t.Fatal(err)
+	}
+
+	return true
+}
+
+// Wait for the end of the call, and get its status
+func (call *grpcTestCall) status() (code int, message string) {
+	if _, err := io.Copy(io.Discard, call.resp.Body); err != nil {
+		call.t.Fatal(err)
+	}
+
+	code, err := strconv.Atoi(call.resp.Trailer.Get("Grpc-Status"))
+	if err != nil {
+		call.t.Fatalf("invalid status %q", call.resp.Trailer.Get("Grpc-Status"))
+	}
+
+	return code, call.resp.Trailer.Get("Grpc-Message")
+}
+
+// Call a unary method. The reply is only received if the call succeeds.
+func (server *grpcTestServer) unary(t *testing.T, method string, board string, request proto.Message, reply proto.Message) (code int, message string) {
+	call := server.call(t, method, board)
+	call.send(request)
+	call.closeSend()
+
+	received := call.recv(reply)
+
+	code, message = call.status()
+	if code == grpcOK && !received {
+		t.Fatalf("%s: no reply", method)
+	}
+
+	return code, message
+}
+
+// Wait until the hub has n event listeners
+func waitListeners(t *testing.T, agent *Agent, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		agent.hub.mutex.Lock()
+		listeners := len(agent.hub.listeners)
+		agent.hub.mutex.Unlock()
+
+		if listeners == n {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("%d event listeners, expected %d", listeners, n)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Get what is updated from a boardUpdate notification
+func updateWhat(t *testing.T, notification *pbNotification) string {
+	var update struct {
+		Info UpdateInfo `json:"info"`
+	}
+
+	if err := json.Unmarshal([]byte(notification.Json), &update); err != nil {
+		t.Fatal(err)
+	}
+
+	return string(update.Info.What)
+}
+
+func TestGrpcUnauthenticated(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir()})
+
+	server := startGrpcServer(t, agent)
+	server.token = ""
+
+	if code, _ := server.unary(t, "ListBoards", "", &pbListBoardsRequest{}, &pbListBoardsReply{}); code != grpcUnauthenticated {
+		t.Fatalf("status %d, expected %d", code, grpcUnauthenticated)
+	}
+
+	server.token = "invalid"
+
+	if code, _ := server.unary(t, "ListBoards", "", &pbListBoardsRequest{}, &pbListBoardsReply{}); code != grpcUnauthenticated {
+		t.Fatalf("status %d with an invalid token, expected %d", code, grpcUnauthenticated)
+	}
+}
+
+func TestGrpcUnknownMethod(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir()})
+
+	server := startGrpcServer(t, agent)
+
+	if code, _ := server.unary(t, "Format", "", &pbEmpty{}, &pbEmpty{}); code != grpcUnimplemented {
+		t.Fatalf("status %d, expected %d", code, grpcUnimplemented)
+	}
+}
+
+func TestGrpcNoBoard(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir()})
+	t.Cleanup(agent.Stop)
+
+	server := startGrpcServer(t, agent)
+
+	var boards pbListBoardsReply
+	if code, message := server.unary(t, "ListBoards", "", &pbListBoardsRequest{}, &boards); code != grpcOK {
+		t.Fatalf("ListBoards failed: %d %s", code, message)
+	}
+
+	if len(boards.Boards) != 0 {
+		t.Fatalf("boards %v, expected none", boards.Boards)
+	}
+
+	code, message := server.unary(t, "ReadFile", "", &pbPathRequest{Path: "/autorun.lua"}, &pbFileContent{})
+	if code != grpcUnavailable || message != ErrNoBoard {
+		t.Fatalf("status %d %s, expected %d %s", code, message, grpcUnavailable, ErrNoBoard)
+	}
+}
+
+func TestGrpcNotifications(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir()})
+
+	server := startGrpcServer(t, agent)
+
+	call := server.call(t, "Notifications", "")
+	call.send(&pbNotificationsRequest{Types: []string{"boardUpdate"}})
+	waitListeners(t, agent, 1)
+
+	// Only the requested types are sent
+	agent.notify("boardDetached", nil)
+	agent.notifyUpdate("Scanning boards")
+
+	var notification pbNotification
+	if !call.recv(&notification) {
+		t.Fatal("notification not received")
+	}
+
+	if notification.Type != "boardUpdate" || notification.Id == "" || updateWhat(t, &notification) != "Scanning boards" {
+		t.Fatalf("unexpected notification %+v", &notification)
+	}
+
+	call.close()
+	waitListeners(t, agent, 0)
+
+	// The notifications published while the client is not listening are sent
+	// when it resumes from the last notification it has received
+	agent.notifyUpdate("No board attached")
+
+	resumed := server.call(t, "Notifications", "")
+	resumed.send(&pbNotificationsRequest{Types: []string{"boardUpdate"}, LastId: notification.Id})
+
+	if !resumed.recv(&notification) {
+		t.Fatal("missed notification not received")
+	}
+
+	if notification.Type != "boardUpdate" || updateWhat(t, &notification) != "No board attached" {
+		t.Fatalf("unexpected notification %+v", &notification)
+	}
+}
+
+func TestGrpcUpgradeProgress(t *testing.T) {
+	board := testBoard(t, nil)
+	agent := board.agent
+	t.Cleanup(agent.Stop)
+
+	// The command worker of the board is not started yet, so the upgrade is in
+	// progress while the command is queued
+	board.commands = make(chan *queuedCommand, commandQueueSize)
+	board.detached = make(chan struct{})
+	agent.boards = append(agent.boards, board)
+
+	server := startGrpcServer(t, agent)
+
+	call := server.call(t, "Upgrade", "")
+	call.send(&pbUpgradeRequest{})
+	call.closeSend()
+
+	waitListeners(t, agent, 1)
+
+	progress := []string{"Downloading firmware", "Unpacking firmware"}
+	for _, what := range progress {
+		agent.notifyUpdate(what)
+	}
+
+	for _, what := range progress {
+		var message pbUpgradeProgress
+		if !call.recv(&message) {
+			t.Fatalf("progress %q not received", what)
+		}
+
+		if message.Message != what {
+			t.Fatalf("progress %q, expected %q", message.Message, what)
+		}
+	}
+
+	// The board is detached before the upgrade starts
+	board.stopCommands()
+	agent.removeBoard(board)
+	go board.commandWorker()
+
+	var message pbUpgradeProgress
+	if call.recv(&message) {
+		t.Fatalf("unexpected progress %q", message.Message)
+	}
+
+	if code, message := call.status(); code != grpcUnavailable || message != ErrNoBoard {
+		t.Fatalf("status %d %s, expected %d %s", code, message, grpcUnavailable, ErrNoBoard)
+	}
+}
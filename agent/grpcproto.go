@@ -0,0 +1,197 @@
+/*
+ * Whitecat Blocky Environment, gRPC service messages
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+Messages of the gRPC service, as defined in agent.proto. They are encoded with the protobuf package,
+that gets the field numbers and types from the struct tags, so they must match agent.proto.
+
+*/
+
+import "github.com/golang/protobuf/proto"
+
+type pbEmpty struct{}
+
+func (m *pbEmpty) Reset()         { *m = pbEmpty{} }
+func (m *pbEmpty) String() string { return proto.CompactTextString(m) }
+func (*pbEmpty) ProtoMessage()    {}
+
+type pbListBoardsRequest struct{}
+
+func (m *pbListBoardsRequest) Reset()         { *m = pbListBoardsRequest{} }
+func (m *pbListBoardsRequest) String() string { return proto.CompactTextString(m) }
+func (*pbListBoardsRequest) ProtoMessage()    {}
+
+type pbBoard struct {
+	Device   string `protobuf:"bytes,1,opt,name=device"`
+	Brand    string `protobuf:"bytes,2,opt,name=brand"`
+	Model    string `protobuf:"bytes,3,opt,name=model"`
+	Subtype  string `protobuf:"bytes,4,opt,name=subtype"`
+	Firmware string `protobuf:"bytes,5,opt,name=firmware"`
+	Info     string `protobuf:"bytes,6,opt,name=info"`
+	NewBuild bool   `protobuf:"varint,7,opt,name=new_build,json=newBuild"`
+	Id       string `protobuf:"bytes,8,opt,name=id"`
+}
+
+func (m *pbBoard) Reset()         { *m = pbBoard{} }
+func (m *pbBoard) String() string { return proto.CompactTextString(m) }
+func (*pbBoard) ProtoMessage()    {}
+
+type pbListBoardsReply struct {
+	Boards []*pbBoard `protobuf:"bytes,1,rep,name=boards"`
+}
+
+func (m *pbListBoardsReply) Reset()         { *m = pbListBoardsReply{} }
+func (m *pbListBoardsReply) String() string { return proto.CompactTextString(m) }
+func (*pbListBoardsReply) ProtoMessage()    {}
+
+type pbPathRequest struct {
+	Path string `protobuf:"bytes,1,opt,name=path"`
+}
+
+func (m *pbPathRequest) Reset()         { *m = pbPathRequest{} }
+func (m *pbPathRequest) String() string { return proto.CompactTextString(m) }
+func (*pbPathRequest) ProtoMessage()    {}
+
+type pbDirEntry struct {
+	Type string `protobuf:"bytes,1,opt,name=type"`
+	Size string `protobuf:"bytes,2,opt,name=size"`
+	Date string `protobuf:"bytes,3,opt,name=date"`
+	Name string `protobuf:"bytes,4,opt,name=name"`
+}
+
+func (m *pbDirEntry) Reset()         { *m = pbDirEntry{} }
+func (m *pbDirEntry) String() string { return proto.CompactTextString(m) }
+func (*pbDirEntry) ProtoMessage()    {}
+
+type pbDirContent struct {
+	Entries []*pbDirEntry `protobuf:"bytes,1,rep,name=entries"`
+}
+
+func (m *pbDirContent) Reset()         { *m = pbDirContent{} }
+func (m *pbDirContent) String() string { return proto.CompactTextString(m) }
+func (*pbDirContent) ProtoMessage()    {}
+
+type pbFileContent struct {
+	Content []byte `protobuf:"bytes,1,opt,name=content,proto3"`
+}
+
+func (m *pbFileContent) Reset()         { *m = pbFileContent{} }
+func (m *pbFileContent) String() string { return proto.CompactTextString(m) }
+func (*pbFileContent) ProtoMessage()    {}
+
+type pbWriteFileRequest struct {
+	Path    string `protobuf:"bytes,1,opt,name=path"`
+	Content []byte `protobuf:"bytes,2,opt,name=content,proto3"`
+}
+
+func (m *pbWriteFileRequest) Reset()         { *m = pbWriteFileRequest{} }
+func (m *pbWriteFileRequest) String() string { return proto.CompactTextString(m) }
+func (*pbWriteFileRequest) ProtoMessage()    {}
+
+type pbRunProgramRequest struct {
+	Path string `protobuf:"bytes,1,opt,name=path"`
+	Code []byte `protobuf:"bytes,2,opt,name=code,proto3"`
+}
+
+func (m *pbRunProgramRequest) Reset()         { *m = pbRunProgramRequest{} }
+func (m *pbRunProgramRequest) String() string { return proto.CompactTextString(m) }
+func (*pbRunProgramRequest) ProtoMessage()    {}
+
+type pbRunCommandRequest struct {
+	Code string `protobuf:"bytes,1,opt,name=code"`
+}
+
+func (m *pbRunCommandRequest) Reset()         { *m = pbRunCommandRequest{} }
+func (m *pbRunCommandRequest) String() string { return proto.CompactTextString(m) }
+func (*pbRunCommandRequest) ProtoMessage()    {}
+
+type pbRunCommandReply struct {
+	Response []byte `protobuf:"bytes,1,opt,name=response,proto3"`
+}
+
+func (m *pbRunCommandReply) Reset()         { *m = pbRunCommandReply{} }
+func (m *pbRunCommandReply) String() string { return proto.CompactTextString(m) }
+func (*pbRunCommandReply) ProtoMessage()    {}
+
+type pbUpgradeRequest struct {
+	Install  bool   `protobuf:"varint,1,opt,name=install"`
+	Firmware string `protobuf:"bytes,2,opt,name=firmware"`
+	Custom   bool   `protobuf:"varint,3,opt,name=custom"`
+}
+
+func (m *pbUpgradeRequest) Reset()         { *m = pbUpgradeRequest{} }
+func (m *pbUpgradeRequest) String() string { return proto.CompactTextString(m) }
+func (*pbUpgradeRequest) ProtoMessage()    {}
+
+type pbUpgradeProgress struct {
+	Message string `protobuf:"bytes,1,opt,name=message"`
+}
+
+func (m *pbUpgradeProgress) Reset()         { *m = pbUpgradeProgress{} }
+func (m *pbUpgradeProgress) String() string { return proto.CompactTextString(m) }
+func (*pbUpgradeProgress) ProtoMessage()    {}
+
+type pbConsoleInput struct {
+	Data []byte `protobuf:"bytes,1,opt,name=data,proto3"`
+}
+
+func (m *pbConsoleInput) Reset()         { *m = pbConsoleInput{} }
+func (m *pbConsoleInput) String() string { return proto.CompactTextString(m) }
+func (*pbConsoleInput) ProtoMessage()    {}
+
+type pbConsoleOutput struct {
+	Data    []byte `protobuf:"bytes,1,opt,name=data,proto3"`
+	Dropped int32  `protobuf:"varint,2,opt,name=dropped"`
+}
+
+func (m *pbConsoleOutput) Reset()         { *m = pbConsoleOutput{} }
+func (m *pbConsoleOutput) String() string { return proto.CompactTextString(m) }
+func (*pbConsoleOutput) ProtoMessage()    {}
+
+type pbNotificationsRequest struct {
+	Types  []string `protobuf:"bytes,1,rep,name=types"`
+	LastId string   `protobuf:"bytes,2,opt,name=last_id,json=lastId"`
+}
+
+func (m *pbNotificationsRequest) Reset()         { *m = pbNotificationsRequest{} }
+func (m *pbNotificationsRequest) String() string { return proto.CompactTextString(m) }
+func (*pbNotificationsRequest) ProtoMessage()    {}
+
+type pbNotification struct {
+	Type string `protobuf:"bytes,1,opt,name=type"`
+	Id   string `protobuf:"bytes,2,opt,name=id"`
+	Json string `protobuf:"bytes,3,opt,name=json"`
+}
+
+func (m *pbNotification) Reset()         { *m = pbNotification{} }
+func (m *pbNotification) String() string { return proto.CompactTextString(m) }
+func (*pbNotification) ProtoMessage()    {}
@@ -0,0 +1,178 @@
+/*
+ * Whitecat Blocky Environment, websocket heartbeat
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+The agent sends a ping frame every HeartbeatInterval seconds on all the websocket connections. If
+nothing is received from the IDE, not even the pong, in HeartbeatTimeout seconds, the connection is
+closed. When the control connection is lost in this way the agent does the same as in detachIde.
+
+On the control connection the agent also sends a heartbeat notification, so the IDE can detect
+when the agent has gone away:
+
+{"notify": "agentHeartbeat", "info": {"interval": 10, "timeout": 30}}
+
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+type AgentHeartbeatInfo struct {
+	Interval int `json:"interval"`
+	Timeout  int `json:"timeout"`
+}
+
+// Codec for send ping frames
+var pingCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		return nil, websocket.PingFrame, nil
+	},
+}
+
+// A network connection that records when data was received for last time. Pong
+// frames are handled inside the websocket package, so this is the only way to
+// know that they are received.
+type activityConn struct {
+	net.Conn
+
+	// Unix time in nanoseconds
+	lastRead int64
+}
+
+func (conn *activityConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&conn.lastRead, time.Now().UnixNano())
+	}
+
+	return n, err
+}
+
+func (conn *activityConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&conn.lastRead)))
+}
+
+// A response writer that hijacks the connection as an activityConn
+type activityWriter struct {
+	http.ResponseWriter
+
+	conn *activityConn
+}
+
+func (w *activityWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.conn = &activityConn{Conn: conn, lastRead: time.Now().UnixNano()}
+
+	// Keep the data already buffered by the http server
+	buffered, _ := rw.Reader.Peek(rw.Reader.Buffered())
+	reader := io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), w.conn)
+
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(reader), rw.Writer), nil
+}
+
+type activityKey struct{}
+
+// Websocket server that tracks the activity of the connections, for the heartbeat
+type heartbeatServer struct {
+	websocket.Server
+}
+
+func (server heartbeatServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	aw := &activityWriter{ResponseWriter: w}
+
+	server.Server.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), activityKey{}, aw)))
+}
+
+// Start the heartbeat of a websocket connection. The connection is closed, and
+// lost is called, if the heartbeat is missed. If c is not nil the heartbeat
+// notification is sent to the client. The returned function stops the heartbeat.
+func (agent *Agent) startHeartbeat(ws *websocket.Conn, c *client, lost func()) (stop func()) {
+	aw, ok := ws.Request().Context().Value(activityKey{}).(*activityWriter)
+	if !ok || aw.conn == nil || agent.config.HeartbeatInterval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(agent.config.HeartbeatInterval) * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+
+			case <-ticker.C:
+				if aw.conn.idle() > time.Duration(agent.config.HeartbeatTimeout)*time.Second {
+					log.Println("heartbeat missed on ", ws.Request().URL.Path, ", closing connection")
+
+					if lost != nil {
+						lost()
+					}
+
+					ws.Close()
+					return
+				}
+
+				pingCodec.Send(ws, nil)
+
+				if c != nil {
+					msg := marshalNotification(Notification{
+						Notify: "agentHeartbeat",
+						Info:   AgentHeartbeatInfo{Interval: agent.config.HeartbeatInterval, Timeout: agent.config.HeartbeatTimeout},
+					})
+
+					c.trySend(frame{data: msg})
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
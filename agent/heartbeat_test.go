@@ -0,0 +1,82 @@
+/*
+ * Whitecat Blocky Environment, heartbeat tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestHeartbeat(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir(), AllowedOrigins: []string{testOrigin}, HeartbeatInterval: 1, HeartbeatTimeout: 2})
+	url, token := startWebsocketServer(t, agent)
+
+	// An IDE that reads the control connection answers the pings, and an IDE
+	// that has hung doesn't
+	alive := dialWebsocket(t, url+"/control?token="+token)
+	dialWebsocket(t, url+"/control?token="+token)
+
+	for deadline := time.Now().Add(5 * time.Second); agent.hub.clientCount() != 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("clients not connected")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	receiveNotification(t, alive, "agentHeartbeat", "")
+
+	lost := make(chan error, 1)
+	go func() {
+		var msg string
+		for {
+			if err := websocket.Message.Receive(alive, &msg); err != nil {
+				lost <- err
+				return
+			}
+		}
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); agent.hub.clientCount() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("hung client not disconnected")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case err := <-lost:
+		t.Fatalf("alive client disconnected: %v", err)
+	default:
+	}
+}
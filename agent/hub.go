@@ -0,0 +1,482 @@
+/*
+ * Whitecat Blocky Environment, IDE clients hub
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+Many IDE clients can be connected to the agent at the same time. Notifications and console output
+are sent to all of them, but only one client, the lease holder, can operate a board. The other
+clients are observers. Each board has its own lease, so different clients can operate different
+boards.
+
+The first client that attaches gets the leases of the boards that are free. Other clients can
+request the lease of a board, and they get it when the lease holder releases it or disconnects.
+Commands without board refer to the default board:
+
+{"command": "boardLeaseRequest", "id": "xx", "board": "yy", "arguments": {}}
+{"command": "boardLeaseRelease", "id": "xx", "board": "yy", "arguments": {}}
+
+{"notify": "boardLease", "board": "yy", "info": {"holder": "xx", "board": "yy"}}
+{"notify": "boardLeaseRequested", "info": {"client": "xx", "board": "yy"}}
+
+The client id is sent in the attachIde reply. The /up and /down connections of a client must pass
+it as a query parameter (/up?client=xx). Console input from observers is rejected.
+
+*/
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/websocket"
+)
+
+// Size of the queue of frames waiting to be sent to a client
+const clientQueueSize = 256
+
+// An IDE client
+type client struct {
+	id string
+
+	// Control connection
+	ws *websocket.Conn
+
+	// Console up connection, if any, the console output waiting to be sent to
+	// it, and the output dropped because the client is slow
+	up        *websocket.Conn
+	upOut     chan consoleOutput
+	upDropped int
+
+	// Console offset after the last output written to the console up connection
+	upWritten atomic.Uint64
+
+	// Board of the console up connection, empty for all the boards
+	upBoard string
+
+	// Frames waiting to be sent to the control connection
+	out       chan frame
+	closeOnce sync.Once
+
+	// Session of the client, and last notification sent before the client
+	// connected
+	session *session
+	seq     uint64
+
+	// Last broadcast notification written to the control connection
+	written atomic.Uint64
+}
+
+type Hub struct {
+	agent *Agent
+
+	mutex sync.Mutex
+
+	// Connected clients, in connection order
+	clients []*client
+
+	// Leases of the boards, by board id
+	leases map[string]*boardLease
+
+	// Sessions, and the notifications and console output for replay them
+	sessions map[string]*session
+	replay   replayBuffer
+
+	// Event listeners, for the /events stream and the gRPC service
+	listeners []*eventListener
+}
+
+func newClientId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+func newClient(ws *websocket.Conn) *client {
+	c := &client{
+		id:  newClientId(),
+		ws:  ws,
+		out: make(chan frame, clientQueueSize),
+	}
+
+	go c.writer()
+
+	return c
+}
+
+// Send the queued frames to the client
+func (c *client) writer() {
+	var err error
+
+	for f := range c.out {
+		if f.binary {
+			err = frameCodec.Send(c.ws, f.data)
+		} else {
+			err = websocket.Message.Send(c.ws, string(f.data))
+		}
+
+		if err != nil {
+			c.ws.Close()
+		} else if f.seq != 0 {
+			c.written.Store(f.seq)
+		}
+	}
+}
+
+// Queue a frame for the client, waiting if the queue is full
+func (c *client) send(f frame) {
+	defer func() {
+		// Client is closed
+		recover()
+	}()
+
+	c.out <- f
+}
+
+// Queue a frame for the client. If the queue is full the client is too slow,
+// and it is disconnected.
+func (c *client) trySend(f frame) {
+	defer func() {
+		recover()
+	}()
+
+	select {
+	case c.out <- f:
+	default:
+		log.Println("client ", c.id, " is too slow, disconnecting")
+		c.ws.Close()
+	}
+}
+
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.out)
+	})
+}
+
+func (hub *Hub) register(c *client) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	c.seq = hub.replay.seq
+	c.written.Store(c.seq)
+	c.upWritten.Store(hub.replay.consoleOffset)
+	hub.clients = append(hub.clients, c)
+}
+
+// Unregister a client, and release its leases. Returns the number of clients
+// that remain connected.
+func (hub *Hub) unregister(c *client) int {
+	hub.mutex.Lock()
+
+	for i, registered := range hub.clients {
+		if registered == c {
+			hub.clients = append(hub.clients[:i], hub.clients[i+1:]...)
+			hub.suspendSession(c)
+			break
+		}
+	}
+
+	remaining := len(hub.clients)
+
+	hub.mutex.Unlock()
+
+	hub.releaseLeases(c)
+	c.close()
+
+	return remaining
+}
+
+func (hub *Hub) clientCount() int {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	return len(hub.clients)
+}
+
+// Get a client by its id. If id is empty, the last connected client is
+// returned, for IDEs that don't send the client id.
+func (hub *Hub) client(id string) *client {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	if id == "" {
+		if len(hub.clients) == 0 {
+			return nil
+		}
+
+		return hub.clients[len(hub.clients)-1]
+	}
+
+	for _, c := range hub.clients {
+		if c.id == id {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// Get the client of a console connection
+func (hub *Hub) clientFor(r *http.Request) *client {
+	return hub.client(r.URL.Query().Get("client"))
+}
+
+// Send a text message to all the clients
+func (hub *Hub) broadcast(msg []byte) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.replay.addNotification(msg)
+
+	for _, c := range hub.clients {
+		c.trySend(frame{data: msg, seq: hub.replay.seq})
+	}
+
+	if len(hub.listeners) > 0 {
+		hub.sendEvent(notificationEvent(msg, hub.replay.seq, hub.replay.consoleOffset))
+	}
+}
+
+// Send the events of the bus to the clients
+func (hub *Hub) Handle(event Event) {
+	if console, ok := event.Info.(ConsoleInfo); ok && event.Type == "console" {
+		hub.broadcastConsole(event.Board, console.Data)
+		return
+	}
+
+	msg := marshalNotification(Notification{Notify: event.Type, Board: event.Board, Info: event.Info})
+	if msg == nil {
+		return
+	}
+
+	hub.broadcast(msg)
+	log.Println("notify: ", string(msg))
+}
+
+// Set the console up connection of a client, that receives the output of board,
+// or of all the boards if board is empty
+func (hub *Hub) setUp(c *client, ws *websocket.Conn, board string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	if c.upOut != nil {
+		close(c.upOut)
+		c.upOut = nil
+	}
+
+	if ws != nil {
+		c.upOut = make(chan consoleOutput, consoleClientQueue)
+
+		// The replayed output is queued before any new output
+		if data := hub.consoleReplay(c, board); len(data) > 0 {
+			c.upOut <- consoleOutput{data: data, offset: hub.replay.consoleOffset}
+		}
+
+		go upWriter(ws, c.upOut, &c.upWritten)
+	}
+
+	c.up = ws
+	c.upBoard = board
+}
+
+// Send the console output of a board to all the clients that have a console up
+// connection for it
+func (hub *Hub) broadcastConsole(board string, data []byte) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.replay.addConsole(board, data)
+
+	for _, c := range hub.clients {
+		if c.upOut != nil && (c.upBoard == "" || c.upBoard == board) {
+			c.sendConsole(consoleOutput{data: data, offset: hub.replay.consoleOffset})
+		}
+	}
+
+	if len(hub.listeners) > 0 {
+		hub.sendEvent(consoleEvent(board, data, hub.replay.seq, hub.replay.consoleOffset))
+	}
+}
+
+// Client that can operate a board, and clients waiting for the lease
+type boardLease struct {
+	holder *client
+	queue  []*client
+}
+
+// Request the lease of a board for a client. If the lease is hold by other
+// client the current lease holder is returned, and if queue is true the
+// requester is queued for get the lease when it is released.
+func (hub *Hub) requestLease(c *client, board string, queue bool) (granted bool, holder string) {
+	hub.mutex.Lock()
+
+	lease := hub.leases[board]
+	if lease == nil {
+		if hub.leases == nil {
+			hub.leases = make(map[string]*boardLease)
+		}
+
+		lease = &boardLease{}
+		hub.leases[board] = lease
+	}
+
+	if lease.holder == nil || lease.holder == c {
+		lease.holder = c
+		hub.mutex.Unlock()
+
+		hub.agent.bus.publish(board, "boardLease", LeaseInfo{Holder: c.id, Board: board})
+
+		return true, c.id
+	}
+
+	holder = lease.holder.id
+	current := lease.holder
+
+	if !queue {
+		hub.mutex.Unlock()
+		return false, holder
+	}
+
+	queued := false
+	for _, waiting := range lease.queue {
+		if waiting == c {
+			queued = true
+		}
+	}
+
+	if !queued {
+		lease.queue = append(lease.queue, c)
+	}
+
+	hub.mutex.Unlock()
+
+	notifyClient(current, "boardLeaseRequested", LeaseRequestedInfo{Client: c.id, Board: board})
+
+	return false, holder
+}
+
+// Release the lease of a board hold by a client, if any, and give it to the
+// next waiting client
+func (hub *Hub) releaseLease(c *client, board string) {
+	hub.mutex.Lock()
+
+	lease := hub.leases[board]
+	if lease == nil {
+		hub.mutex.Unlock()
+		return
+	}
+
+	for i, waiting := range lease.queue {
+		if waiting == c {
+			lease.queue = append(lease.queue[:i], lease.queue[i+1:]...)
+			break
+		}
+	}
+
+	if lease.holder != c {
+		hub.mutex.Unlock()
+		return
+	}
+
+	lease.holder = nil
+	if len(lease.queue) > 0 {
+		lease.holder = lease.queue[0]
+		lease.queue = lease.queue[1:]
+	}
+
+	holder := ""
+	if lease.holder != nil {
+		holder = lease.holder.id
+	}
+
+	hub.mutex.Unlock()
+
+	hub.agent.bus.publish(board, "boardLease", LeaseInfo{Holder: holder, Board: board})
+}
+
+// Release the leases of all the boards hold by a client
+func (hub *Hub) releaseLeases(c *client) {
+	hub.mutex.Lock()
+	boards := make([]string, 0, len(hub.leases))
+	for board := range hub.leases {
+		boards = append(boards, board)
+	}
+	hub.mutex.Unlock()
+
+	for _, board := range boards {
+		hub.releaseLease(c, board)
+	}
+}
+
+func (hub *Hub) isLeaseHolder(c *client, board string) bool {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	lease := hub.leases[board]
+
+	return c != nil && lease != nil && lease.holder == c
+}
+
+func (hub *Hub) leaseHolderId(board string) string {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	lease := hub.leases[board]
+	if lease == nil || lease.holder == nil {
+		return ""
+	}
+
+	return lease.holder.id
+}
+
+// Test if a client holds the lease of a board. A free lease is given to the
+// client, so the first client that operates a board gets its lease.
+func (hub *Hub) checkLease(c *client, board string) (granted bool, holder string) {
+	if hub.isLeaseHolder(c, board) {
+		return true, c.id
+	}
+
+	return hub.requestLease(c, board, false)
+}
+
+// Get the id of the client that holds the lease of the default board
+func (agent *Agent) leaseHolderId() string {
+	board := agent.findBoard("")
+	if board == nil {
+		return ""
+	}
+
+	return agent.hub.leaseHolderId(board.id)
+}
@@ -0,0 +1,115 @@
+/*
+ * Whitecat Blocky Environment, client hub tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Get the notifications of the given type queued for a client
+func queuedNotifications(c *client, notify string) []Notification {
+	var notifications []Notification
+
+	for _, msg := range receivedFrames(c) {
+		var notification Notification
+		json.Unmarshal([]byte(msg), &notification)
+
+		if notification.Notify == notify {
+			notifications = append(notifications, notification)
+		}
+	}
+
+	return notifications
+}
+
+func TestBroadcastToAllClients(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir()})
+
+	clients := []*client{testClient(), testClient()}
+	for _, c := range clients {
+		agent.hub.register(c)
+	}
+
+	agent.notifyUpdate("Scanning boards")
+
+	for _, c := range clients {
+		if notifications := queuedNotifications(c, "boardUpdate"); len(notifications) != 1 {
+			t.Errorf("client %s got %d notifications", c.id, len(notifications))
+		}
+	}
+
+	if remaining := agent.hub.unregister(clients[0]); remaining != 1 {
+		t.Errorf("%d clients remain, expected 1", remaining)
+	}
+}
+
+func TestLease(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir()})
+	hub := agent.hub
+
+	holder, observer := testClient(), testClient()
+	hub.register(holder)
+	hub.register(observer)
+
+	if granted, _ := hub.requestLease(holder, "board", false); !granted {
+		t.Fatal("free lease not granted")
+	}
+
+	// An observer that doesn't queue is only told who holds the lease
+	if granted, id := hub.requestLease(observer, "board", false); granted || id != holder.id {
+		t.Fatalf("lease granted %v to %s, expected the holder %s", granted, id, holder.id)
+	}
+
+	if granted, _ := hub.checkLease(observer, "board"); granted {
+		t.Fatal("observer can operate the board")
+	}
+
+	// A queued observer gets the lease when the holder releases it
+	receivedFrames(holder)
+	hub.requestLease(observer, "board", true)
+
+	if requested := queuedNotifications(holder, "boardLeaseRequested"); len(requested) != 1 {
+		t.Fatalf("holder got %d lease requests", len(requested))
+	}
+
+	hub.releaseLease(holder, "board")
+
+	if id := hub.leaseHolderId("board"); id != observer.id {
+		t.Fatalf("lease holder %q, expected %s", id, observer.id)
+	}
+
+	// The lease is released when its holder disconnects
+	hub.unregister(observer)
+
+	if id := hub.leaseHolderId("board"); id != "" {
+		t.Fatalf("lease holder %q after disconnect", id)
+	}
+}
@@ -0,0 +1,518 @@
+/*
+ * Whitecat Blocky Environment, mDNS advertisement
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+In LAN mode the agent is advertised on the local network with mDNS and DNS-SD (RFC 6762 and
+RFC 6763), so that the IDEs on the same network can discover it, and connect to its boards:
+
+_wccagent._tcp.local.                                    PTR  Whitecat Create Agent on host._wccagent._tcp.local.
+Whitecat Create Agent on host._wccagent._tcp.local.      SRV  0 0 8080 host.local.
+Whitecat Create Agent on host._wccagent._tcp.local.      TXT  "version=2.2" "board=ESP32" "wss=8443"
+host.local.                                              A    192.168.1.10
+
+The SRV port is the port of the websocket server, or of the secure websocket server if the plain
+one isn't on the LAN. board is the model of the attached boards, separated by commas, and
+wss is the port of the secure websocket server, if it is on the LAN.
+
+The agent answers the queries received on the system assigned multicast interface, announces
+itself on start and when a board is attached or detached, and says goodbye when it is stopped.
+This is a minimal responder, that doesn't probe for name conflicts.
+
+*/
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const mdnsService = "_wccagent._tcp.local."
+const mdnsServices = "_services._dns-sd._udp.local."
+
+// Time to live of the advertised records, in seconds
+const mdnsTTL = 120
+
+// DNS record types and classes
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+
+	dnsClassIN         = 1
+	dnsClassCacheFlush = 0x8000
+)
+
+var mdnsAddress = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+type dnsRecord struct {
+	name  string
+	rtype uint16
+	flush bool
+	data  []byte
+}
+
+type mdnsAdvertiser struct {
+	agent *Agent
+	conn  *net.UDPConn
+
+	// Instance and host names, the addresses that are advertised (all the LAN
+	// addresses if ip is nil), and the ports of the websocket servers
+	instance   string
+	host       string
+	ip         net.IP
+	port       int
+	securePort int
+
+	// Models of the attached boards, by board id
+	boards     map[string]string
+	boardMutex sync.Mutex
+
+	// Signaled when the board changes
+	changed chan bool
+
+	sendMutex sync.Mutex
+	closed    bool
+}
+
+// Test if a server address only listens on the loopback interface
+func loopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// Get the host and the port of a server address
+func splitAddress(address string) (net.IP, int) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0
+	}
+
+	p, _ := strconv.Atoi(port)
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsUnspecified() {
+		ip = nil
+	}
+
+	return ip, p
+}
+
+func newMdnsAdvertiser(agent *Agent) (*mdnsAdvertiser, error) {
+	advertiser := &mdnsAdvertiser{
+		agent:   agent,
+		boards:  make(map[string]string),
+		changed: make(chan bool, 1),
+	}
+
+	if agent.config.Address != "" && !loopbackAddress(agent.config.Address) {
+		advertiser.ip, advertiser.port = splitAddress(agent.config.Address)
+	}
+
+	if agent.config.SecureAddress != "" && !loopbackAddress(agent.config.SecureAddress) {
+		ip, port := splitAddress(agent.config.SecureAddress)
+		if advertiser.port == 0 {
+			advertiser.ip, advertiser.port = ip, port
+		}
+
+		advertiser.securePort = port
+	}
+
+	if advertiser.port == 0 {
+		return nil, errors.New("LAN mode needs an Address that isn't loopback, such as :8080")
+	}
+
+	hostname, _ := os.Hostname()
+	hostname = strings.Split(hostname, ".")[0]
+	if hostname == "" {
+		hostname = "wccagent"
+	}
+
+	advertiser.instance = "Whitecat Create Agent on " + hostname + "." + mdnsService
+	advertiser.host = hostname + ".local."
+
+	return advertiser, nil
+}
+
+// Encode a domain name. The first label of an instance name can have spaces.
+func dnsName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+
+	return append(b, 0)
+}
+
+// Decode a domain name, that can be compressed
+func readDnsName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	end := -1
+
+	for jumps := 0; jumps < 16; {
+		if offset >= len(msg) {
+			return "", 0, errors.New("invalid name")
+		}
+
+		length := int(msg[offset])
+
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+
+			return strings.Join(labels, ".") + ".", end, nil
+
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(msg) {
+				return "", 0, errors.New("invalid name")
+			}
+
+			if end < 0 {
+				end = offset + 2
+			}
+
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3fff)
+			jumps++
+
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errors.New("invalid name")
+			}
+
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+
+	return "", 0, errors.New("invalid name")
+}
+
+// Encode a DNS response. question has the encoded questions of the query, that
+// are only sent back to legacy resolvers.
+func dnsResponse(id uint16, questions int, question []byte, answers []dnsRecord, additionals []dnsRecord, ttl uint32) []byte {
+	b := make([]byte, 12)
+
+	binary.BigEndian.PutUint16(b[0:], id)
+	binary.BigEndian.PutUint16(b[2:], 0x8400) // response, authoritative
+	binary.BigEndian.PutUint16(b[4:], uint16(questions))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(additionals)))
+	b = append(b, question...)
+
+	for _, record := range append(answers, additionals...) {
+		class := uint16(dnsClassIN)
+		if record.flush {
+			class |= dnsClassCacheFlush
+		}
+
+		b = dnsName(b, record.name)
+		b = binary.BigEndian.AppendUint16(b, record.rtype)
+		b = binary.BigEndian.AppendUint16(b, class)
+		b = binary.BigEndian.AppendUint32(b, ttl)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(record.data)))
+		b = append(b, record.data...)
+	}
+
+	return b
+}
+
+func (advertiser *mdnsAdvertiser) ptrRecord() dnsRecord {
+	return dnsRecord{name: mdnsService, rtype: dnsTypePTR, data: dnsName(nil, advertiser.instance)}
+}
+
+func (advertiser *mdnsAdvertiser) srvRecord() dnsRecord {
+	data := make([]byte, 6)
+	binary.BigEndian.PutUint16(data[4:], uint16(advertiser.port))
+
+	return dnsRecord{name: advertiser.instance, rtype: dnsTypeSRV, flush: true, data: dnsName(data, advertiser.host)}
+}
+
+func (advertiser *mdnsAdvertiser) txtRecord() dnsRecord {
+	advertiser.boardMutex.Lock()
+	ids := make([]string, 0, len(advertiser.boards))
+	for id := range advertiser.boards {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	models := make([]string, len(ids))
+	for i, id := range ids {
+		models[i] = advertiser.boards[id]
+	}
+	advertiser.boardMutex.Unlock()
+
+	txt := []string{"version=" + Version, "board=" + strings.Join(models, ",")}
+
+	if advertiser.securePort != 0 {
+		txt = append(txt, "wss="+strconv.Itoa(advertiser.securePort))
+	}
+
+	var data []byte
+	for _, s := range txt {
+		data = append(data, byte(len(s)))
+		data = append(data, s...)
+	}
+
+	return dnsRecord{name: advertiser.instance, rtype: dnsTypeTXT, flush: true, data: data}
+}
+
+// Get the A records of the host, for the LAN addresses of the agent
+func (advertiser *mdnsAdvertiser) aRecords() []dnsRecord {
+	var ips []net.IP
+
+	if advertiser.ip != nil {
+		ips = append(ips, advertiser.ip)
+	} else if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+	}
+
+	var records []dnsRecord
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			records = append(records, dnsRecord{name: advertiser.host, rtype: dnsTypeA, flush: true, data: ip4})
+		}
+	}
+
+	return records
+}
+
+// Get all the records of the agent, that are sent in the announcements
+func (advertiser *mdnsAdvertiser) records() []dnsRecord {
+	records := []dnsRecord{advertiser.ptrRecord(), advertiser.srvRecord(), advertiser.txtRecord()}
+
+	return append(records, advertiser.aRecords()...)
+}
+
+// Get the response to a query, nil if the query isn't for the agent. Legacy
+// resolvers get the questions back, and the query id.
+func (advertiser *mdnsAdvertiser) answer(msg []byte, legacy bool) []byte {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[2:])&0x8000 != 0 {
+		return nil
+	}
+
+	var answers, additionals []dnsRecord
+
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	offset := 12
+
+	for i := 0; i < questions; i++ {
+		name, end, err := readDnsName(msg, offset)
+		if err != nil || end+4 > len(msg) {
+			return nil
+		}
+
+		qtype := binary.BigEndian.Uint16(msg[end:])
+		offset = end + 4
+
+		anyType := qtype == dnsTypeANY
+
+		switch {
+		case strings.EqualFold(name, mdnsService) && (anyType || qtype == dnsTypePTR):
+			answers = append(answers, advertiser.ptrRecord())
+			additionals = append(additionals, advertiser.srvRecord(), advertiser.txtRecord())
+			additionals = append(additionals, advertiser.aRecords()...)
+
+		case strings.EqualFold(name, mdnsServices) && (anyType || qtype == dnsTypePTR):
+			answers = append(answers, dnsRecord{name: mdnsServices, rtype: dnsTypePTR, data: dnsName(nil, mdnsService)})
+
+		case strings.EqualFold(name, advertiser.instance):
+			if anyType || qtype == dnsTypeSRV {
+				answers = append(answers, advertiser.srvRecord())
+				additionals = append(additionals, advertiser.aRecords()...)
+			}
+
+			if anyType || qtype == dnsTypeTXT {
+				answers = append(answers, advertiser.txtRecord())
+			}
+
+		case strings.EqualFold(name, advertiser.host) && (anyType || qtype == dnsTypeA):
+			answers = append(answers, advertiser.aRecords()...)
+		}
+	}
+
+	if len(answers) == 0 {
+		return nil
+	}
+
+	if !legacy {
+		return dnsResponse(0, 0, nil, answers, additionals, mdnsTTL)
+	}
+
+	return dnsResponse(binary.BigEndian.Uint16(msg), questions, msg[12:offset], answers, additionals, mdnsTTL)
+}
+
+// Send a response, to the multicast group or to a legacy resolver
+func (advertiser *mdnsAdvertiser) send(msg []byte, to *net.UDPAddr) {
+	advertiser.sendMutex.Lock()
+	defer advertiser.sendMutex.Unlock()
+
+	if advertiser.closed {
+		return
+	}
+
+	if _, err := advertiser.conn.WriteToUDP(msg, to); err != nil {
+		log.Println("can't send mDNS response: ", err)
+	}
+}
+
+// Announce the agent, a TTL of 0 says goodbye
+func (advertiser *mdnsAdvertiser) announce(ttl uint32) {
+	advertiser.send(dnsResponse(0, 0, nil, advertiser.records(), nil, ttl), mdnsAddress)
+}
+
+// Answer the queries
+func (advertiser *mdnsAdvertiser) serve() {
+	buffer := make([]byte, 9000)
+
+	for {
+		n, from, err := advertiser.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		// Queries that don't come from the mDNS port are sent by legacy
+		// resolvers, that get the response in unicast
+		legacy := from.Port != mdnsAddress.Port
+
+		response := advertiser.answer(buffer[:n], legacy)
+		if response == nil {
+			continue
+		}
+
+		if legacy {
+			advertiser.send(response, from)
+		} else {
+			advertiser.send(response, mdnsAddress)
+		}
+	}
+}
+
+// Update the board models, when a board is attached or detached
+func (advertiser *mdnsAdvertiser) Handle(event Event) {
+	advertiser.boardMutex.Lock()
+
+	if info, ok := event.Info.(BoardAttachedInfo); ok {
+		var boardInfo BoardInfo
+
+		json.Unmarshal(info.Info, &boardInfo)
+		advertiser.boards[event.Board] = boardInfo.Board
+	} else {
+		delete(advertiser.boards, event.Board)
+	}
+
+	advertiser.boardMutex.Unlock()
+
+	select {
+	case advertiser.changed <- true:
+	default:
+	}
+}
+
+// Say goodbye, and stop answering the queries
+func (advertiser *mdnsAdvertiser) close() {
+	advertiser.announce(0)
+
+	advertiser.sendMutex.Lock()
+	advertiser.closed = true
+	advertiser.sendMutex.Unlock()
+
+	advertiser.conn.Close()
+}
+
+func (agent *Agent) mdnsStart(advertiser *mdnsAdvertiser) {
+	var err error
+
+	advertiser.conn, err = net.ListenMulticastUDP("udp4", nil, mdnsAddress)
+	if err != nil {
+		log.Println("can't advertise the agent: ", err)
+		return
+	}
+
+	agent.serversMutex.Lock()
+	if agent.stopped() {
+		agent.serversMutex.Unlock()
+		advertiser.conn.Close()
+		return
+	}
+
+	agent.mdns = advertiser
+	agent.serversMutex.Unlock()
+
+	unsubscribe := agent.bus.subscribe(advertiser, "boardAttached", "boardDetached")
+	defer unsubscribe()
+
+	log.Println("Advertising ", advertiser.instance, " on the LAN ...")
+
+	go advertiser.serve()
+
+	// Announce twice, one second apart, as RFC 6762 suggests
+	advertiser.announce(mdnsTTL)
+	again := time.After(time.Second)
+
+	for {
+		select {
+		case <-again:
+			advertiser.announce(mdnsTTL)
+
+		case <-advertiser.changed:
+			advertiser.announce(mdnsTTL)
+
+		case <-agent.done:
+			return
+		}
+	}
+}
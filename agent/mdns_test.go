@@ -0,0 +1,228 @@
+/*
+ * Whitecat Blocky Environment, mDNS advertiser tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLanModeAddress(t *testing.T) {
+	for _, test := range []struct {
+		address, secureAddress string
+		port, securePort       int
+	}{
+		{"localhost:8080", "", 0, 0},
+		{"127.0.0.1:8080", "[::1]:8443", 0, 0},
+		{":8080", "", 8080, 0},
+		{"localhost:8080", ":8443", 8443, 8443},
+		{":8080", "0.0.0.0:8443", 8080, 8443},
+	} {
+		agent := New(Config{DataFolder: t.TempDir(), Address: test.address, SecureAddress: test.secureAddress, LanMode: true})
+
+		advertiser, err := newMdnsAdvertiser(agent)
+		if test.port == 0 {
+			if err == nil {
+				t.Errorf("%s %s: advertised on loopback", test.address, test.secureAddress)
+			}
+
+			// The agent doesn't start in LAN mode if it isn't on the LAN
+			if agent.Start(context.Background()) == nil {
+				t.Errorf("%s %s: started in LAN mode", test.address, test.secureAddress)
+				agent.Stop()
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s %s: %v", test.address, test.secureAddress, err)
+			continue
+		}
+
+		if advertiser.port != test.port || advertiser.securePort != test.securePort || advertiser.ip != nil {
+			t.Errorf("%s %s: advertised %v ports %d %d, want ports %d %d", test.address, test.secureAddress,
+				advertiser.ip, advertiser.port, advertiser.securePort, test.port, test.securePort)
+		}
+	}
+}
+
+// Encode a query with one question
+func dnsQuery(id uint16, name string, qtype uint16) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[0:], id)
+	binary.BigEndian.PutUint16(b[4:], 1)
+
+	b = dnsName(b, name)
+	b = binary.BigEndian.AppendUint16(b, qtype)
+
+	return binary.BigEndian.AppendUint16(b, dnsClassIN)
+}
+
+// Decode the records of a response
+func dnsRecords(t *testing.T, msg []byte) []dnsRecord {
+	offset := 12
+
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+		_, end, err := readDnsName(msg, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		offset = end + 4
+	}
+
+	count := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+
+	var records []dnsRecord
+	for i := 0; i < count; i++ {
+		name, end, err := readDnsName(msg, offset)
+		if err != nil || end+10 > len(msg) {
+			t.Fatalf("invalid record %d: %v", i, err)
+		}
+
+		length := int(binary.BigEndian.Uint16(msg[end+8:]))
+		records = append(records, dnsRecord{
+			name:  name,
+			rtype: binary.BigEndian.Uint16(msg[end:]),
+			flush: binary.BigEndian.Uint16(msg[end+2:])&dnsClassCacheFlush != 0,
+			data:  msg[end+10 : end+10+length],
+		})
+
+		offset = end + 10 + length
+	}
+
+	return records
+}
+
+// Decode the strings of a TXT record
+func txtStrings(data []byte) []string {
+	var txt []string
+
+	for len(data) > 0 {
+		txt = append(txt, string(data[1:1+data[0]]))
+		data = data[1+data[0]:]
+	}
+
+	return txt
+}
+
+func TestMdnsAnswer(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir(), Address: "192.168.1.10:8080", SecureAddress: ":8443", LanMode: true})
+
+	advertiser, err := newMdnsAdvertiser(agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Queries for other services aren't answered
+	if advertiser.answer(dnsQuery(0, "_http._tcp.local.", dnsTypePTR), false) != nil {
+		t.Error("query for another service answered")
+	}
+
+	records := dnsRecords(t, advertiser.answer(dnsQuery(0, "_WCCAGENT._tcp.local.", dnsTypePTR), false))
+
+	types := make(map[uint16]dnsRecord)
+	for _, record := range records {
+		types[record.rtype] = record
+	}
+
+	if len(records) != 4 || len(types) != 4 {
+		t.Fatalf("%d records, want PTR, SRV, TXT and A", len(records))
+	}
+
+	if instance, _, _ := readDnsName(types[dnsTypePTR].data, 0); instance != advertiser.instance {
+		t.Errorf("PTR to %s, want %s", instance, advertiser.instance)
+	}
+
+	srv := types[dnsTypeSRV].data
+	if port := binary.BigEndian.Uint16(srv[4:]); port != 8080 {
+		t.Errorf("SRV port %d, want 8080", port)
+	}
+
+	if host, _, _ := readDnsName(srv, 6); host != advertiser.host {
+		t.Errorf("SRV host %s, want %s", host, advertiser.host)
+	}
+
+	if ip := types[dnsTypeA].data; string(ip) != string([]byte{192, 168, 1, 10}) {
+		t.Errorf("A %v, want 192.168.1.10", ip)
+	}
+
+	if txt := strings.Join(txtStrings(types[dnsTypeTXT].data), " "); txt != "version="+Version+" board= wss=8443" {
+		t.Errorf("TXT %q", txt)
+	}
+
+	// Legacy resolvers get the query id and the question back
+	response := advertiser.answer(dnsQuery(1234, advertiser.instance, dnsTypeTXT), true)
+	if id, questions := binary.BigEndian.Uint16(response), binary.BigEndian.Uint16(response[4:]); id != 1234 || questions != 1 {
+		t.Errorf("legacy response with id %d and %d questions", id, questions)
+	}
+
+	if records := dnsRecords(t, response); len(records) != 1 || records[0].rtype != dnsTypeTXT {
+		t.Errorf("%d records, want the TXT record", len(records))
+	}
+}
+
+func TestMdnsBoards(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir(), Address: ":8080", LanMode: true})
+
+	advertiser, err := newMdnsAdvertiser(agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attached := func(board string, model string) {
+		info, _ := json.Marshal(BoardInfo{Board: model})
+		advertiser.Handle(Event{Type: "boardAttached", Board: board, Info: BoardAttachedInfo{Id: board, Info: info}})
+	}
+
+	attached("B", "ESP32")
+	attached("A", "N1ESP32")
+
+	if txt := txtStrings(advertiser.txtRecord().data); strings.Join(txt, " ") != "version="+Version+" board=N1ESP32,ESP32" {
+		t.Errorf("TXT %q", txt)
+	}
+
+	advertiser.Handle(Event{Type: "boardDetached", Board: "A", Info: BoardDetachedInfo{}})
+
+	if txt := txtStrings(advertiser.txtRecord().data); strings.Join(txt, " ") != "version="+Version+" board=ESP32" {
+		t.Errorf("TXT %q", txt)
+	}
+
+	// The announcement is signaled
+	select {
+	case <-advertiser.changed:
+	default:
+		t.Error("change not signaled")
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * Whitecat Blocky Environment, serial port monitor
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import "C"
+
+import (
+	"github.com/mikepb/go-serial"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Time between the connection attempts to a network board
+const dialInterval = 5 * time.Second
+
+func (agent *Agent) tryLater() {
+	time.Sleep(time.Millisecond * 10)
+
+	if len(agent.attachedBoards()) == 0 {
+		agent.elapsed = agent.elapsed + 10
+		if agent.elapsed > 5000 {
+			// No board found in the last 5 seconds
+			agent.notifyUpdate("No board attached")
+
+			agent.elapsed = 0
+		}
+	}
+}
+
+func (agent *Agent) startMonitor() {
+	agent.monitoringMutex.Lock()
+	defer agent.monitoringMutex.Unlock()
+
+	if !agent.monitoring {
+		agent.monitoring = true
+		go agent.monitor()
+	}
+}
+
+func (agent *Agent) stopMonitor() {
+	agent.monitoringMutex.Lock()
+	defer agent.monitoringMutex.Unlock()
+
+	if agent.monitoring {
+		agent.monitoring = false
+
+		select {
+		case agent.ideDetach <- true:
+		case <-agent.done:
+		}
+	}
+}
+
+// Connect to the network boards and the pseudo-terminals sent by the IDE, that
+// are not attached. Boards that don't answer are tried again after dialInterval.
+func (agent *Agent) dialNetworkBoards() {
+	for _, device := range agent.devices {
+		if device.Address == "" || time.Since(agent.dials[device.Address]) < dialInterval {
+			continue
+		}
+
+		if agent.boardOnDevice(device.Address) != nil {
+			continue
+		}
+
+		agent.dials[device.Address] = time.Now()
+
+		log.Println("connecting to ", device.Address, " ...")
+
+		candidate := Board{agent: agent, id: device.Address}
+		candidate.setState(BoardOpening, "")
+
+		transport, err := agent.openTransport(device.Address)
+		if err != nil {
+			log.Println("can't connect to ", device.Address, ": ", err)
+			candidate.setState(BoardError, err.Error())
+			continue
+		}
+
+		candidate.attach(transport, device.Address)
+	}
+}
+
+// Monitor serial ports and search for Lua RTOS devices.
+// The Lua RTOS devices that are found are attached, and monitored until they are
+// disconnected.
+func (agent *Agent) monitor() {
+	defer func() {
+		log.Println("stop monitor ...")
+
+		if err := recover(); err != nil {
+			time.Sleep(time.Millisecond * 1000)
+
+			if !agent.stopped() {
+				go agent.monitor()
+			}
+		}
+	}()
+
+	log.Println("start monitor ...")
+
+	// Notify IDE that monitor is searching for a board
+	agent.notifyUpdate("Scanning boards")
+	agent.notify("boardState", BoardStateInfo{State: BoardScanning})
+
+	for {
+		select {
+		case <-agent.ideDetach:
+			return
+		case <-agent.done:
+			return
+		default:
+			// Test that the attached boards are still connected
+			agent.checkBoards()
+
+			// Connect to the network boards
+			agent.dialNetworkBoards()
+
+			// Enumerate all serial ports
+			ports, err := serial.ListPorts()
+			if err != nil {
+				log.Println("can't get serial ports")
+				agent.tryLater()
+				continue
+			}
+
+			// Search the serial ports that match with one of the supported adapters
+			skipped := make(map[string]bool)
+
+			for _, info := range ports {
+				// Skip the ports of the attached boards
+				if agent.boardOnDevice(info.Name()) != nil {
+					continue
+				}
+
+				// Read VID/PID
+				vendorId, productId, err := info.USBVIDPID()
+				if err != nil {
+					continue
+				}
+
+				// We need a VID / PID
+				if vendorId != 0 && productId != 0 {
+					vendorId := "0x" + strconv.FormatInt(int64(vendorId), 16)
+					productId := "0x" + strconv.FormatInt(int64(productId), 16)
+
+					log.Printf("found adapter, VID %s:%s (%s)", vendorId, productId, info.Name())
+
+					// Search a VID/PIN into requested devices
+
+					// Skip the first port of each dual adapter
+					if (vendorId == "0x403") && (productId == "0x6010") {
+						if !skipped[info.USBSerialNumber()] {
+							skipped[info.USBSerialNumber()] = true
+							continue
+						}
+					}
+
+					for _, device := range agent.devices {
+						if device.VendorId == vendorId && device.ProductId == productId {
+							// This adapter matches
+							log.Printf("check adapter, VID %s:%s", device.VendorId, device.ProductId)
+
+							// Create a candidate board
+							candidate := Board{agent: agent}
+
+							// Attach candidate
+							candidate.maxBauds, _ = strconv.Atoi(device.MaxBauds)
+							candidate.devInfo = info
+							candidate.id = agent.boardId(info.USBSerialNumber(), info.Name())
+							candidate.setState(BoardOpening, "")
+
+							transport, err := openSerial(info.Name())
+							if err != nil {
+								candidate.setState(BoardError, err.Error())
+								panic(err)
+							}
+
+							candidate.attach(transport, info.Name())
+
+							if agent.boardOnDevice(info.Name()) != nil {
+								break
+							}
+						}
+					}
+				}
+			}
+
+			agent.tryLater()
+		}
+	}
+}
@@ -0,0 +1,417 @@
+/*
+ * Whitecat Blocky Environment, IDE origin check and pairing
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+The agent only accepts websocket connections from the origins listed in the AllowedOrigins setting
+of wccagent.json. By default only the origin of BaseIdeURL is allowed.
+
+Before connecting to /control, /up and /down the IDE must be paired with the agent. The IDE opens
+the /pair websocket, and the agent sends a pairing code, that the IDE must show to the user:
+
+{"notify": "pairingRequested", "info": {"code": "123456"}}
+
+The user approves the request from the tray menu, or from the console if the agent runs without
+user interface, after checking that the code shown by the agent is the same. Then the agent sends
+the token, and closes the connection:
+
+{"notify": "pairingApproved", "info": {"token": "xxxx"}}
+
+If the user rejects the request:
+
+{"notify": "pairingRejected", "info": {}}
+
+The agent remembers the token, and the IDE must pass it in all the next connections, from the same
+origin, as a query parameter (/control?token=xxxx, /up?token=xxxx&client=xx).
+
+*/
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var errOriginNotAllowed = errors.New("origin not allowed")
+var errNotPaired = errors.New("not paired")
+
+// A token issued to a paired IDE
+type PairedToken struct {
+	Token  string    `json:"token"`
+	Origin string    `json:"origin"`
+	Date   time.Time `json:"date"`
+}
+
+type PairingRequestedInfo struct {
+	Code string `json:"code"`
+}
+
+type PairingApprovedInfo struct {
+	Token string `json:"token"`
+}
+
+// A pairing request waiting for the user approval
+type PairingRequest struct {
+	// Origin of the IDE, and the code that it shows to the user
+	Origin string
+	Code   string
+
+	// The user answer
+	approved chan bool
+
+	// Closed when the IDE closes the connection
+	cancel chan struct{}
+}
+
+// Max number of pairing requests waiting for the user approval
+const maxPairingRequests = 10
+
+func (agent *Agent) tokensFile() string {
+	return path.Join(agent.config.DataFolder, "tokens.json")
+}
+
+// Load the tokens of the paired IDEs
+func (agent *Agent) loadTokens() {
+	agent.pairedTokensMutex.Lock()
+	defer agent.pairedTokensMutex.Unlock()
+
+	agent.readTokens()
+}
+
+// Load the tokens of the paired IDEs if the tokens file has changed since it
+// was last read
+func (agent *Agent) reloadTokens() {
+	agent.pairedTokensMutex.Lock()
+	defer agent.pairedTokensMutex.Unlock()
+
+	info, err := os.Stat(agent.tokensFile())
+	if err != nil {
+		if agent.pairedTokensTime.IsZero() {
+			return
+		}
+	} else if info.ModTime().Equal(agent.pairedTokensTime) && info.Size() == agent.pairedTokensSize {
+		return
+	}
+
+	agent.readTokens()
+}
+
+// Must be called with the tokens locked
+func (agent *Agent) readTokens() {
+	agent.pairedTokens = nil
+	agent.pairedTokensTime = time.Time{}
+	agent.pairedTokensSize = 0
+
+	info, err := os.Stat(agent.tokensFile())
+	if err != nil {
+		return
+	}
+
+	data, err := ioutil.ReadFile(agent.tokensFile())
+	if err != nil {
+		return
+	}
+
+	agent.pairedTokensTime = info.ModTime()
+	agent.pairedTokensSize = info.Size()
+
+	if err := json.Unmarshal(data, &agent.pairedTokens); err != nil {
+		log.Println("can't read paired tokens: ", err)
+	}
+}
+
+// Must be called with the tokens locked
+func (agent *Agent) saveTokens() error {
+	data, err := json.MarshalIndent(agent.pairedTokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(agent.tokensFile(), data, 0600); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(agent.tokensFile()); err == nil {
+		agent.pairedTokensTime = info.ModTime()
+		agent.pairedTokensSize = info.Size()
+	}
+
+	return nil
+}
+
+// Issue a new token for an origin, and store it
+func (agent *Agent) addToken(origin string) (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	agent.pairedTokensMutex.Lock()
+	defer agent.pairedTokensMutex.Unlock()
+
+	agent.pairedTokens = append(agent.pairedTokens, PairedToken{
+		Token:  hex.EncodeToString(token),
+		Origin: origin,
+		Date:   time.Now(),
+	})
+
+	if err := agent.saveTokens(); err != nil {
+		agent.pairedTokens = agent.pairedTokens[:len(agent.pairedTokens)-1]
+		return "", err
+	}
+
+	return hex.EncodeToString(token), nil
+}
+
+// Test if token was issued for origin
+func (agent *Agent) validToken(token string, origin string) bool {
+	agent.pairedTokensMutex.Lock()
+	defer agent.pairedTokensMutex.Unlock()
+
+	if token == "" {
+		return false
+	}
+
+	for _, paired := range agent.pairedTokens {
+		if subtle.ConstantTimeCompare([]byte(paired.Token), []byte(token)) == 1 && paired.Origin == origin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Test if a token was issued, for any origin
+func (agent *Agent) hasToken(token string) bool {
+	agent.pairedTokensMutex.Lock()
+	defer agent.pairedTokensMutex.Unlock()
+
+	for _, paired := range agent.pairedTokens {
+		if subtle.ConstantTimeCompare([]byte(paired.Token), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Test if a token can be used with the REST API
+func (agent *Agent) validApiToken(token string) bool {
+	if token == "" {
+		return false
+	}
+
+	if agent.hasToken(token) {
+		return true
+	}
+
+	// The token may have been created with wccagent -token while the agent is
+	// running. The tokens file is only read again if it has changed.
+	agent.reloadTokens()
+
+	return agent.hasToken(token)
+}
+
+// Test if an origin is in the allow-list. Only the scheme and the host of the
+// allowed URLs are compared.
+func (agent *Agent) originAllowed(origin *url.URL) bool {
+	for _, allowed := range agent.config.AllowedOrigins {
+		allowedURL, err := url.Parse(allowed)
+		if err != nil {
+			continue
+		}
+
+		if strings.EqualFold(allowedURL.Scheme, origin.Scheme) && strings.EqualFold(allowedURL.Host, origin.Host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Websocket handshake that only accepts allowed origins
+func (agent *Agent) checkOrigin(config *websocket.Config, r *http.Request) error {
+	var err error
+
+	config.Origin, err = websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+
+	if config.Origin == nil || !agent.originAllowed(config.Origin) {
+		log.Println("rejected connection from origin ", r.Header.Get("Origin"))
+		return errOriginNotAllowed
+	}
+
+	return nil
+}
+
+// Websocket handshake that only accepts paired IDEs, from allowed origins
+func (agent *Agent) checkPaired(config *websocket.Config, r *http.Request) error {
+	if err := agent.checkOrigin(config, r); err != nil {
+		return err
+	}
+
+	if !agent.validToken(r.URL.Query().Get("token"), config.Origin.String()) {
+		log.Println("rejected connection from not paired origin ", config.Origin)
+		return errNotPaired
+	}
+
+	return nil
+}
+
+// Websocket handler for paired IDEs
+func (agent *Agent) pairedHandler(handler websocket.Handler) http.Handler {
+	return heartbeatServer{websocket.Server{Handler: handler, Handshake: agent.checkPaired}}
+}
+
+func newPairingCode() string {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "000000"
+	}
+
+	return fmt.Sprintf("%06d", n)
+}
+
+func sendPairingNotification(ws *websocket.Conn, notification string, info interface{}) {
+	msg := marshalNotification(Notification{Notify: notification, Info: info})
+	if msg != nil {
+		websocket.Message.Send(ws, string(msg))
+	}
+}
+
+// Pair an IDE
+func (agent *Agent) pair(ws *websocket.Conn) {
+	defer ws.Close()
+
+	request := &PairingRequest{
+		Origin:   ws.Config().Origin.String(),
+		Code:     newPairingCode(),
+		approved: make(chan bool, 1),
+		cancel:   make(chan struct{}),
+	}
+
+	log.Println("pairing request from ", request.Origin, " with code ", request.Code)
+
+	defer agent.startHeartbeat(ws, nil, nil)()
+
+	select {
+	case agent.pairingRequests <- request:
+	default:
+		log.Println("too many pairing requests")
+		sendPairingNotification(ws, "pairingRejected", nil)
+		return
+	}
+
+	sendPairingNotification(ws, "pairingRequested", PairingRequestedInfo{Code: request.Code})
+
+	go func() {
+		var msg string
+
+		for websocket.Message.Receive(ws, &msg) == nil {
+		}
+
+		close(request.cancel)
+	}()
+
+	select {
+	case approved := <-request.approved:
+		if !approved {
+			log.Println("pairing request ", request.Code, " rejected")
+			sendPairingNotification(ws, "pairingRejected", nil)
+			return
+		}
+
+		token, err := agent.addToken(request.Origin)
+		if err != nil {
+			log.Println("can't store token: ", err)
+			sendPairingNotification(ws, "pairingRejected", nil)
+			return
+		}
+
+		log.Println("pairing request ", request.Code, " approved")
+		sendPairingNotification(ws, "pairingApproved", PairingApprovedInfo{Token: token})
+
+	case <-request.cancel:
+		log.Println("pairing request ", request.Code, " cancelled")
+	}
+}
+
+// Get the next pairing request that is still waiting for the user approval.
+// Returns nil when the agent is stopped.
+func (agent *Agent) NextPairingRequest() *PairingRequest {
+	for {
+		select {
+		case request := <-agent.pairingRequests:
+			select {
+			case <-request.cancel:
+				continue
+			default:
+				return request
+			}
+
+		case <-agent.done:
+			return nil
+		}
+	}
+}
+
+// Answer a pairing request
+func (request *PairingRequest) Approve(approved bool) {
+	request.approved <- approved
+}
+
+// Get a channel that is closed when the IDE cancels the request
+func (request *PairingRequest) Cancelled() <-chan struct{} {
+	return request.cancel
+}
+
+// Create a token for scripts, that is not bound to an origin
+func (agent *Agent) NewToken() (string, error) {
+	agent.loadTokens()
+
+	return agent.addToken("")
+}
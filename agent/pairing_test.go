@@ -0,0 +1,184 @@
+/*
+ * Whitecat Blocky Environment, pairing tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestApiTokenCreatedByOtherProcess(t *testing.T) {
+	folder := t.TempDir()
+
+	agent := New(Config{DataFolder: folder})
+	agent.loadTokens()
+
+	if agent.validApiToken("unknown") {
+		t.Fatal("unknown token accepted")
+	}
+
+	// wccagent -token, while the agent is running
+	token, err := New(Config{DataFolder: folder}).NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !agent.validApiToken(token) {
+		t.Fatal("new token rejected")
+	}
+}
+
+func TestApiTokenReloadOnlyOnChange(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir()})
+
+	token, err := agent.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite the file without changing its size and modification time. An
+	// unknown token must not read it again.
+	info, err := os.Stat(agent.tokensFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(agent.tokensFile(), bytes.Repeat([]byte(" "), int(info.Size())), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(agent.tokensFile(), info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	if agent.validApiToken("unknown") {
+		t.Fatal("unknown token accepted")
+	}
+
+	if !agent.validApiToken(token) {
+		t.Fatal("tokens file read again without changes")
+	}
+
+	// Once the file changes, it is read again
+	later := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(agent.tokensFile(), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	agent.validApiToken("unknown")
+
+	if agent.validApiToken(token) {
+		t.Fatal("changed tokens file not read again")
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir(), BaseIdeURL: "https://ide.example.com/ide"})
+
+	for origin, allowed := range map[string]bool{
+		"https://ide.example.com":      true,
+		"https://IDE.example.com":      true,
+		"http://ide.example.com":       false,
+		"https://ide.example.com:8443": false,
+		"https://evil.example.com":     false,
+	} {
+		u, _ := url.Parse(origin)
+		if agent.originAllowed(u) != allowed {
+			t.Errorf("%s: allowed %v, expected %v", origin, !allowed, allowed)
+		}
+	}
+}
+
+func TestControlRequiresPairing(t *testing.T) {
+	agent := testAgent(t)
+	url, token := startWebsocketServer(t, agent)
+
+	other, err := agent.addToken("https://other.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		origin string
+		token  string
+	}{
+		{"https://evil.example.com", token},
+		{testOrigin, ""},
+		{testOrigin, "unknown"},
+		{testOrigin, other},
+	} {
+		if ws, err := websocket.Dial(url+"/control?token="+test.token, "", test.origin); err == nil {
+			ws.Close()
+			t.Errorf("connection from %s with token %q accepted", test.origin, test.token)
+		}
+	}
+
+	dialWebsocket(t, url+"/control?token="+token)
+}
+
+func TestPairing(t *testing.T) {
+	agent := testAgent(t)
+	url, _ := startWebsocketServer(t, agent)
+
+	for _, approved := range []bool{false, true} {
+		ws := dialWebsocket(t, url+"/pair")
+
+		requested := receiveNotification(t, ws, "pairingRequested", "")
+		code := requested.Info.(map[string]interface{})["code"]
+
+		// The user checks the code shown by the IDE
+		request := agent.NextPairingRequest()
+		if request.Code != code || request.Origin != testOrigin {
+			t.Fatalf("request %s from %s, expected %s from %s", request.Code, request.Origin, code, testOrigin)
+		}
+
+		request.Approve(approved)
+
+		if !approved {
+			receiveNotification(t, ws, "pairingRejected", "")
+			continue
+		}
+
+		info := receiveNotification(t, ws, "pairingApproved", "").Info.(map[string]interface{})
+		token, _ := info["token"].(string)
+
+		if !agent.validToken(token, testOrigin) {
+			t.Fatal("paired token rejected")
+		}
+
+		dialWebsocket(t, url+"/control?token="+token)
+	}
+}
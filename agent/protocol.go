@@ -0,0 +1,417 @@
+/*
+ * Whitecat Blocky Environment, agent protocol messages
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// JSON Schema of the protocol, served by the agent at /protocol.schema.json.
+// parseCommand validates the commands against it, see schema.go.
+//
+//go:embed protocol.schema.json
+var protocolSchema []byte
+
+// Notification, or command reply, sent to the IDE. Board is the id of the board
+// that has sent the notification, see boards.go.
+type Notification struct {
+	Notify string      `json:"notify"`
+	Id     string      `json:"id,omitempty"`
+	Board  string      `json:"board,omitempty"`
+	Status string      `json:"status,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	Info   interface{} `json:"info"`
+}
+
+type BoardAttachedInfo struct {
+	Id       string          `json:"id"`
+	Info     json.RawMessage `json:"info"`
+	NewBuild bool            `json:"newBuild"`
+}
+
+type BoardDetachedInfo struct {
+	Id string `json:"id"`
+}
+
+// Byte slices are sent base64 encoded
+type BlockInfo struct {
+	Block []byte `json:"block"`
+}
+
+type BlockErrorInfo struct {
+	Block []byte `json:"block"`
+	Error []byte `json:"error"`
+}
+
+type RuntimeErrorInfo struct {
+	Where     string `json:"where"`
+	Line      string `json:"line"`
+	Exception string `json:"exception"`
+	Message   []byte `json:"message"`
+}
+
+type DirEntry struct {
+	Type string `json:"type"`
+	Size string `json:"size"`
+	Date string `json:"date"`
+	Name string `json:"name"`
+}
+
+type FileContentInfo struct {
+	Content []byte `json:"content"`
+}
+
+// Reply of a command that sends data to the IDE in binary frames
+type BinaryTransferInfo struct {
+	Transfer string `json:"transfer"`
+	Size     int    `json:"size"`
+}
+
+type RunCommandInfo struct {
+	Response []byte `json:"response"`
+}
+
+type UpdateInfo struct {
+	What []byte `json:"what"`
+}
+
+// Version of the protocol implemented by the agent. IDEs that implement a
+// protocol version between MinProtocolVersion and ProtocolVersion are
+// compatible. IDEs that don't send a protocol version are assumed to implement
+// the protocol version 1.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+)
+
+// Max size of the files that can be sent to, or received from, the board
+const MaxFileSize = 16 * 1024 * 1024
+
+// Capabilities of the agent, sent to the IDE in the attachIde reply
+type Capabilities struct {
+	Commands        []string `json:"commands"`
+	Notifications   []string `json:"notifications"`
+	Transports      []string `json:"transports"`
+	BoardTransports []string `json:"boardTransports"`
+	MaxFileSize     int      `json:"maxFileSize"`
+	ChunkSize       int      `json:"chunkSize"`
+	FrameSize       int      `json:"frameSize"`
+	BinaryFrames    bool     `json:"binaryFrames"`
+	MultipleBoards  bool     `json:"multipleBoards"`
+	MultipleIdes    bool     `json:"multipleIdes"`
+	Sessions        bool     `json:"sessions"`
+	Flashing        bool     `json:"flashing"`
+}
+
+type AttachIdeInfo struct {
+	AgentVersion    string        `json:"agent-version"`
+	ProtocolVersion int           `json:"protocolVersion"`
+	Capabilities    *Capabilities `json:"capabilities,omitempty"`
+	ClientId        string        `json:"clientId"`
+	LeaseHolder     string        `json:"leaseHolder"`
+	Session         string        `json:"session"`
+	Resumed         bool          `json:"resumed"`
+}
+
+type LeaseInfo struct {
+	Holder string `json:"holder"`
+	Board  string `json:"board,omitempty"`
+}
+
+type LeaseRequestedInfo struct {
+	Client string `json:"client"`
+	Board  string `json:"board,omitempty"`
+}
+
+type IncompatibleProtocolInfo struct {
+	AgentVersion       string `json:"agent-version"`
+	ProtocolVersion    int    `json:"protocolVersion"`
+	MinProtocolVersion int    `json:"minProtocolVersion"`
+	IdeVersion         int    `json:"ideVersion"`
+}
+
+type CommandRejectedInfo struct {
+	Command string `json:"command"`
+	Reason  string `json:"reason"`
+}
+
+// Command received from the IDE. Arguments are decoded later, when the command
+// is known. Timeout is the deadline of a board command, in milliseconds, and
+// Board is the id of the board that executes it, the default board if empty.
+type CommandMessage struct {
+	Id        string          `json:"id"`
+	Command   string          `json:"command"`
+	Timeout   int             `json:"timeout"`
+	Board     string          `json:"board"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// Session is the id of a session to resume
+type AttachIdeArguments struct {
+	ProtocolVersion int         `json:"protocolVersion"`
+	Devices         []deviceDef `json:"devices"`
+	Session         string      `json:"session"`
+}
+
+type PathArguments struct {
+	Path string `json:"path"`
+}
+
+type ReadFileArguments struct {
+	Path     string `json:"path"`
+	Transfer string `json:"transfer"`
+}
+
+// Content is base64 encoded, unless transfer is binary. In this case size bytes
+// follow the command in binary frames.
+type WriteFileArguments struct {
+	Path     string `json:"path"`
+	Content  string `json:"content"`
+	Transfer string `json:"transfer"`
+	Size     int    `json:"size"`
+}
+
+type RunProgramArguments struct {
+	Path     string `json:"path"`
+	Code     string `json:"code"`
+	Transfer string `json:"transfer"`
+	Size     int    `json:"size"`
+}
+
+type UploadFirmwareArguments struct {
+	Size int `json:"size"`
+}
+
+type UpgradeArguments struct {
+	Custom bool `json:"custom"`
+}
+
+type RunCommandArguments struct {
+	Path string `json:"path"`
+	Code string `json:"code"`
+}
+
+// Firmware is required, unless a custom firmware is installed
+type InstallArguments struct {
+	Firmware string `json:"firmware"`
+	Custom   bool   `json:"custom"`
+}
+
+// Arguments for each command. Commands without arguments have a nil entry.
+var commandArguments = map[string]func() interface{}{
+	"attachIde":           func() interface{} { return &AttachIdeArguments{} },
+	"detachIde":           nil,
+	"boardUpgrade":        func() interface{} { return &UpgradeArguments{} },
+	"boardInfo":           nil,
+	"boardReset":          nil,
+	"boardStop":           nil,
+	"boardGetDirContent":  func() interface{} { return &PathArguments{} },
+	"boardReadFile":       func() interface{} { return &ReadFileArguments{} },
+	"boardWriteFile":      func() interface{} { return &WriteFileArguments{} },
+	"boardRemoveFile":     func() interface{} { return &PathArguments{} },
+	"boardRunProgram":     func() interface{} { return &RunProgramArguments{} },
+	"boardRunCommand":     func() interface{} { return &RunCommandArguments{} },
+	"boardInstall":        func() interface{} { return &InstallArguments{} },
+	"agentUploadFirmware": func() interface{} { return &UploadFirmwareArguments{} },
+	"boardLeaseRequest":   nil,
+	"boardLeaseRelease":   nil,
+	"cancel":              func() interface{} { return &CancelArguments{} },
+}
+
+// Commands that only the lease holder can send
+var leasedCommands = map[string]bool{
+	"boardUpgrade":        true,
+	"boardReset":          true,
+	"boardStop":           true,
+	"boardGetDirContent":  true,
+	"boardReadFile":       true,
+	"boardWriteFile":      true,
+	"boardRemoveFile":     true,
+	"boardRunProgram":     true,
+	"boardRunCommand":     true,
+	"boardInstall":        true,
+	"agentUploadFirmware": true,
+}
+
+// Notifications that the agent can send
+var notificationTypes = []string{
+	"attachIde",
+	"detachIde",
+	"boardAttached",
+	"boardDetached",
+	"boardPowerOnReset",
+	"boardSoftwareReset",
+	"boardDeepSleepReset",
+	"boardRuntimeError",
+	"boardRuntimeWarning",
+	"boardUpdate",
+	"boardState",
+	"boardUpgraded",
+	"boardInfo",
+	"boardReset",
+	"boardTimeout",
+	"boardGetDirContent",
+	"boardReadFile",
+	"boardWriteFile",
+	"boardRemoveFile",
+	"boardRunProgram",
+	"boardRunCommand",
+	"blockStart",
+	"blockEnd",
+	"blockError",
+	"blockErrorCatched",
+	"invalidFirmware",
+	"invalidPrerequisites",
+	"agentUploadFirmware",
+	"boardLease",
+	"boardLeaseRequest",
+	"boardLeaseRelease",
+	"boardLeaseRequested",
+	"boardConsoleIn",
+	"commandRejected",
+	"incompatibleProtocol",
+	"pairingRequested",
+	"pairingApproved",
+	"pairingRejected",
+	"agentHeartbeat",
+	"sessionResumed",
+	"cancel",
+	"consoleOverflow",
+}
+
+// Get the capabilities of this agent build
+func agentCapabilities() *Capabilities {
+	commands := make([]string, 0, len(commandArguments))
+	for command := range commandArguments {
+		commands = append(commands, command)
+	}
+
+	sort.Strings(commands)
+
+	return &Capabilities{
+		Commands:        commands,
+		Notifications:   notificationTypes,
+		Transports:      []string{"websocket"},
+		BoardTransports: []string{"serial", "telnet", "tcp"},
+		MaxFileSize:     MaxFileSize,
+		ChunkSize:       BoardChunkSize,
+		FrameSize:       FrameSize,
+		BinaryFrames:    true,
+		MultipleBoards:  true,
+		MultipleIdes:    true,
+		Sessions:        true,
+		Flashing:        true,
+	}
+}
+
+// Test if the IDE's protocol version is compatible with the agent's protocol version
+func compatibleProtocol(ideVersion int) bool {
+	if ideVersion == 0 {
+		ideVersion = 1
+	}
+
+	return ideVersion >= MinProtocolVersion && ideVersion <= ProtocolVersion
+}
+
+// Decode JSON into v, rejecting unknown fields
+func decodeStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	return decoder.Decode(v)
+}
+
+// Parse a command received from the IDE, and validate it. If the command is
+// not valid, the returned error has the reason. The returned command has
+// the id and the command name, if they can be parsed.
+func parseCommand(msg string) (CommandMessage, interface{}, error) {
+	var command CommandMessage
+
+	if err := decodeStrict([]byte(msg), &command); err != nil {
+		// Try to get the id for the rejection
+		json.Unmarshal([]byte(msg), &command)
+
+		return command, nil, err
+	}
+
+	newArguments, ok := commandArguments[command.Command]
+	if !ok {
+		return command, nil, fmt.Errorf("unknown command %q", command.Command)
+	}
+
+	var message map[string]interface{}
+	if err := decodeJSON([]byte(msg), &message); err != nil {
+		return command, nil, err
+	}
+
+	if newArguments == nil {
+		return command, nil, commandSchemas.validateCommand(command.Command, message)
+	}
+
+	raw := command.Arguments
+
+	// Old IDEs send arguments as a JSON encoded string
+	if len(raw) > 0 && raw[0] == '"' {
+		unquoted, err := strconv.Unquote(string(raw))
+		if err != nil {
+			return command, nil, err
+		}
+
+		raw = []byte(unquoted)
+	}
+
+	if len(raw) == 0 || string(raw) == "null" {
+		raw = []byte("{}")
+	}
+
+	var decoded interface{}
+	if err := decodeJSON(raw, &decoded); err != nil {
+		return command, nil, errors.New("arguments: " + err.Error())
+	}
+
+	message["arguments"] = decoded
+
+	if err := commandSchemas.validateCommand(command.Command, message); err != nil {
+		return command, nil, err
+	}
+
+	arguments := newArguments()
+	if err := decodeStrict(raw, arguments); err != nil {
+		return command, nil, errors.New("arguments: " + err.Error())
+	}
+
+	return command, arguments, nil
+}
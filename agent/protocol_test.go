@@ -0,0 +1,165 @@
+/*
+ * Whitecat Blocky Environment, protocol tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// The object schema of the arguments of a command
+func argumentsSchema(t *testing.T, command string) map[string]interface{} {
+	branch := commandSchemas.commands[command].(map[string]interface{})
+	arguments := branch["properties"].(map[string]interface{})["arguments"].(map[string]interface{})
+
+	if ref, ok := arguments["$ref"].(string); ok {
+		arguments = commandSchemas.resolve(ref).(map[string]interface{})
+	}
+
+	if one, ok := arguments["oneOf"].([]interface{}); ok {
+		for _, s := range one {
+			if s.(map[string]interface{})["type"] == "object" {
+				return s.(map[string]interface{})
+			}
+		}
+
+		t.Fatalf("%s: no object arguments in the schema", command)
+	}
+
+	return arguments
+}
+
+func jsonFields(v interface{}) []string {
+	var fields []string
+
+	typ := reflect.TypeOf(v).Elem()
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = typ.Field(i).Name
+		}
+
+		fields = append(fields, name)
+	}
+
+	sort.Strings(fields)
+
+	return fields
+}
+
+func TestCommandsMatchSchema(t *testing.T) {
+	for command := range commandArguments {
+		if _, ok := commandSchemas.commands[command]; !ok {
+			t.Errorf("%s is not in protocol.schema.json", command)
+		}
+	}
+
+	for command := range commandSchemas.commands {
+		newArguments, ok := commandArguments[command]
+		if !ok {
+			t.Errorf("%s is in protocol.schema.json, but the agent doesn't accept it", command)
+			continue
+		}
+
+		if newArguments == nil {
+			continue
+		}
+
+		var properties []string
+		for name := range argumentsSchema(t, command)["properties"].(map[string]interface{}) {
+			properties = append(properties, name)
+		}
+
+		sort.Strings(properties)
+
+		if fields := jsonFields(newArguments()); !strings.EqualFold(strings.Join(fields, ","), strings.Join(properties, ",")) {
+			t.Errorf("%s: arguments %v don't match the schema properties %v", command, fields, properties)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	for _, test := range []struct {
+		msg       string
+		arguments interface{}
+	}{
+		{`{"command":"boardReset","id":"1"}`, nil},
+		{`{"command":"boardStop","arguments":null}`, nil},
+		{`{"command":"attachIde","arguments":"{\"protocolVersion\":2}"}`, &AttachIdeArguments{ProtocolVersion: 2}},
+		{`{"command":"attachIde"}`, &AttachIdeArguments{}},
+		{`{"command":"boardReadFile","board":"b","timeout":100,"arguments":{"path":"/a.lua","transfer":"binary"}}`, &ReadFileArguments{Path: "/a.lua", Transfer: "binary"}},
+		{`{"command":"boardWriteFile","arguments":{"path":"/a.lua","content":"cHJpbnQoMSk="}}`, &WriteFileArguments{Path: "/a.lua", Content: "cHJpbnQoMSk="}},
+		{`{"command":"boardInstall"}`, &InstallArguments{}},
+		{`{"command":"cancel","arguments":{"id":"7"}}`, &CancelArguments{Id: "7"}},
+	} {
+		_, arguments, err := parseCommand(test.msg)
+		if err != nil {
+			t.Errorf("%s: %v", test.msg, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(arguments, test.arguments) {
+			t.Errorf("%s: got %#v, want %#v", test.msg, arguments, test.arguments)
+		}
+	}
+}
+
+func TestParseCommandRejected(t *testing.T) {
+	for _, test := range []struct {
+		msg    string
+		reason string
+	}{
+		{`{"command":"boardFly"}`, `unknown command "boardFly"`},
+		{`{"command":"boardReadFile","arguments":{}}`, "arguments: path failed on required"},
+		{`{"command":"boardReadFile","arguments":{"path":""}}`, "arguments: path failed on minLength"},
+		{`{"command":"boardReadFile","arguments":{"path":"/a","transfer":"hex"}}`, "arguments: transfer failed on enum"},
+		{`{"command":"boardReadFile","arguments":{"path":"/a","offset":1}}`, "arguments: offset failed on additionalProperties"},
+		{`{"command":"boardWriteFile","arguments":{"path":"/a","size":-1}}`, "arguments: size failed on minimum"},
+		{`{"command":"boardWriteFile","arguments":{"path":"/a","size":1.5}}`, "arguments: size failed on type"},
+		{`{"command":"agentUploadFirmware","arguments":{"size":0}}`, "arguments: size failed on minimum"},
+		{`{"command":"boardRunCommand","arguments":{"code":""}}`, "arguments: code failed on minLength"},
+		{`{"command":"cancel","arguments":{}}`, "arguments: id failed on required"},
+		{`{"command":"boardReset","timeout":-1}`, "timeout failed on minimum"},
+		{`{"command":"boardReset","arguments":{"now":true}}`, "arguments: now failed on additionalProperties"},
+		{`{"command":"attachIde","arguments":{"protocolVersion":0}}`, "arguments: protocolVersion failed on minimum"},
+	} {
+		_, _, err := parseCommand(test.msg)
+		if err == nil {
+			t.Errorf("%s: accepted", test.msg)
+			continue
+		}
+
+		if err.Error() != test.reason {
+			t.Errorf("%s: got %q, want %q", test.msg, err, test.reason)
+		}
+	}
+}
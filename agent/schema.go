@@ -0,0 +1,366 @@
+/*
+ * Whitecat Blocky Environment, protocol schema validation
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+The commands received from the IDE are validated against protocol.schema.json, the same
+document that the agent publishes, so the schema and the validation can't drift.
+
+Only the JSON Schema keywords used by protocol.schema.json are implemented: type, enum, const,
+properties, required, additionalProperties, items, minimum, minLength, pattern, oneOf, allOf,
+if / then and local $ref. Annotations, such as description or contentEncoding, are ignored.
+
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+type schemaError struct {
+	Path    string
+	Keyword string
+}
+
+func (err *schemaError) Error() string {
+	return err.Path + " failed on " + err.Keyword
+}
+
+type jsonSchema struct {
+	definitions map[string]interface{}
+
+	// Schema of each command, by command name
+	commands map[string]interface{}
+}
+
+var commandSchemas = mustCompileSchema(protocolSchema)
+
+// Parse the protocol schema, and index the definitions of the commands by
+// command name
+func compileSchema(document []byte) (*jsonSchema, error) {
+	var root map[string]interface{}
+	if err := decodeJSON(document, &root); err != nil {
+		return nil, err
+	}
+
+	definitions, _ := root["definitions"].(map[string]interface{})
+
+	schema := &jsonSchema{
+		definitions: definitions,
+		commands:    make(map[string]interface{}),
+	}
+
+	command, _ := definitions["command"].(map[string]interface{})
+	branches, _ := command["oneOf"].([]interface{})
+	for _, branch := range branches {
+		properties, _ := branch.(map[string]interface{})["properties"].(map[string]interface{})
+		name, _ := properties["command"].(map[string]interface{})
+
+		if value, ok := name["const"].(string); ok {
+			schema.commands[value] = branch
+		}
+
+		if values, ok := name["enum"].([]interface{}); ok {
+			for _, value := range values {
+				schema.commands[value.(string)] = branch
+			}
+		}
+	}
+
+	return schema, nil
+}
+
+func mustCompileSchema(document []byte) *jsonSchema {
+	schema, err := compileSchema(document)
+	if err != nil {
+		panic("protocol.schema.json: " + err.Error())
+	}
+
+	return schema
+}
+
+// Decode JSON keeping numbers as json.Number, to check integers
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	return decoder.Decode(v)
+}
+
+// Validate a decoded command message against the schema of the command
+func (schema *jsonSchema) validateCommand(name string, message interface{}) error {
+	command, ok := schema.commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q", name)
+	}
+
+	return schema.validate(command, message, "")
+}
+
+func (schema *jsonSchema) resolve(ref string) interface{} {
+	if !strings.HasPrefix(ref, "#/definitions/") {
+		panic("protocol.schema.json: unsupported $ref " + ref)
+	}
+
+	return schema.definitions[strings.TrimPrefix(ref, "#/definitions/")]
+}
+
+func schemaPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+
+	if path == "arguments" {
+		return path + ": " + name
+	}
+
+	return path + "." + name
+}
+
+func schemaType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+
+	return ""
+}
+
+func schemaHasType(value interface{}, types interface{}) bool {
+	valueType := schemaType(value)
+
+	matches := func(t interface{}) bool {
+		return t == valueType || (t == "number" && valueType == "integer")
+	}
+
+	if list, ok := types.([]interface{}); ok {
+		for _, t := range list {
+			if matches(t) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return matches(types)
+}
+
+func schemaEqual(a, b interface{}) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+
+	return bytes.Equal(ja, jb)
+}
+
+func schemaNumber(value interface{}) (float64, bool) {
+	if number, ok := value.(json.Number); ok {
+		f, err := number.Float64()
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+// Validate value against a schema. path is the name of the value, used in the
+// returned error.
+func (schema *jsonSchema) validate(s interface{}, value interface{}, path string) error {
+	rules, ok := s.(map[string]interface{})
+	if !ok {
+		// true, false, or a missing definition
+		if s == false {
+			return &schemaError{Path: path, Keyword: "false"}
+		}
+
+		return nil
+	}
+
+	if ref, ok := rules["$ref"].(string); ok {
+		if err := schema.validate(schema.resolve(ref), value, path); err != nil {
+			return err
+		}
+	}
+
+	if types, ok := rules["type"]; ok && !schemaHasType(value, types) {
+		return &schemaError{Path: path, Keyword: "type"}
+	}
+
+	if constant, ok := rules["const"]; ok && !schemaEqual(value, constant) {
+		return &schemaError{Path: path, Keyword: "const"}
+	}
+
+	if values, ok := rules["enum"].([]interface{}); ok {
+		found := false
+		for _, v := range values {
+			if schemaEqual(value, v) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return &schemaError{Path: path, Keyword: "enum"}
+		}
+	}
+
+	if number, ok := schemaNumber(value); ok {
+		if minimum, ok := schemaNumber(rules["minimum"]); ok && number < minimum {
+			return &schemaError{Path: path, Keyword: "minimum"}
+		}
+	}
+
+	if str, ok := value.(string); ok {
+		if minLength, ok := schemaNumber(rules["minLength"]); ok && float64(utf8.RuneCountInString(str)) < minLength {
+			return &schemaError{Path: path, Keyword: "minLength"}
+		}
+
+		if pattern, ok := rules["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(str) {
+			return &schemaError{Path: path, Keyword: "pattern"}
+		}
+	}
+
+	if object, ok := value.(map[string]interface{}); ok {
+		if err := schema.validateObject(rules, object, path); err != nil {
+			return err
+		}
+	}
+
+	if array, ok := value.([]interface{}); ok {
+		if items, ok := rules["items"]; ok {
+			for i, item := range array {
+				if err := schema.validate(items, item, schemaPath(path, fmt.Sprint(i))); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if all, ok := rules["allOf"].([]interface{}); ok {
+		for _, s := range all {
+			if err := schema.validate(s, value, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	if one, ok := rules["oneOf"].([]interface{}); ok {
+		// When no schema matches, report the error of the schema of the
+		// same type as the value, if any
+		var typeErr error
+
+		matches := 0
+		for _, s := range one {
+			err := schema.validate(s, value, path)
+			if err == nil {
+				matches++
+			} else if e, ok := err.(*schemaError); typeErr == nil && ok && (e.Path != path || e.Keyword != "type") {
+				typeErr = err
+			}
+		}
+
+		if matches == 0 && typeErr != nil {
+			return typeErr
+		}
+
+		if matches != 1 {
+			return &schemaError{Path: path, Keyword: "oneOf"}
+		}
+	}
+
+	if condition, ok := rules["if"]; ok {
+		if schema.validate(condition, value, path) == nil {
+			if err := schema.validate(rules["then"], value, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (schema *jsonSchema) validateObject(rules map[string]interface{}, object map[string]interface{}, path string) error {
+	if required, ok := rules["required"].([]interface{}); ok {
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				return &schemaError{Path: schemaPath(path, name.(string)), Keyword: "required"}
+			}
+		}
+	}
+
+	properties, _ := rules["properties"].(map[string]interface{})
+
+	// Sorted, to always report the same error
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		property := object[name]
+		if s, ok := properties[name]; ok {
+			if err := schema.validate(s, property, schemaPath(path, name)); err != nil {
+				return err
+			}
+		} else if additional, ok := rules["additionalProperties"]; ok {
+			if err := schema.validate(additional, property, schemaPath(path, name)); err != nil {
+				if additional == false {
+					return &schemaError{Path: schemaPath(path, name), Keyword: "additionalProperties"}
+				}
+
+				return err
+			}
+		}
+	}
+
+	return nil
+}
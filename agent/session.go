@@ -0,0 +1,315 @@
+/*
+ * Whitecat Blocky Environment, resumable IDE sessions
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+Each attached IDE has a session. The session id is sent in the attachIde reply:
+
+{"notify": "attachIde", "id": "xx", "status": "ok", "info": {..., "session": "xx", "resumed": false}}
+
+If the IDE is reloaded, or the connection is lost, it can resume the session sending the session id
+in attachIde, before SessionTimeout expires:
+
+{"command": "attachIde", "id": "xx", "arguments": {"session": "xx"}}
+
+When a session is resumed the board is not reset, so the running program is not interrupted. After
+the attachIde reply the agent sends the notifications that the IDE has missed, and then:
+
+{"notify": "sessionResumed", "info": {"session": "xx", "replayed": 10, "missed": 0}}
+
+missed is the number of notifications that were lost because the replay buffer is full. The console
+output that the IDE has missed, from the last output written to its console connection, is sent when
+the /up connection is opened. If the connection selects a board, only its output is sent.
+
+detachIde ends the session.
+
+*/
+
+import (
+	"time"
+)
+
+// Size of the replay buffer, in notifications and in console bytes
+const (
+	replayNotifications = 512
+	replayConsole       = 64 * 1024
+)
+
+type SessionResumedInfo struct {
+	Session  string `json:"session"`
+	Replayed int    `json:"replayed"`
+	Missed   int    `json:"missed"`
+}
+
+type session struct {
+	id string
+
+	// Client of the session, nil if the client is gone
+	client *client
+	gone   time.Time
+
+	// Last notification, and console byte, that the client has received before
+	// disconnect
+	notificationSeq uint64
+	consoleOffset   uint64
+
+	// Console output must be replayed when /up is connected
+	consolePending bool
+}
+
+// Ring buffers with the last notifications and console output sent to the clients
+type replayBuffer struct {
+	notifications [replayNotifications][]byte
+	seq           uint64
+
+	console       [replayConsole]byte
+	consoleOffset uint64
+
+	// Board of each part of the console output in the buffer
+	consoleParts []consolePart
+}
+
+// Part of the console output sent by a board, from offset to the next part
+type consolePart struct {
+	offset uint64
+	board  string
+}
+
+func (replay *replayBuffer) addNotification(msg []byte) {
+	replay.seq++
+	replay.notifications[replay.seq%replayNotifications] = msg
+}
+
+func (replay *replayBuffer) addConsole(board string, data []byte) {
+	if n := len(replay.consoleParts); n == 0 || replay.consoleParts[n-1].board != board {
+		replay.consoleParts = append(replay.consoleParts, consolePart{offset: replay.consoleOffset, board: board})
+	}
+
+	for _, b := range data {
+		replay.console[replay.consoleOffset%replayConsole] = b
+		replay.consoleOffset++
+	}
+
+	// Remove the parts that are no longer in the buffer
+	first := replay.consoleFirst()
+	for len(replay.consoleParts) > 1 && replay.consoleParts[1].offset <= first {
+		replay.consoleParts = replay.consoleParts[1:]
+	}
+}
+
+// Offset of the first console byte that is still in the buffer
+func (replay *replayBuffer) consoleFirst() uint64 {
+	if replay.consoleOffset > replayConsole {
+		return replay.consoleOffset - replayConsole
+	}
+
+	return 0
+}
+
+// Get the notifications after seq, up to last, and how many of them are lost
+func (replay *replayBuffer) notificationsBetween(seq uint64, last uint64) (msgs [][]byte, missed int) {
+	// Only the last replayNotifications notifications are kept
+	if replay.seq > replayNotifications {
+		first := replay.seq - replayNotifications
+		if first > last {
+			first = last
+		}
+
+		if seq < first {
+			missed = int(first - seq)
+			seq = first
+		}
+	}
+
+	for seq < last {
+		seq++
+		msgs = append(msgs, replay.notifications[seq%replayNotifications])
+	}
+
+	return msgs, missed
+}
+
+// Get the console output of a board after offset, or the output of all the
+// boards if board is empty, and how many bytes of output are lost
+func (replay *replayBuffer) consoleSince(offset uint64, board string) (data []byte, missed int) {
+	if first := replay.consoleFirst(); offset < first {
+		missed = int(first - offset)
+		offset = first
+	}
+
+	data = make([]byte, 0, replay.consoleOffset-offset)
+	for i, part := range replay.consoleParts {
+		end := replay.consoleOffset
+		if i+1 < len(replay.consoleParts) {
+			end = replay.consoleParts[i+1].offset
+		}
+
+		if end <= offset || (board != "" && part.board != board) {
+			continue
+		}
+
+		start := part.offset
+		if start < offset {
+			start = offset
+		}
+
+		for ; start < end; start++ {
+			data = append(data, replay.console[start%replayConsole])
+		}
+	}
+
+	return data, missed
+}
+
+// Remove the sessions that have expired. Must be called with the hub locked.
+func (hub *Hub) expireSessions() {
+	for id, s := range hub.sessions {
+		if s.client == nil && time.Since(s.gone) > hub.agent.config.SessionTimeout {
+			delete(hub.sessions, id)
+		}
+	}
+}
+
+// Start a session for a client, or resume the session with the given id if it
+// exists and its client is gone
+func (hub *Hub) startSession(c *client, id string) (resumed bool) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.expireSessions()
+
+	if hub.sessions == nil {
+		hub.sessions = make(map[string]*session)
+	}
+
+	if c.session != nil {
+		if c.session.id == id || id == "" {
+			// Already attached
+			return false
+		}
+
+		delete(hub.sessions, c.session.id)
+	}
+
+	s, ok := hub.sessions[id]
+	if !ok || s.client != nil {
+		s = &session{id: newClientId()}
+		hub.sessions[s.id] = s
+	}
+
+	s.client = c
+	c.session = s
+
+	if ok {
+		s.consolePending = true
+	}
+
+	return ok
+}
+
+// Send to the client of a resumed session the notifications that it has missed
+func (hub *Hub) replaySession(c *client) {
+	hub.mutex.Lock()
+
+	if c.session == nil {
+		hub.mutex.Unlock()
+		return
+	}
+
+	// Notifications sent after the client has connected are already queued
+	msgs, missed := hub.replay.notificationsBetween(c.session.notificationSeq, c.seq)
+	id := c.session.id
+
+	hub.mutex.Unlock()
+
+	// Sending can wait for a slow client, so it is done with the hub unlocked
+	for _, msg := range msgs {
+		c.send(frame{data: msg})
+	}
+
+	notifyClient(c, "sessionResumed", SessionResumedInfo{Session: id, Replayed: len(msgs), Missed: missed})
+}
+
+// End the session of a client
+func (hub *Hub) endSession(c *client) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	if c.session != nil {
+		delete(hub.sessions, c.session.id)
+		c.session = nil
+	}
+}
+
+// Keep the session of a client that has gone, so it can be resumed. The
+// notifications that were queued, but not written to the client, are replayed
+// when the session is resumed. Must be called with the hub locked.
+func (hub *Hub) suspendSession(c *client) {
+	if c.session == nil || c.session.client != c {
+		return
+	}
+
+	c.session.client = nil
+	c.session.gone = time.Now()
+	c.session.notificationSeq = c.written.Load()
+
+	// The console output that was queued, but not written to the console
+	// connection, is replayed too
+	if !c.session.consolePending {
+		c.session.consoleOffset = c.upWritten.Load()
+	}
+}
+
+// Get the console output of board, or of all the boards if board is empty,
+// missed by a resumed session, to send it to the new console connection. Must
+// be called with the hub locked.
+func (hub *Hub) consoleReplay(c *client, board string) []byte {
+	if c.session == nil || !c.session.consolePending {
+		return nil
+	}
+
+	c.session.consolePending = false
+
+	data, _ := hub.replay.consoleSince(c.session.consoleOffset, board)
+
+	return data
+}
+
+func (hub *Hub) sessionId(c *client) string {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	if c.session == nil {
+		return ""
+	}
+
+	return c.session.id
+}
@@ -0,0 +1,156 @@
+/*
+ * Whitecat Blocky Environment, session tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// A client without connection. Its frames are read from c.out.
+func testClient() *client {
+	return &client{id: newClientId(), out: make(chan frame, clientQueueSize)}
+}
+
+func receivedFrames(c *client) []string {
+	var msgs []string
+
+	for {
+		select {
+		case f := <-c.out:
+			msgs = append(msgs, string(f.data))
+		default:
+			return msgs
+		}
+	}
+}
+
+func TestResumeReplaysUnwrittenNotifications(t *testing.T) {
+	hub := &Hub{agent: &Agent{config: Config{SessionTimeout: time.Minute}}}
+
+	c := testClient()
+	hub.register(c)
+	hub.startSession(c, "")
+	id := hub.sessionId(c)
+
+	for _, msg := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`} {
+		hub.broadcast([]byte(msg))
+	}
+
+	// The writer has only written the first notification when the client is gone
+	f := <-c.out
+	c.written.Store(f.seq)
+	hub.unregister(c)
+
+	resumed := testClient()
+	hub.register(resumed)
+	if !hub.startSession(resumed, id) {
+		t.Fatal("session not resumed")
+	}
+
+	hub.replaySession(resumed)
+
+	msgs := receivedFrames(resumed)
+	if len(msgs) != 3 || msgs[0] != `{"n":2}` || msgs[1] != `{"n":3}` {
+		t.Fatalf("replayed %q", msgs)
+	}
+
+	var info struct {
+		Notify string             `json:"notify"`
+		Info   SessionResumedInfo `json:"info"`
+	}
+
+	json.Unmarshal([]byte(msgs[2]), &info)
+	if info.Notify != "sessionResumed" || info.Info.Session != id || info.Info.Replayed != 2 || info.Info.Missed != 0 {
+		t.Errorf("got %s", msgs[2])
+	}
+}
+
+func TestResumeReplaysConsoleFirst(t *testing.T) {
+	hub := &Hub{agent: &Agent{config: Config{SessionTimeout: time.Minute}}}
+
+	c := testClient()
+	hub.register(c)
+	hub.startSession(c, "")
+	id := hub.sessionId(c)
+	hub.unregister(c)
+
+	hub.broadcastConsole("b", []byte("missed"))
+
+	resumed := testClient()
+	hub.register(resumed)
+	hub.startSession(resumed, id)
+
+	hub.mutex.Lock()
+	data := hub.consoleReplay(resumed, "")
+	again := hub.consoleReplay(resumed, "")
+	hub.mutex.Unlock()
+
+	if string(data) != "missed" {
+		t.Errorf("replayed console %q", data)
+	}
+
+	if again != nil {
+		t.Errorf("console replayed twice")
+	}
+}
+
+func TestResumeReplaysUnwrittenConsole(t *testing.T) {
+	hub := &Hub{agent: &Agent{config: Config{SessionTimeout: time.Minute}}}
+
+	c := testClient()
+	c.upOut = make(chan consoleOutput, consoleClientQueue)
+	hub.register(c)
+	hub.startSession(c, "")
+	id := hub.sessionId(c)
+
+	hub.broadcastConsole("a", []byte("one "))
+	hub.broadcastConsole("b", []byte("two "))
+	hub.broadcastConsole("a", []byte("three"))
+
+	// The writer has only written the first output when the client is gone
+	output := <-c.upOut
+	c.upWritten.Store(output.offset)
+	hub.unregister(c)
+
+	resumed := testClient()
+	hub.register(resumed)
+	hub.startSession(resumed, id)
+
+	// The new console connection only receives the output of its board
+	hub.mutex.Lock()
+	data := hub.consoleReplay(resumed, "a")
+	hub.mutex.Unlock()
+
+	if string(data) != "three" {
+		t.Errorf("replayed console %q", data)
+	}
+}
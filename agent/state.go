@@ -0,0 +1,160 @@
+/*
+ * Whitecat Blocky Environment, board state
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+The lifecycle of each board is modelled as a state machine. The IDE is notified on every state
+change:
+
+{"notify": "boardState", "board": "xx", "info": {"id": "xx", "state": "ready", "previous": "booting"}}
+{"notify": "boardState", "board": "xx", "info": {"id": "xx", "state": "error", "previous": "booting", "reason": "timeout"}}
+
+States:
+
+scanning                  a port that matches the requested devices has been found
+opening                   the port, or the connection to a network board, is being opened
+booting                   the board is being reset, and the agent waits for Lua RTOS
+formatting                Lua RTOS is formatting the file system, while booting
+uploading-prerequisites   the agent is uploading the IDE framework to the board
+ready                     the board is ready for commands
+running                   a program sent by the IDE is running
+upgrading                 the firmware is being flashed
+error                     the board can't be used, reason tells why
+detached                  the board has been detached, this is the last state
+
+The transitions that are not listed in boardTransitions are rejected. When the monitor starts, it
+sends a boardState notification without board, with the scanning state.
+
+*/
+
+import (
+	"log"
+)
+
+type BoardState string
+
+const (
+	BoardScanning               BoardState = "scanning"
+	BoardOpening                BoardState = "opening"
+	BoardBooting                BoardState = "booting"
+	BoardFormatting             BoardState = "formatting"
+	BoardUploadingPrerequisites BoardState = "uploading-prerequisites"
+	BoardReady                  BoardState = "ready"
+	BoardRunning                BoardState = "running"
+	BoardUpgrading              BoardState = "upgrading"
+	BoardError                  BoardState = "error"
+	BoardDetached               BoardState = "detached"
+)
+
+// Valid transitions, from each state
+var boardTransitions = map[BoardState][]BoardState{
+	BoardScanning:               {BoardOpening, BoardDetached},
+	BoardOpening:                {BoardBooting, BoardError, BoardDetached},
+	BoardBooting:                {BoardFormatting, BoardUploadingPrerequisites, BoardReady, BoardError, BoardDetached},
+	BoardFormatting:             {BoardUploadingPrerequisites, BoardReady, BoardError, BoardDetached},
+	BoardUploadingPrerequisites: {BoardReady, BoardError, BoardDetached},
+	BoardReady:                  {BoardBooting, BoardRunning, BoardUpgrading, BoardError, BoardDetached},
+	BoardRunning:                {BoardBooting, BoardReady, BoardUpgrading, BoardError, BoardDetached},
+	BoardUpgrading:              {BoardError, BoardDetached},
+	BoardError:                  {BoardBooting, BoardUpgrading, BoardDetached},
+	BoardDetached:               {},
+}
+
+type BoardStateInfo struct {
+	Id       string     `json:"id"`
+	State    BoardState `json:"state"`
+	Previous BoardState `json:"previous,omitempty"`
+	Reason   string     `json:"reason,omitempty"`
+}
+
+// Get the state of a board. A new board is in the scanning state.
+func (board *Board) getState() BoardState {
+	board.stateMutex.Lock()
+	defer board.stateMutex.Unlock()
+
+	if board.state == "" {
+		return BoardScanning
+	}
+
+	return board.state
+}
+
+// Change the state of a board, and notify the change. reason tells why the
+// board is in the new state, if it is not obvious. Returns false if the
+// transition is not valid, and the state is not changed.
+func (board *Board) setState(state BoardState, reason string) bool {
+	board.stateMutex.Lock()
+
+	previous := board.state
+	if previous == "" {
+		previous = BoardScanning
+	}
+
+	if previous == state {
+		board.stateMutex.Unlock()
+		return true
+	}
+
+	valid := false
+	for _, next := range boardTransitions[previous] {
+		if next == state {
+			valid = true
+			break
+		}
+	}
+
+	if !valid {
+		board.stateMutex.Unlock()
+		log.Println("invalid board state transition, from ", previous, " to ", state)
+		return false
+	}
+
+	board.state = state
+	board.stateMutex.Unlock()
+
+	log.Println("board ", board.id, " is ", state)
+	board.notify("boardState", BoardStateInfo{Id: board.id, State: state, Previous: previous, Reason: reason})
+
+	return true
+}
+
+// Test if the board is being upgraded
+func (board *Board) upgrading() bool {
+	return board.getState() == BoardUpgrading
+}
+
+// Test if the board of a command is being upgraded. Commands without board are
+// executed by the default board.
+func (agent *Agent) boardUpgrading(id string) bool {
+	board := agent.findBoard(id)
+
+	return board != nil && board.upgrading()
+}
@@ -0,0 +1,128 @@
+/*
+ * Whitecat Blocky Environment, board state tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"testing"
+)
+
+func TestBoardStateTransitions(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir()})
+
+	states := make(eventRecorder, 16)
+	defer agent.Subscribe(states, "boardState")()
+
+	board := &Board{agent: agent, id: "test"}
+
+	if state := board.getState(); state != BoardScanning {
+		t.Fatalf("new board is %s, want %s", state, BoardScanning)
+	}
+
+	for _, test := range []struct {
+		state BoardState
+		valid bool
+	}{
+		{BoardReady, false},
+		{BoardOpening, true},
+		{BoardOpening, true},
+		{BoardBooting, true},
+		{BoardReady, true},
+		{BoardFormatting, false},
+		{BoardUpgrading, true},
+		{BoardReady, false},
+		{BoardError, true},
+		{BoardDetached, true},
+		{BoardBooting, false},
+	} {
+		previous := board.getState()
+
+		if valid := board.setState(test.state, ""); valid != test.valid {
+			t.Errorf("%s to %s valid %v, want %v", previous, test.state, valid, test.valid)
+		}
+
+		if want := map[bool]BoardState{true: test.state, false: previous}[test.valid]; board.getState() != want {
+			t.Errorf("%s to %s left the board %s, want %s", previous, test.state, board.getState(), want)
+		}
+	}
+
+	// Only the changes of state are notified, with the previous state
+	var notified []BoardStateInfo
+	for len(states) > 0 {
+		event := <-states
+		notified = append(notified, event.Info.(BoardStateInfo))
+	}
+
+	want := []BoardStateInfo{
+		{Id: "test", State: BoardOpening, Previous: BoardScanning},
+		{Id: "test", State: BoardBooting, Previous: BoardOpening},
+		{Id: "test", State: BoardReady, Previous: BoardBooting},
+		{Id: "test", State: BoardUpgrading, Previous: BoardReady},
+		{Id: "test", State: BoardError, Previous: BoardUpgrading},
+		{Id: "test", State: BoardDetached, Previous: BoardError},
+	}
+
+	if len(notified) != len(want) {
+		t.Fatalf("notified %v, want %v", notified, want)
+	}
+
+	for i := range want {
+		if notified[i] != want[i] {
+			t.Errorf("notified %v, want %v", notified[i], want[i])
+		}
+	}
+}
+
+func TestBoardStateReason(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir()})
+
+	states := make(eventRecorder, 16)
+	defer agent.Subscribe(states, "boardState")()
+
+	board := &Board{agent: agent, id: "test"}
+	board.setState(BoardOpening, "")
+	board.setState(BoardError, "can't open the port")
+
+	<-states
+	if info := (<-states).Info.(BoardStateInfo); info.State != BoardError || info.Reason != "can't open the port" {
+		t.Errorf("notified %s with reason %q", info.State, info.Reason)
+	}
+
+	// A board that is being upgraded is busy
+	if agent.boardUpgrading("test") {
+		t.Error("board not attached is upgrading")
+	}
+
+	agent.addBoard(board)
+	board.setState(BoardUpgrading, "")
+
+	if !agent.boardUpgrading("") || !agent.boardUpgrading("test") {
+		t.Error("board is not upgrading")
+	}
+}
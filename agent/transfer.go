@@ -0,0 +1,193 @@
+/*
+ * Whitecat Blocky Environment, binary transfers over the control websocket
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+File contents can be transferred as raw binary websocket frames, instead of base64 inside the
+JSON command. The command announces the transfer, and the data follows in binary frames:
+
+{"command": "boardWriteFile", "id": "xx", "arguments": {"path": "xxxx", "transfer": "binary", "size": 1024}}
+<binary frames, 1024 bytes in total>
+
+When reading a file, the reply announces the transfer, and the data follows in binary frames of
+frameSize bytes at most:
+
+{"command": "boardReadFile", "id": "xx", "arguments": {"path": "xxxx", "transfer": "binary"}}
+{"notify": "boardReadFile", "id": "xx", "status": "ok", "info": {"transfer": "binary", "size": 1024}}
+<binary frames, 1024 bytes in total>
+
+A custom firmware zip can be uploaded to the agent in the same way, and then flashed using
+boardInstall / boardUpgrade with the custom argument:
+
+{"command": "agentUploadFirmware", "id": "xx", "arguments": {"size": 1048576}}
+<binary frames, 1048576 bytes in total>
+{"command": "boardUpgrade", "id": "xx", "arguments": {"custom": true}}
+
+The upload is rejected with board-busy while a board is being upgraded, and an upgrade with the
+custom argument fails with invalid-firmware if no custom firmware has been uploaded.
+
+*/
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"golang.org/x/net/websocket"
+)
+
+// Max size of the data sent in each binary frame
+const FrameSize = 16 * 1024
+
+// Max size of a custom firmware zip
+const MaxFirmwareSize = 64 * 1024 * 1024
+
+const (
+	Base64Transfer = "base64"
+	BinaryTransfer = "binary"
+)
+
+var errTransfer = errors.New("binary transfer interrupted")
+
+// A custom firmware can't be uploaded while a board is being upgraded
+var errUpgradeInProgress = errors.New("upgrade in progress")
+
+// A custom firmware upgrade is requested, but no custom firmware has been uploaded
+var errNoCustomFirmware = errors.New("no custom firmware")
+
+// A websocket frame, and its type
+type frame struct {
+	binary bool
+	data   []byte
+
+	// Sequence number of a broadcast notification, 0 for the other frames
+	seq uint64
+}
+
+// Codec for receive text and binary frames, keeping the frame type
+var frameCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		return v.([]byte), websocket.BinaryFrame, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		f := v.(*frame)
+		f.binary = payloadType == websocket.BinaryFrame
+		f.data = data
+		return nil
+	},
+}
+
+// Receive size bytes in binary frames. A text frame received before all the
+// bytes are received interrupts the transfer.
+func receiveBinary(ws *websocket.Conn, size int) ([]byte, error) {
+	data := make([]byte, 0, size)
+
+	for len(data) < size {
+		var f frame
+
+		if err := frameCodec.Receive(ws, &f); err != nil {
+			return nil, err
+		}
+
+		if !f.binary || len(data)+len(f.data) > size {
+			return nil, errTransfer
+		}
+
+		data = append(data, f.data...)
+	}
+
+	return data, nil
+}
+
+// Send data to a client in binary frames of FrameSize bytes at most
+func sendBinary(c *client, data []byte) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > FrameSize {
+			n = FrameSize
+		}
+
+		c.send(frame{binary: true, data: data[:n]})
+
+		data = data[n:]
+	}
+}
+
+// Folder where the custom firmware is unpacked
+func (agent *Agent) customFirmwareFolder() string {
+	return path.Join(agent.tmpFolder(), "custom_firmware")
+}
+
+// Store a custom firmware zip received from the IDE, and unpack it in its own
+// folder, apart from the downloaded firmware. The firmware is rejected while a
+// board is being upgraded, as it may be flashing the previous one.
+func (agent *Agent) storeCustomFirmware(firmware []byte) error {
+	agent.customFirmwareMutex.Lock()
+	defer agent.customFirmwareMutex.Unlock()
+
+	for _, board := range agent.attachedBoards() {
+		if board.upgrading() {
+			return errUpgradeInProgress
+		}
+	}
+
+	zipFile := path.Join(agent.tmpFolder(), "custom_firmware.zip")
+	firmwareFolder := agent.customFirmwareFolder()
+
+	agent.customFirmware = false
+	os.RemoveAll(firmwareFolder)
+
+	if err := ioutil.WriteFile(zipFile, firmware, 0644); err != nil {
+		return err
+	}
+
+	if err := unzip(zipFile, firmwareFolder); err != nil {
+		return errInvalidFirmware
+	}
+
+	if _, err := os.Stat(path.Join(firmwareFolder, "flash_args")); err != nil {
+		return errInvalidFirmware
+	}
+
+	agent.customFirmware = true
+
+	return nil
+}
+
+// Test if a custom firmware has been uploaded. If it is being uploaded, waits
+// until it is stored.
+func (agent *Agent) hasCustomFirmware() bool {
+	agent.customFirmwareMutex.Lock()
+	defer agent.customFirmwareMutex.Unlock()
+
+	return agent.customFirmware
+}
@@ -0,0 +1,109 @@
+/*
+ * Whitecat Blocky Environment, custom firmware tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Upload a custom firmware zip with the given entries
+func uploadCustomFirmware(t *testing.T, agent *Agent, entries []zipEntry) error {
+	firmware, err := ioutil.ReadFile(writeZip(t, entries))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return agent.storeCustomFirmware(firmware)
+}
+
+func TestStoreCustomFirmware(t *testing.T) {
+	board := testBoard(t, &serialTransport{})
+	agent := board.agent
+
+	if err := os.MkdirAll(filepath.Join(agent.tmpFolder(), "firmware_files"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// An upgrade with the custom firmware fails before it is uploaded, and the
+	// board is not disturbed
+	if err := board.upgrade(false, "", true); err != errNoCustomFirmware {
+		t.Fatalf("upgrade %v, expected %v", err, errNoCustomFirmware)
+	}
+
+	if state := board.getState(); state != BoardReady {
+		t.Fatalf("board %s, expected %s", state, BoardReady)
+	}
+
+	err := uploadCustomFirmware(t, agent, []zipEntry{{name: "firmware.bin", mode: 0644, body: "firmware"}})
+	if err != errInvalidFirmware || agent.hasCustomFirmware() {
+		t.Fatalf("firmware without flash_args stored: %v", err)
+	}
+
+	err = uploadCustomFirmware(t, agent, []zipEntry{
+		{name: "flash_args", mode: 0644, body: "--flash_mode dio 0x10000 firmware.bin"},
+		{name: "firmware.bin", mode: 0644, body: "firmware"},
+	})
+	if err != nil || !agent.hasCustomFirmware() {
+		t.Fatalf("firmware not stored: %v", err)
+	}
+
+	// The custom firmware has its own folder, the downloaded firmware is kept
+	if _, err := os.Stat(filepath.Join(agent.customFirmwareFolder(), "flash_args")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(agent.tmpFolder(), "firmware_files")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreCustomFirmwareUpgrading(t *testing.T) {
+	board := testBoard(t, nil)
+	agent := board.agent
+	agent.addBoard(board)
+
+	if err := os.MkdirAll(agent.tmpFolder(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	board.setState(BoardUpgrading, "")
+
+	err := uploadCustomFirmware(t, agent, []zipEntry{{name: "flash_args", mode: 0644, body: "firmware.bin"}})
+	if err != errUpgradeInProgress {
+		t.Fatalf("upload %v, expected %v", err, errUpgradeInProgress)
+	}
+
+	if code := upgradeErrorCode(err); code != ErrBoardBusy {
+		t.Fatalf("error code %s, expected %s", code, ErrBoardBusy)
+	}
+}
@@ -0,0 +1,471 @@
+/*
+ * Whitecat Blocky Environment, board transports
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no events shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+A board is connected to the agent through a transport. USB boards use the serial transport, and
+boards on the network, that expose the Lua RTOS telnet shell, use the TCP transport. The IDE
+attaches a network board by sending its address in the devices of attachIde:
+
+{"command": "attachIde", "arguments": {"protocolVersion": 2, "devices": [{"address": "192.168.1.20:23"}]}}
+
+The address is host:port or telnet://host:port, for the telnet shell, or tcp://host:port, for a
+raw TCP connection to the board's console, such as a serial to TCP bridge. On telnet connections
+the agent asks for the binary option in both directions, so files can be transferred. If the board
+refuses it, the agent follows the telnet rules for CR: a CR not followed by LF is sent as CR NUL,
+and CR NUL is received as CR.
+
+The agent can't reboot a network board, as the connection would be lost. Resetting it interrupts
+the running program, and the agent waits for the prompt. Network boards can't be upgraded, the
+firmware is flashed through a serial port.
+
+On Linux, if the EmulatorDevices setting is enabled, the address can also be a pseudo-terminal,
+such as the one of the Lua RTOS emulator (see emulator/emulator.go), that is reset by closing and
+opening it again:
+
+{"command": "attachIde", "arguments": {"protocolVersion": 2, "devices": [{"address": "/dev/pts/3"}]}}
+
+Other addresses are rejected, the serial ports are only opened when the monitor finds them.
+
+*/
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mikepb/go-serial"
+)
+
+// The connection to a board
+type Transport interface {
+	// Read and write the board's console
+	Read(b []byte) (int, error)
+	Write(b []byte) (int, error)
+
+	// Reset the board. Returns false if the board can't be rebooted, and only
+	// the running program is interrupted.
+	Reset() (rebooted bool, err error)
+
+	// Test if the board is still connected
+	Connected() bool
+
+	Close() error
+}
+
+// Transports that can change their bit rate
+type bitRateSetter interface {
+	SetBitRate(bitRate int) error
+}
+
+// Timeout of the connection to a network board
+const dialTimeout = 5 * time.Second
+
+var errNoSerial = errors.New("the board is not connected to a serial port")
+
+var errUnknownDevice = errors.New("the device is not a network address, or an allowed pseudo-terminal")
+
+// Test if a device is the address of a network board, and not a serial port
+func networkDevice(dev string) bool {
+	if strings.HasPrefix(dev, "telnet://") || strings.HasPrefix(dev, "tcp://") {
+		return true
+	}
+
+	_, _, err := net.SplitHostPort(dev)
+
+	return err == nil
+}
+
+// Test if a device is a pseudo-terminal
+func ttyDevice(dev string) bool {
+	return strings.HasPrefix(dev, "/dev/pts/")
+}
+
+// Open the transport of a device sent by the IDE, the address of a network
+// board, or a pseudo-terminal if the EmulatorDevices setting is enabled
+func (agent *Agent) openTransport(dev string) (Transport, error) {
+	if networkDevice(dev) {
+		return dialTransport(dev)
+	}
+
+	if ttyDevice(dev) && agent.config.EmulatorDevices {
+		return openTTY(dev)
+	}
+
+	return nil, errUnknownDevice
+}
+
+/*
+ * Serial transport
+ */
+
+type serialTransport struct {
+	port *serial.Port
+}
+
+func serialOptions(bitRate int) serial.Options {
+	options := serial.RawOptions
+	options.BitRate = bitRate
+	options.Mode = serial.MODE_READ_WRITE
+	options.RTS = serial.RTS_OFF
+
+	return options
+}
+
+func openSerial(name string) (*serialTransport, error) {
+	// Configure options or serial port connection
+	options := serialOptions(115200)
+	options.DTR = serial.DTR_OFF
+
+	port, err := options.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &serialTransport{port: port}, nil
+}
+
+func (t *serialTransport) Read(b []byte) (int, error) {
+	return t.port.Read(b)
+}
+
+func (t *serialTransport) Write(b []byte) (int, error) {
+	return t.port.Write(b)
+}
+
+// Reset the board with the RTS line. The board boots at 115200 bauds.
+func (t *serialTransport) Reset() (bool, error) {
+	options := serialOptions(115200)
+	t.port.Apply(&options)
+
+	time.Sleep(time.Millisecond * 10)
+
+	options.RTS = serial.RTS_ON
+	t.port.Apply(&options)
+
+	time.Sleep(time.Millisecond * 10)
+
+	options.RTS = serial.RTS_OFF
+	t.port.Apply(&options)
+
+	return true, nil
+}
+
+func (t *serialTransport) SetBitRate(bitRate int) error {
+	options := serialOptions(bitRate)
+
+	return t.port.Apply(&options)
+}
+
+func (t *serialTransport) Connected() bool {
+	_, err := t.port.InputWaiting()
+
+	return err == nil
+}
+
+func (t *serialTransport) Close() error {
+	return t.port.Close()
+}
+
+/*
+ * TCP and telnet transport
+ */
+
+// Telnet commands and options
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetBinary          = 0
+	telnetEcho            = 1
+	telnetSuppressGoAhead = 3
+)
+
+type tcpTransport struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// Is it a telnet connection, or a raw one?
+	telnet bool
+
+	// Is the binary option enabled in each direction? Without it CR is sent as
+	// CR NUL, and CR NUL is received as CR. wantBinaryIn and wantBinaryOut are
+	// the options requested by the agent that the board has not answered yet.
+	binaryIn      bool
+	binaryOut     atomic.Bool
+	wantBinaryIn  bool
+	wantBinaryOut bool
+
+	// Last byte read was CR
+	cr bool
+
+	writeMutex sync.Mutex
+
+	// Error that closed the connection
+	err      error
+	errMutex sync.Mutex
+}
+
+func dialTransport(address string) (*tcpTransport, error) {
+	telnet := true
+
+	if strings.HasPrefix(address, "tcp://") {
+		address = strings.TrimPrefix(address, "tcp://")
+		telnet = false
+	} else {
+		address = strings.TrimPrefix(address, "telnet://")
+	}
+
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tcpTransport{conn: conn, reader: bufio.NewReader(conn), telnet: telnet}
+
+	// Ask for the binary option in both directions, so any byte can be
+	// transferred
+	if telnet {
+		t.wantBinaryIn = true
+		t.wantBinaryOut = true
+
+		if _, err := t.send([]byte{telnetIAC, telnetDO, telnetBinary, telnetIAC, telnetWILL, telnetBinary}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+func (t *tcpTransport) failed(err error) {
+	t.errMutex.Lock()
+	defer t.errMutex.Unlock()
+
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+// Read the console, without the telnet commands
+func (t *tcpTransport) Read(b []byte) (int, error) {
+	n := 0
+
+	for n < len(b) && (n == 0 || t.reader.Buffered() > 0) {
+		c, err := t.reader.ReadByte()
+		if err != nil {
+			t.failed(err)
+
+			if n > 0 {
+				return n, nil
+			}
+
+			return 0, err
+		}
+
+		if t.telnet && c == telnetIAC {
+			if c, err = t.command(); err != nil {
+				t.failed(err)
+				return n, err
+			}
+
+			// Only an escaped IAC is data
+			if c != telnetIAC {
+				continue
+			}
+		}
+
+		// CR NUL is a CR
+		if t.telnet && !t.binaryIn && t.cr && c == 0 {
+			t.cr = false
+			continue
+		}
+
+		t.cr = c == '\r'
+
+		b[n] = c
+		n++
+	}
+
+	return n, nil
+}
+
+// Process a telnet command. The agent only accepts the echo and the suppress
+// go ahead options of the board, that are used by the Lua RTOS shell, and the
+// binary option in both directions.
+func (t *tcpTransport) command() (byte, error) {
+	command, err := t.reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	switch command {
+	case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+		option, err := t.reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		switch {
+		case option == telnetBinary:
+			t.binaryOption(command)
+		case command == telnetWILL && (option == telnetEcho || option == telnetSuppressGoAhead):
+			t.send([]byte{telnetIAC, telnetDO, option})
+		case command == telnetWILL:
+			t.send([]byte{telnetIAC, telnetDONT, option})
+		case command == telnetDO:
+			t.send([]byte{telnetIAC, telnetWONT, option})
+		}
+
+	case telnetSB:
+		// Skip the subnegotiation, until IAC SE
+		for previous := byte(0); ; {
+			c, err := t.reader.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+
+			if previous == telnetIAC && c == telnetSE {
+				break
+			}
+
+			previous = c
+		}
+	}
+
+	return command, nil
+}
+
+// Process the answer, or the request, of the board for the binary option. Only
+// the requests are answered, so the negotiation doesn't loop.
+func (t *tcpTransport) binaryOption(command byte) {
+	switch command {
+	case telnetWILL:
+		if !t.wantBinaryIn && !t.binaryIn {
+			t.send([]byte{telnetIAC, telnetDO, telnetBinary})
+		}
+
+		t.binaryIn = true
+		t.wantBinaryIn = false
+
+	case telnetWONT:
+		if !t.wantBinaryIn && t.binaryIn {
+			t.send([]byte{telnetIAC, telnetDONT, telnetBinary})
+		}
+
+		t.binaryIn = false
+		t.wantBinaryIn = false
+
+	case telnetDO:
+		if !t.wantBinaryOut && !t.binaryOut.Load() {
+			t.send([]byte{telnetIAC, telnetWILL, telnetBinary})
+		}
+
+		t.binaryOut.Store(true)
+		t.wantBinaryOut = false
+
+	case telnetDONT:
+		if !t.wantBinaryOut && t.binaryOut.Load() {
+			t.send([]byte{telnetIAC, telnetWONT, telnetBinary})
+		}
+
+		t.binaryOut.Store(false)
+		t.wantBinaryOut = false
+	}
+}
+
+func (t *tcpTransport) send(b []byte) (int, error) {
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+
+	n, err := t.conn.Write(b)
+	if err != nil {
+		t.failed(err)
+	}
+
+	return n, err
+}
+
+// Write to the console. IAC bytes are escaped on telnet connections, and
+// without the binary option a CR that is not followed by LF is sent as CR NUL.
+func (t *tcpTransport) Write(b []byte) (int, error) {
+	if !t.telnet {
+		return t.send(b)
+	}
+
+	binary := t.binaryOut.Load()
+
+	escaped := make([]byte, 0, len(b))
+	for i, c := range b {
+		if c == telnetIAC {
+			escaped = append(escaped, telnetIAC)
+		}
+
+		escaped = append(escaped, c)
+
+		if c == '\r' && !binary && (i+1 == len(b) || b[i+1] != '\n') {
+			escaped = append(escaped, 0)
+		}
+	}
+
+	if _, err := t.send(escaped); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Interrupt the running program with Ctrl-C, and ask for a prompt
+func (t *tcpTransport) Reset() (bool, error) {
+	_, err := t.Write([]byte{3, '\r', '\n'})
+
+	return false, err
+}
+
+func (t *tcpTransport) Connected() bool {
+	t.errMutex.Lock()
+	defer t.errMutex.Unlock()
+
+	return t.err == nil
+}
+
+func (t *tcpTransport) Close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,149 @@
+/*
+ * Whitecat Blocky Environment, transport tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestOpenTransportRejectsUnknownDevices(t *testing.T) {
+	agent := New(Config{DataFolder: t.TempDir()})
+
+	// Serial ports are only opened when the monitor finds them, and the
+	// pseudo-terminals when the EmulatorDevices setting is enabled
+	for _, dev := range []string{"/dev/ttyUSB0", "/dev/pts/3", "/etc/passwd", "COM3"} {
+		if _, err := agent.openTransport(dev); err != errUnknownDevice {
+			t.Errorf("%s: got %v, expected %v", dev, err, errUnknownDevice)
+		}
+	}
+}
+
+// Dial a telnet transport to a server that answers the binary option requests
+// with answer, and then sends data. Returns the transport, and the server side
+// of the connection.
+func telnetTransport(t *testing.T, answer []byte, data []byte) (*tcpTransport, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+
+		accepted <- conn
+	}()
+
+	transport, err := dialTransport("telnet://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { transport.Close() })
+
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("connection not accepted")
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	request := make([]byte, 6)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(request, []byte{telnetIAC, telnetDO, telnetBinary, telnetIAC, telnetWILL, telnetBinary}) {
+		t.Fatalf("binary option request %v", request)
+	}
+
+	conn.Write(append(answer, data...))
+
+	return transport, conn
+}
+
+// Read n bytes of the console
+func readConsole(t *testing.T, transport *tcpTransport, n int) []byte {
+	data := make([]byte, 0, n)
+	b := make([]byte, n)
+
+	for len(data) < n {
+		read, err := transport.Read(b[:n-len(data)])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data = append(data, b[:read]...)
+	}
+
+	return data
+}
+
+func TestTelnetBinary(t *testing.T) {
+	answer := []byte{telnetIAC, telnetWILL, telnetBinary, telnetIAC, telnetDO, telnetBinary}
+	transport, conn := telnetTransport(t, answer, []byte("a\r\x00b\xff\xff"))
+
+	if data := readConsole(t, transport, 4); string(data) != "a\r\x00b" {
+		t.Fatalf("read %q", data)
+	}
+
+	if data := readConsole(t, transport, 1); string(data) != "\xff" {
+		t.Fatalf("read %q", data)
+	}
+
+	transport.Write([]byte("x\ry\xff"))
+
+	written := make([]byte, 5)
+	if _, err := io.ReadFull(conn, written); err != nil || string(written) != "x\ry\xff\xff" {
+		t.Fatalf("written %q, %v", written, err)
+	}
+}
+
+func TestTelnetNotBinary(t *testing.T) {
+	answer := []byte{telnetIAC, telnetWONT, telnetBinary, telnetIAC, telnetDONT, telnetBinary}
+	transport, conn := telnetTransport(t, answer, []byte("a\r\x00b\r\n"))
+
+	if data := readConsole(t, transport, 5); string(data) != "a\rb\r\n" {
+		t.Fatalf("read %q", data)
+	}
+
+	transport.Write([]byte("x\ry\r\n"))
+
+	written := make([]byte, 6)
+	if _, err := io.ReadFull(conn, written); err != nil || string(written) != "x\r\x00y\r\n" {
+		t.Fatalf("written %q, %v", written, err)
+	}
+}
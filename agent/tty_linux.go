@@ -0,0 +1,177 @@
+//go:build linux
+// +build linux
+
+/*
+ * Whitecat Blocky Environment, pseudo-terminal transport
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Time the pseudo-terminal is kept closed when the board is reset, so the
+// other end can see the hang up
+const ttyResetTime = 100 * time.Millisecond
+
+// Transport for the boards connected to a pseudo-terminal, such as the Lua
+// RTOS emulator. The board is reset by closing and opening the terminal again.
+type ttyTransport struct {
+	name string
+
+	mutex  sync.Mutex
+	file   *os.File
+	closed bool
+
+	// Error that closed the terminal
+	err error
+}
+
+func openTTY(name string) (Transport, error) {
+	t := &ttyTransport{name: name}
+
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func ioctl(fd int, request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// Open the terminal in raw mode. The terminal is opened in non-blocking mode,
+// so a read in progress is interrupted when it is closed.
+func (t *ttyTransport) open() error {
+	fd, err := syscall.Open(t.name, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: t.name, Err: err}
+	}
+
+	var termios syscall.Termios
+	if err = ioctl(fd, syscall.TCGETS, unsafe.Pointer(&termios)); err == nil {
+		termios.Iflag = 0
+		termios.Oflag = 0
+		termios.Lflag = 0
+		termios.Cflag = termios.Cflag&^(syscall.CSIZE|syscall.PARENB) | syscall.CS8 | syscall.CREAD | syscall.CLOCAL
+		termios.Cc[syscall.VMIN] = 1
+		termios.Cc[syscall.VTIME] = 0
+
+		err = ioctl(fd, syscall.TCSETS, unsafe.Pointer(&termios))
+	}
+
+	if err != nil {
+		syscall.Close(fd)
+		return &os.PathError{Op: "open", Path: t.name, Err: err}
+	}
+
+	t.file = os.NewFile(uintptr(fd), t.name)
+
+	return nil
+}
+
+func (t *ttyTransport) current() *os.File {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.file
+}
+
+// Read the terminal. A read interrupted by a reset continues in the terminal
+// opened again.
+func (t *ttyTransport) Read(b []byte) (int, error) {
+	for {
+		file := t.current()
+
+		n, err := file.Read(b)
+		if err == nil {
+			return n, nil
+		}
+
+		t.mutex.Lock()
+		reopened := t.file != file && !t.closed
+		if !reopened && t.err == nil {
+			t.err = err
+		}
+		t.mutex.Unlock()
+
+		if !reopened {
+			return n, err
+		}
+	}
+}
+
+func (t *ttyTransport) Write(b []byte) (int, error) {
+	return t.current().Write(b)
+}
+
+// Reset the board, closing the terminal and opening it again
+func (t *ttyTransport) Reset() (bool, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return false, os.ErrClosed
+	}
+
+	t.file.Close()
+	time.Sleep(ttyResetTime)
+
+	if err := t.open(); err != nil {
+		t.err = err
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (t *ttyTransport) Connected() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.err == nil
+}
+
+func (t *ttyTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.closed = true
+
+	return t.file.Close()
+}
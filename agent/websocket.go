@@ -0,0 +1,703 @@
+/*
+ * Whitecat Blocky Environment, Whitecat Agent Websocket Server
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+/*
+
+This is the implementation for the Whitecat Agent websocket server. This server has two main
+functions:
+
+* Listen commands sended by the IDE, process this commands, and send back a response to the IDE
+* Notify IDE about important things that it must be know
+
+Notifications:
+
+{"notify": "boardAttached", "board": "xx", "info": {"id": "xx", "info": {"modules":[], "maps": []}, "newBuild": false}}
+{"notify": "boardDetached", "board": "xx", "info": {"id": "xx"}}
+{"notify": "boardPowerOnReset", "info": {}}
+{"notify": "boardSoftwareReset", "info": {}}
+{"notify": "boardDeepSleepReset", "info": {}}
+{"notify": "boardRuntimeError", "info": {"where": "xx", "line": "xx", "exception": "xx", "message": "xx"}}
+{"notify": "boardConsoleOut", "info": {"content": "xxx"}}
+{"notify": "boardUptate", "info": {}}
+{"notify": "boardState", "board": "xx", "info": {"id": "xx", "state": "ready", "previous": "booting"}}
+{"notify": "boardUpgraded", "info": {}}
+{"notify": "boardInfo", "info": {"build": "xx", "commit": "xx", "board": "xx", "subtype": "xx", "brand": "xx", "ota": false, "status": {"shell": false, "history": false}}}
+{"notify": "boardTimeout", "info": {}}
+{"notify": "invalidFirmware", "info": {}}
+
+Available commands:
+
+{"command": "attachIde", "arguments": {"protocolVersion": 2, "devices": []}}
+{"command": "detachIde", "arguments": "{}"}
+
+{"command": "boardUpgrade", "arguments": "{}"}
+{"command": "boardInfo", "arguments": "{}"}
+{"command": "boardReset, "arguments": "{}"}
+{"command": "boardStop, "arguments": "{}"}
+{"command": "boardGetDirContent", "arguments": {"path": "xxxx"}}
+{"command": "boardReadFile", "arguments": {"path": "xxxx"}}
+{"command": "boardRunProgram", "arguments": {"path": "xxxx", "code": "xxxx"}}
+{"command": "boardRunCommand", "arguments": {"code": "xxxx"}}
+{"command": "boardInstall", "arguments": {"firmware": "xxxx"}}
+
+Each command can carry an optional id, that is echoed back in the command's reply, with the
+status of the command, and with an error code if the command has failed:
+
+{"command": "boardReadFile", "id": "xx", "arguments": {"path": "xxxx"}}
+{"notify": "boardReadFile", "id": "xx", "status": "ok", "info": {"content": "xxx"}}
+{"notify": "boardReadFile", "id": "xx", "status": "error", "error": "timeout", "info": {"content": ""}}
+
+Error codes: timeout, board-busy, decode-error, no-board, invalid-firmware, download-error, not-allowed,
+invalid-command, file-too-large, transfer-error, no-lease, cancelled, not-found, incompatible-protocol
+
+File contents can also be sent in binary frames, see transfer.go.
+
+Boards on the network are attached by sending their address in the attachIde devices, see
+transport.go.
+
+The same endpoints are served over wss on SecureAddress, when it is set, with the certificates
+generated in certificates.go. This is needed by the IDEs that are loaded over https, as browsers
+block plain ws connections from secure pages. The IDE can also be paired over wss, so the plain
+listener can be disabled by setting an empty Address.
+
+Only paired IDEs, from allowed origins, can connect to /control, /up and /down, see pairing.go.
+
+Dead connections are detected with a heartbeat, see heartbeat.go.
+
+Several boards can be attached at once, and commands and consoles select their board, see boards.go.
+
+The lifecycle of each board is notified in boardState notifications, see state.go.
+
+IDEs can resume their session after a reload without resetting the board, see session.go.
+
+Board commands are queued, and can be cancelled, see commands.go.
+
+Console output is sent to /up in batches, see console.go.
+
+The board commands are also available as a REST API, see api.go.
+
+Notifications and console output are also sent as Server-Sent Events on /events, see events.go.
+
+The agent also serves a gRPC service, defined in agent.proto, see grpc.go.
+
+The agent can be embedded in other programs, see agent.go.
+
+Scripts can control a running agent with wccagent ctl, through a local socket, see ctl.go.
+
+Notifications are published on an event bus, that can have other sinks than the IDE, see bus.go.
+
+On attachIde the IDE sends the protocol version that it implements. The agent replies with its
+protocol version and its capabilities:
+
+{"notify": "attachIde", "status": "ok", "info": {"agent-version": "xx", "protocolVersion": 2,
+ "capabilities": {"commands": [], "notifications": [], "transports": ["websocket"],
+ "boardTransports": ["serial", "telnet", "tcp"], "maxFileSize": 0,
+ "chunkSize": 0, "binaryFrames": false, "multipleBoards": true, "flashing": true}}}
+
+If the IDE's protocol version is not supported the agent sends, before the error reply:
+
+{"notify": "incompatibleProtocol", "info": {"agent-version": "xx", "protocolVersion": 2, "minProtocolVersion": 1, "ideVersion": 3}}
+
+Commands that are not valid JSON, are unknown, or have invalid arguments are rejected:
+
+{"notify": "commandRejected", "id": "xx", "status": "error", "error": "invalid-command", "info": {"command": "xx", "reason": "xx"}}
+
+The JSON Schema for all the messages is in protocol.schema.json, and is served at /protocol.schema.json.
+
+*/
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"golang.org/x/net/websocket"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+type deviceDef struct {
+	VendorId  string
+	ProductId string
+	Vendor    string
+	MaxBauds  string
+
+	// Address of a network board, see transport.go
+	Address string
+}
+
+// Error codes sent to the IDE in the reply of a failed command
+const (
+	ErrTimeout         = "timeout"
+	ErrBoardBusy       = "board-busy"
+	ErrDecode          = "decode-error"
+	ErrNoBoard         = "no-board"
+	ErrInvalidFirmware = "invalid-firmware"
+	ErrDownload        = "download-error"
+	ErrNotAllowed      = "not-allowed"
+	ErrInvalidCommand  = "invalid-command"
+	ErrFileTooLarge    = "file-too-large"
+	ErrTransfer        = "transfer-error"
+	ErrNoLease         = "no-lease"
+	ErrCancelled       = "cancelled"
+	ErrNotFound        = "not-found"
+
+	ErrIncompatibleProtocol = "incompatible-protocol"
+)
+
+func marshalNotification(notification Notification) []byte {
+	if notification.Info == nil {
+		notification.Info = struct{}{}
+	}
+
+	msg, err := json.Marshal(notification)
+	if err != nil {
+		log.Println("can't marshal notification: ", err)
+		return nil
+	}
+
+	return msg
+}
+
+// Publish a notification on the event bus, that sends it to all the clients
+func (agent *Agent) notify(notification string, info interface{}) {
+	agent.bus.publish("", notification, info)
+}
+
+// Send a notification from a board to all the clients
+func (board *Board) notify(notification string, info interface{}) {
+	board.agent.bus.publish(board.id, notification, info)
+}
+
+// Send a notification to one client
+func notifyClient(c *client, notification string, info interface{}) {
+	msg := marshalNotification(Notification{Notify: notification, Info: info})
+	if msg == nil {
+		return
+	}
+
+	c.send(frame{data: msg})
+	log.Println("notify to ", c.id, ": ", string(msg))
+}
+
+// Send a notification from a board to one client
+func (board *Board) notifyClient(c *client, notification string, info interface{}) {
+	msg := marshalNotification(Notification{Notify: notification, Board: board.id, Info: info})
+	if msg == nil {
+		return
+	}
+
+	c.send(frame{data: msg})
+	log.Println("notify to ", c.id, ": ", string(msg))
+}
+
+// Send the reply to a command. The reply is the command's notification with the
+// command id echoed back, the command status, and the error code if the command
+// has failed.
+// The reply is only sent to the client that has sent the command.
+func reply(c *client, id string, notification string, errCode string, info interface{}) {
+	status := "ok"
+	if errCode != "" {
+		status = "error"
+	}
+
+	msg := marshalNotification(Notification{Notify: notification, Id: id, Status: status, Error: errCode, Info: info})
+	if msg == nil {
+		return
+	}
+
+	c.send(frame{data: msg})
+	log.Println("reply to ", c.id, ": ", string(msg))
+}
+
+// Notify the IDE about something that the agent is doing
+func (agent *Agent) notifyUpdate(what string) {
+	agent.notify("boardUpdate", UpdateInfo{What: []byte(what)})
+}
+
+// Notify the IDE about something that the agent is doing with a board
+func (board *Board) notifyUpdate(what string) {
+	board.notify("boardUpdate", UpdateInfo{What: []byte(what)})
+}
+
+// Get the info of a board, as sent in the boardAttached notification
+func (board *Board) attachedInfo() BoardAttachedInfo {
+	board.infoMutex.Lock()
+	defer board.infoMutex.Unlock()
+
+	info := BoardAttachedInfo{Id: board.id, NewBuild: board.newBuild}
+
+	if json.Valid([]byte(board.info)) {
+		info.Info = json.RawMessage(board.info)
+	}
+
+	return info
+}
+
+// Get the info sent in the attachIde reply
+func (agent *Agent) attachIdeInfo(c *client, resumed bool) AttachIdeInfo {
+	return AttachIdeInfo{
+		AgentVersion:    Version,
+		ProtocolVersion: ProtocolVersion,
+		Capabilities:    agentCapabilities(),
+		ClientId:        c.id,
+		LeaseHolder:     agent.leaseHolderId(),
+		Session:         agent.hub.sessionId(c),
+		Resumed:         resumed,
+	}
+}
+
+func (board *Board) notifyAttached() {
+	board.notify("boardAttached", board.attachedInfo())
+}
+
+// Run a board operation, catching the panics raised by the board primitives.
+// Returns the error code, or "" if the operation has finished normally.
+func boardCall(operation func()) (errCode string) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("board operation failed: ", err)
+
+			if err == errTimeout || err == context.DeadlineExceeded {
+				errCode = ErrTimeout
+			} else if err == context.Canceled {
+				errCode = ErrCancelled
+			} else {
+				errCode = ErrNoBoard
+			}
+		}
+	}()
+
+	operation()
+
+	return ""
+}
+
+// Test that the board of a command is ready for execute it. If not, reply the
+// command with the corresponding error.
+func (agent *Agent) boardReady(c *client, command CommandMessage, board *Board) bool {
+	if board == nil {
+		reply(c, command.Id, command.Command, ErrNoBoard, nil)
+		return false
+	}
+
+	if board.upgrading() {
+		reply(c, command.Id, command.Command, ErrBoardBusy, nil)
+		return false
+	}
+
+	if !board.validFirmware {
+		reply(c, command.Id, command.Command, ErrInvalidFirmware, nil)
+		return false
+	}
+
+	return true
+}
+
+// Stop the program running in the board. This is done before retry a
+// board operation that has failed, because probably the main thread is
+// executing a blocking program.
+func (board *Board) stopProgram() string {
+	board.notifyUpdate("Stopping program")
+	errCode := boardCall(func() {
+		board.reset(false)
+	})
+	board.notify("boardReset", nil)
+	board.notifyAttached()
+
+	return errCode
+}
+
+// Unregister a client that has gone. If it is the last client the monitor is
+// stopped, and the boards are detached if detach is true.
+func (agent *Agent) clientGone(c *client, detach bool) {
+	if agent.hub.unregister(c) == 0 {
+		// Last client has gone
+		agent.stopMonitor()
+
+		if detach {
+			agent.detachBoards()
+		}
+	}
+}
+
+func (agent *Agent) control(ws *websocket.Conn) {
+	var msg string
+	var err error
+
+	c := newClient(ws)
+	agent.hub.register(c)
+
+	log.Println("start control for client ", c.id, " ...")
+
+	// When the heartbeat is missed the IDE is detached
+	var lost int32
+
+	stopHeartbeat := agent.startHeartbeat(ws, c, func() {
+		atomic.StoreInt32(&lost, 1)
+	})
+
+	defer func() {
+		stopHeartbeat()
+		agent.cancelCommands(c)
+		agent.clientGone(c, atomic.LoadInt32(&lost) == 1)
+
+		ws.Close()
+		log.Println("stop control for client ", c.id, " ...")
+	}()
+
+	for {
+		var f frame
+
+		// Get a new message
+		if err = frameCodec.Receive(ws, &f); err != nil {
+			return
+		}
+
+		if f.binary {
+			// Binary frames are only expected after a command that announces a transfer
+			reply(c, "", "commandRejected", ErrInvalidCommand, CommandRejectedInfo{Reason: "unexpected binary frame"})
+			continue
+		}
+
+		msg = string(f.data)
+
+		log.Println("received message: ", msg)
+
+		// Parse command
+		command, arguments, err := parseCommand(msg)
+		if err != nil {
+			log.Println("command rejected: ", err)
+			reply(c, command.Id, "commandRejected", ErrInvalidCommand, CommandRejectedInfo{Command: command.Command, Reason: err.Error()})
+			continue
+		}
+
+		if agent.boardUpgrading(command.Board) {
+			reply(c, command.Id, command.Command, ErrBoardBusy, nil)
+			continue
+		}
+
+		if board := agent.findBoard(command.Board); board != nil && leasedCommands[command.Command] {
+			if granted, holder := agent.hub.checkLease(c, board.id); !granted {
+				reply(c, command.Id, command.Command, ErrNoLease, LeaseInfo{Holder: holder, Board: board.id})
+				continue
+			}
+		}
+
+		switch command.Command {
+		case "attachIde":
+			attachArguments := arguments.(*AttachIdeArguments)
+
+			if !compatibleProtocol(attachArguments.ProtocolVersion) {
+				notifyClient(c, "incompatibleProtocol", IncompatibleProtocolInfo{
+					AgentVersion:       Version,
+					ProtocolVersion:    ProtocolVersion,
+					MinProtocolVersion: MinProtocolVersion,
+					IdeVersion:         attachArguments.ProtocolVersion,
+				})
+				reply(c, command.Id, "attachIde", ErrIncompatibleProtocol, agent.attachIdeInfo(c, false))
+				continue
+			}
+
+			resumed := agent.hub.startSession(c, attachArguments.Session)
+
+			if attachArguments.Devices != nil {
+				agent.devices = attachArguments.Devices
+			}
+
+			// The client gets the leases of the free boards, and they are reset
+			// unless the session is resumed. A resumed session or an observer
+			// don't disturb the running programs.
+			errCode := ""
+			reset := make(map[*Board]bool)
+			for _, board := range agent.attachedBoards() {
+				if granted, _ := agent.hub.requestLease(c, board.id, false); !granted || resumed || board.upgrading() {
+					continue
+				}
+
+				reset[board] = true
+				if boardErrCode := boardCall(func() { board.exclusive(func() { board.reset(false) }) }); boardErrCode != "" {
+					errCode = boardErrCode
+				}
+			}
+
+			reply(c, command.Id, "attachIde", errCode, agent.attachIdeInfo(c, resumed))
+			if resumed {
+				agent.hub.replaySession(c)
+			}
+			for _, board := range agent.attachedBoards() {
+				if reset[board] {
+					board.notifyAttached()
+				} else {
+					board.notifyClient(c, "boardAttached", board.attachedInfo())
+				}
+			}
+			agent.startMonitor()
+
+		case "detachIde":
+			reply(c, command.Id, "detachIde", "", nil)
+			agent.hub.endSession(c)
+			agent.clientGone(c, true)
+
+			return
+
+		case "boardLeaseRequest":
+			board := agent.findBoard(command.Board)
+			if board == nil {
+				reply(c, command.Id, "boardLeaseRequest", ErrNoBoard, nil)
+				continue
+			}
+
+			granted, holder := agent.hub.requestLease(c, board.id, true)
+			if granted {
+				reply(c, command.Id, "boardLeaseRequest", "", LeaseInfo{Holder: holder, Board: board.id})
+			} else {
+				reply(c, command.Id, "boardLeaseRequest", ErrBoardBusy, LeaseInfo{Holder: holder, Board: board.id})
+			}
+
+		case "boardLeaseRelease":
+			board := agent.findBoard(command.Board)
+			if board == nil {
+				reply(c, command.Id, "boardLeaseRelease", ErrNoBoard, nil)
+				continue
+			}
+
+			agent.hub.releaseLease(c, board.id)
+			reply(c, command.Id, "boardLeaseRelease", "", LeaseInfo{Holder: agent.hub.leaseHolderId(board.id), Board: board.id})
+
+		case "cancel":
+			id := arguments.(*CancelArguments).Id
+			reply(c, command.Id, "cancel", agent.cancelCommand(c, id), CancelInfo{Id: id})
+
+		case "agentUploadFirmware":
+			size := arguments.(*UploadFirmwareArguments).Size
+			if size > MaxFirmwareSize {
+				reply(c, command.Id, "agentUploadFirmware", ErrFileTooLarge, nil)
+				continue
+			}
+
+			firmware, err := receiveBinary(ws, size)
+			if err != nil {
+				reply(c, command.Id, "agentUploadFirmware", ErrTransfer, nil)
+				continue
+			}
+
+			if err = agent.storeCustomFirmware(firmware); err != nil {
+				reply(c, command.Id, "agentUploadFirmware", upgradeErrorCode(err), nil)
+				continue
+			}
+
+			reply(c, command.Id, "agentUploadFirmware", "", nil)
+
+		default:
+			// Board commands are executed by the command queue
+			content, errCode := boardCommandContent(ws, arguments)
+			if errCode != "" {
+				reply(c, command.Id, command.Command, errCode, nil)
+				continue
+			}
+
+			if !agent.queueCommand(c, command, arguments, content) {
+				reply(c, command.Id, command.Command, ErrBoardBusy, nil)
+			}
+		}
+	}
+}
+
+// Get the content of the board commands that send a file to the board
+func boardCommandContent(ws *websocket.Conn, arguments interface{}) ([]byte, string) {
+	switch arguments := arguments.(type) {
+	case *WriteFileArguments:
+		return commandContent(ws, arguments.Content, arguments.Transfer, arguments.Size)
+
+	case *RunProgramArguments:
+		return commandContent(ws, arguments.Code, arguments.Transfer, arguments.Size)
+	}
+
+	return nil, ""
+}
+
+// Get the content sent with a command, base64 encoded in the command itself,
+// or in binary frames after the command. Returns the content, and the error code
+// if the content can't be get.
+func commandContent(ws *websocket.Conn, encoded string, transfer string, size int) ([]byte, string) {
+	if transfer == BinaryTransfer {
+		if size > MaxFileSize {
+			return nil, ErrFileTooLarge
+		}
+
+		content, err := receiveBinary(ws, size)
+		if err != nil {
+			return nil, ErrTransfer
+		}
+
+		return content, ""
+	}
+
+	content, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrDecode
+	}
+
+	if len(content) > MaxFileSize {
+		return nil, ErrFileTooLarge
+	}
+
+	return content, ""
+}
+
+// Get the error code for an upgrade error
+func upgradeErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	if err == errInvalidFirmware {
+		return ErrInvalidFirmware
+	}
+
+	if err == errNoSerial {
+		return ErrNotAllowed
+	}
+
+	if err == errUpgradeInProgress {
+		return ErrBoardBusy
+	}
+
+	if err == errNoCustomFirmware {
+		return ErrInvalidFirmware
+	}
+
+	return ErrDownload
+}
+
+func (agent *Agent) consoleUp(ws *websocket.Conn) {
+	var msg string
+
+	c := agent.hub.clientFor(ws.Request())
+	if c == nil {
+		ws.Close()
+		return
+	}
+
+	log.Println("consoleUp start for client ", c.id, " ...")
+
+	defer ws.Close()
+	defer log.Println("consoleUp stop for client ", c.id, " ...")
+	defer agent.startHeartbeat(ws, nil, nil)()
+
+	agent.hub.setUp(c, ws, ws.Request().URL.Query().Get("board"))
+
+	// Nothing is expected from the client, wait until the connection is closed
+	for {
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			agent.hub.setUp(c, nil, "")
+			return
+		}
+	}
+}
+
+func (agent *Agent) consoleDown(ws *websocket.Conn) {
+	var err error
+	var msg string
+
+	c := agent.hub.clientFor(ws.Request())
+	if c == nil {
+		ws.Close()
+		return
+	}
+
+	// Input is sent to the selected board, or to the default board
+	boardId := ws.Request().URL.Query().Get("board")
+
+	log.Println("consoleDown start for client ", c.id, " ...")
+
+	defer ws.Close()
+	defer log.Println("consoleDown stop for client ", c.id, " ...")
+	defer agent.startHeartbeat(ws, nil, nil)()
+
+	for {
+		// Get a new message
+		if err = websocket.Message.Receive(ws, &msg); err != nil {
+			return
+		}
+
+		if agent.boardUpgrading(boardId) {
+			continue
+		}
+
+		board := agent.findBoard(boardId)
+		if board == nil {
+			continue
+		}
+
+		if granted, holder := agent.hub.checkLease(c, board.id); !granted {
+			// Observers can't send console input
+			reply(c, "", "boardConsoleIn", ErrNoLease, LeaseInfo{Holder: holder, Board: board.id})
+			continue
+		}
+
+		if errCode := board.writeConsole([]byte(msg)); errCode != "" {
+			reply(c, "", "boardConsoleIn", errCode, nil)
+		}
+	}
+}
+
+// Get the handler of the websocket server
+func (agent *Agent) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("/", agent.pairedHandler(agent.control))
+	mux.Handle("/control", agent.pairedHandler(agent.control))
+	mux.Handle("/up", agent.pairedHandler(agent.consoleUp))
+	mux.Handle("/down", agent.pairedHandler(agent.consoleDown))
+	mux.Handle("/pair", heartbeatServer{websocket.Server{Handler: agent.pair, Handshake: agent.checkOrigin}})
+	mux.Handle("/api/", agent.apiRouter())
+	mux.HandleFunc("/events", agent.events)
+	mux.HandleFunc("/protocol.schema.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/schema+json")
+		w.Write(protocolSchema)
+	})
+
+	return mux
+}
+
+// Get the handler of the secure websocket server, that only serves the IDE endpoints
+func (agent *Agent) secureHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("/control", agent.pairedHandler(agent.control))
+	mux.Handle("/up", agent.pairedHandler(agent.consoleUp))
+	mux.Handle("/down", agent.pairedHandler(agent.consoleDown))
+	mux.Handle("/pair", heartbeatServer{websocket.Server{Handler: agent.pair, Handshake: agent.checkOrigin}})
+
+	return mux
+}
@@ -0,0 +1,221 @@
+/*
+ * Whitecat Blocky Environment, websocket server tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Origin of the IDE in the tests
+const testOrigin = "https://ide.whitecatboard.org"
+
+// Serve the websocket endpoints of an agent, and pair an IDE from testOrigin.
+// Returns the websocket URL of the server, and the token of the IDE.
+func startWebsocketServer(t *testing.T, agent *Agent) (url string, token string) {
+	server := httptest.NewServer(agent.handler())
+	t.Cleanup(server.Close)
+	t.Cleanup(agent.Stop)
+
+	token, err := agent.addToken(testOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return "ws" + strings.TrimPrefix(server.URL, "http"), token
+}
+
+// A new agent that only accepts connections from testOrigin
+func testAgent(t *testing.T) *Agent {
+	return New(Config{DataFolder: t.TempDir(), AllowedOrigins: []string{testOrigin}})
+}
+
+// Connect to a websocket endpoint from testOrigin
+func dialWebsocket(t *testing.T, url string) *websocket.Conn {
+	ws, err := websocket.Dial(url, "", testOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { ws.Close() })
+
+	return ws
+}
+
+// Send a command to the control connection
+func sendCommand(t *testing.T, ws *websocket.Conn, command string) {
+	if err := websocket.Message.Send(ws, command); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Receive notifications until one with the given type, or the reply of a
+// command if id is not empty
+func receiveNotification(t *testing.T, ws *websocket.Conn, notify string, id string) Notification {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for {
+		var msg string
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			t.Fatalf("%s %s not received: %v", notify, id, err)
+		}
+
+		var notification Notification
+		json.Unmarshal([]byte(msg), &notification)
+
+		if notification.Notify == notify && notification.Id == id {
+			return notification
+		}
+	}
+}
+
+func TestCommandReplies(t *testing.T) {
+	url, token := startWebsocketServer(t, testAgent(t))
+	ws := dialWebsocket(t, url+"/control?token="+token)
+
+	for _, test := range []struct {
+		command string
+		notify  string
+		errCode string
+	}{
+		{`{"command":"boardInfo","id":"1"}`, "boardInfo", ErrNoBoard},
+		{`{"command":"boardWriteFile","id":"2","arguments":{"path":"/a.lua","content":"!!"}}`, "boardWriteFile", ErrDecode},
+		{`{"command":"cancel","id":"3","arguments":{"id":"1"}}`, "cancel", ErrNotFound},
+		{`{"command":"boardFormat","id":"4"}`, "commandRejected", ErrInvalidCommand},
+	} {
+		var command CommandMessage
+		json.Unmarshal([]byte(test.command), &command)
+
+		sendCommand(t, ws, test.command)
+
+		// The reply echoes the id, with the error code of the command
+		reply := receiveNotification(t, ws, test.notify, command.Id)
+		if reply.Status != "error" || reply.Error != test.errCode {
+			t.Errorf("%s: got %s %s, want error %s", test.command, reply.Status, reply.Error, test.errCode)
+		}
+	}
+}
+
+func TestCommandSucceeded(t *testing.T) {
+	url, token := startWebsocketServer(t, testAgent(t))
+	ws := dialWebsocket(t, url+"/control?token="+token)
+
+	sendCommand(t, ws, `{"command":"attachIde","id":"1","arguments":{"protocolVersion":2,"devices":[]}}`)
+
+	reply := receiveNotification(t, ws, "attachIde", "1")
+	if reply.Status != "ok" || reply.Error != "" {
+		t.Fatalf("got %s %s, want ok", reply.Status, reply.Error)
+	}
+}
+
+func TestSecureWebsocketServer(t *testing.T) {
+	agent := New(Config{
+		DataFolder:     t.TempDir(),
+		AllowedOrigins: []string{testOrigin},
+		Certificates:   CertificateOptions{Hosts: []string{"127.0.0.1"}},
+	})
+
+	tlsConfig, err := agent.serverTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Serve with the TLS settings of the agent, httptest would use its own certificate
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: agent.secureHandler()}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	t.Cleanup(agent.Stop)
+
+	address := listener.Addr().String()
+
+	// Trust the certification authority of the agent, as the IDE browser does once installed
+	ca, err := ioutil.ReadFile(CACertificate(agent.config.DataFolder))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca)
+
+	token, err := agent.addToken(testOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := websocket.NewConfig("wss://"+address+"/control?token="+token, testOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.TlsConfig = &tls.Config{RootCAs: roots}
+
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ws.Close()
+
+	sendCommand(t, ws, `{"command":"attachIde","id":"1","arguments":{"protocolVersion":2,"devices":[]}}`)
+
+	if reply := receiveNotification(t, ws, "attachIde", "1"); reply.Status != "ok" {
+		t.Fatalf("got %s %s, want ok", reply.Status, reply.Error)
+	}
+
+	// Only the IDE endpoints are served over wss
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	for _, path := range []string{"/api/v1/openapi.json", "/protocol.schema.json"} {
+		resp, err := client.Get("https://" + address + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s served over wss with status %d", path, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+/*
+ * Whitecat Blocky Environment, certificate installation
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+/*
+
+wccagent cert installs the certification authority of the agent, so that browsers trust the
+secure websocket server (see agent/certificates.go), or uninstalls it. This is only available
+on linux:
+
+wccagent cert install
+wccagent cert uninstall
+
+The certification authority is added to the NSS databases of the user, used by Chrome, Chromium
+and Firefox, and to the system trust store. The NSS databases are updated with certutil, from
+the libnss3-tools package, and the system trust store with sudo if the agent isn't run by root.
+
+Run it as the user that runs the IDE, as the NSS databases are per user.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"runtime"
+
+	"github.com/jyex/whitecat-create-agent/agent"
+)
+
+// Nickname of the certification authority in the NSS databases
+const certNickname = "Whitecat Create Agent"
+
+// System trust stores: the folder of the certificates, the file name of the
+// certification authority, and the command that updates the store
+type trustStore struct {
+	folder string
+	file   string
+	update []string
+}
+
+var trustStores = []trustStore{
+	// Debian, Ubuntu
+	{"/usr/local/share/ca-certificates", "wccagent.crt", []string{"update-ca-certificates"}},
+	// Fedora, RHEL
+	{"/etc/pki/ca-trust/source/anchors", "wccagent.pem", []string{"update-ca-trust", "extract"}},
+	// Arch
+	{"/etc/ca-certificates/trust-source/anchors", "wccagent.crt", []string{"trust", "extract-compat"}},
+	// openSUSE
+	{"/usr/share/pki/trust/anchors", "wccagent.pem", []string{"update-ca-certificates"}},
+}
+
+func certUsage() {
+	fmt.Println("wccagent: usage: wccagent cert command")
+	fmt.Println("")
+	fmt.Println(" install: trust the certification authority of the agent")
+	fmt.Println(" uninstall: remove the certification authority of the agent")
+}
+
+// Run a command, as root if the agent isn't run by root
+func certSudo(args ...string) error {
+	if os.Geteuid() != 0 {
+		args = append([]string{"sudo"}, args...)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// Get the system trust store, nil if it isn't supported
+func certTrustStore() *trustStore {
+	for i := range trustStores {
+		if _, err := os.Stat(trustStores[i].folder); err == nil {
+			return &trustStores[i]
+		}
+	}
+
+	return nil
+}
+
+// Get the NSS databases of the user: the shared one, and the Firefox profiles
+func certNSSDatabases() []string {
+	var databases []string
+
+	usr, err := user.Current()
+	if err != nil {
+		return nil
+	}
+
+	folders := []string{path.Join(usr.HomeDir, ".pki", "nssdb")}
+
+	for _, profiles := range []string{".mozilla/firefox/*", "snap/firefox/common/.mozilla/firefox/*"} {
+		matches, _ := filepath.Glob(path.Join(usr.HomeDir, profiles))
+		folders = append(folders, matches...)
+	}
+
+	for _, folder := range folders {
+		if _, err := os.Stat(path.Join(folder, "cert9.db")); err == nil {
+			databases = append(databases, "sql:"+folder)
+		} else if _, err := os.Stat(path.Join(folder, "cert8.db")); err == nil {
+			databases = append(databases, "dbm:"+folder)
+		}
+	}
+
+	return databases
+}
+
+func certInstall() error {
+	if _, err := agent.GenerateCertificates(AppDataFolder, agent.DefaultCertificateOptions()); err != nil {
+		return err
+	}
+
+	ca := agent.CACertificate(AppDataFolder)
+	failed := false
+
+	if _, err := exec.LookPath("certutil"); err != nil {
+		fmt.Println("certutil not found, install libnss3-tools to trust the certificates in the browsers")
+		failed = true
+	} else {
+		for _, database := range certNSSDatabases() {
+			// Replace the certification authority, it changes when it is renewed
+			exec.Command("certutil", "-D", "-d", database, "-n", certNickname).Run()
+
+			if out, err := exec.Command("certutil", "-A", "-d", database, "-t", "C,,", "-n", certNickname, "-i", ca).CombinedOutput(); err != nil {
+				fmt.Printf("can't install in %s: %s", database, out)
+				failed = true
+			} else {
+				fmt.Println("installed in", database)
+			}
+		}
+	}
+
+	store := certTrustStore()
+	if store == nil {
+		fmt.Println("system trust store not supported")
+		failed = true
+	} else {
+		file := path.Join(store.folder, store.file)
+
+		if err := certSudo("cp", ca, file); err != nil {
+			return err
+		}
+
+		if err := certSudo(store.update...); err != nil {
+			return err
+		}
+
+		fmt.Println("installed in", file)
+	}
+
+	if failed {
+		return errors.New("the certification authority is not installed everywhere")
+	}
+
+	return nil
+}
+
+func certUninstall() error {
+	if _, err := exec.LookPath("certutil"); err == nil {
+		for _, database := range certNSSDatabases() {
+			if exec.Command("certutil", "-L", "-d", database, "-n", certNickname).Run() != nil {
+				continue
+			}
+
+			if out, err := exec.Command("certutil", "-D", "-d", database, "-n", certNickname).CombinedOutput(); err != nil {
+				return fmt.Errorf("can't uninstall from %s: %s", database, out)
+			}
+
+			fmt.Println("uninstalled from", database)
+		}
+	}
+
+	if store := certTrustStore(); store != nil {
+		file := path.Join(store.folder, store.file)
+
+		if _, err := os.Stat(file); err == nil {
+			if err := certSudo("rm", "-f", file); err != nil {
+				return err
+			}
+
+			if err := certSudo(store.update...); err != nil {
+				return err
+			}
+
+			fmt.Println("uninstalled from", file)
+		}
+	}
+
+	return nil
+}
+
+func cert(args []string) int {
+	var err error
+
+	if runtime.GOOS != "linux" {
+		fmt.Fprintln(os.Stderr, "wccagent: cert is only available on linux")
+		return 1
+	}
+
+	switch {
+	case len(args) == 1 && args[0] == "install":
+		err = certInstall()
+
+	case len(args) == 1 && args[0] == "uninstall":
+		err = certUninstall()
+
+	default:
+		certUsage()
+		return 1
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "wccagent: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,445 @@
+/*
+ * Whitecat Blocky Environment, agent client
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+// Package client connects to a running Whitecat Create Agent, and sends the
+// board commands with the websocket protocol described in the agent's
+// websocket.go.
+package client
+
+/*
+
+The client must be paired with the agent once, from an origin allowed by the agent. The user
+approves the pairing request in the agent, and the token must be kept for the next connections:
+
+	token, err := client.Pair(client.DefaultURL, "https://ide.whitecatboard.org", func(code string) {
+		fmt.Println("Approve the pairing request with code", code)
+	})
+
+	c, err := client.Dial(client.Config{Origin: "https://ide.whitecatboard.org", Token: token})
+	defer c.Close()
+
+	entries, err := c.ListDir(ctx, "/examples")
+
+The deadline of the context is sent as the deadline of the command, and the command is cancelled
+in the agent when the context is done. When a command fails with an error code sent by the agent,
+the error is an *Error.
+
+When the agent has several boards attached, Config.Board selects the board of the commands, and
+the Board of each notification is the board that has sent it.
+
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Address of an agent running in this computer
+const DefaultURL = "ws://localhost:8080"
+
+// Size of the notifications channel. Notifications are dropped when it is full.
+const notificationsSize = 256
+
+var ErrClosed = errors.New("connection closed")
+var ErrPairingRejected = errors.New("pairing rejected")
+
+// An error code sent by the agent
+type Error struct {
+	Command string
+	Code    string
+}
+
+func (err *Error) Error() string {
+	return err.Command + ": " + err.Code
+}
+
+// A notification sent by the agent. Info has the type of the notification's
+// info, for example *BoardAttachedInfo for boardAttached, or json.RawMessage if
+// it isn't known.
+type Notification struct {
+	Type string
+
+	// Id of the board that has sent the notification, if any
+	Board string
+
+	Info interface{}
+}
+
+type Config struct {
+	// URL of the agent, DefaultURL if empty
+	URL string
+
+	// Origin of the client. It must be allowed by the agent.
+	Origin string
+
+	// Token got with Pair
+	Token string
+
+	// Session to resume, if any
+	Session string
+
+	// Addresses of the network boards that the agent can attach, host:port,
+	// or pseudo-terminals such as the one of the Lua RTOS emulator
+	Boards []string
+
+	// Id of the board that executes the commands. The agent uses the first
+	// attached board if it is empty.
+	Board string
+}
+
+// A connection to the agent
+type Client struct {
+	ws    *websocket.Conn
+	board string
+
+	// Information sent by the agent when the client attached
+	Info AttachIdeInfo
+
+	mutex   sync.Mutex
+	lastId  uint64
+	pending map[string]chan message
+	err     error
+
+	notifications chan Notification
+	closed        chan struct{}
+}
+
+func agentURL(base string, path string, query url.Values) string {
+	if base == "" {
+		base = DefaultURL
+	}
+
+	return base + path + "?" + query.Encode()
+}
+
+// Pair the client with the agent, and get the token for the next connections.
+// code is called with the pairing code, that the user must check before
+// approve the request.
+func Pair(base string, origin string, code func(string)) (string, error) {
+	ws, err := websocket.Dial(agentURL(base, "/pair", url.Values{}), "", origin)
+	if err != nil {
+		return "", err
+	}
+
+	defer ws.Close()
+
+	for {
+		var msg message
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return "", err
+		}
+
+		var info pairingInfo
+		json.Unmarshal(msg.Info, &info)
+
+		switch msg.Notify {
+		case "pairingRequested":
+			code(info.Code)
+
+		case "pairingApproved":
+			return info.Token, nil
+
+		case "pairingRejected":
+			return "", ErrPairingRejected
+		}
+	}
+}
+
+// Connect to the agent, and attach the client
+func Dial(config Config) (*Client, error) {
+	ws, err := websocket.Dial(agentURL(config.URL, "/control", url.Values{"token": {config.Token}}), "", config.Origin)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		ws:            ws,
+		board:         config.Board,
+		pending:       make(map[string]chan message),
+		notifications: make(chan Notification, notificationsSize),
+		closed:        make(chan struct{}),
+	}
+
+	go c.reader()
+
+	arguments := attachIdeArguments{ProtocolVersion: ProtocolVersion, Session: config.Session}
+	for _, address := range config.Boards {
+		arguments.Devices = append(arguments.Devices, device{Address: address})
+	}
+
+	info, err := c.call(context.Background(), "attachIde", arguments)
+	if err == nil {
+		err = json.Unmarshal(info, &c.Info)
+	}
+
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Detach the client and close the connection. The session of the client is
+// ended.
+func (c *Client) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c.call(ctx, "detachIde", nil)
+
+	return c.ws.Close()
+}
+
+// Notifications sent by the agent. The channel is closed when the connection
+// is closed.
+func (c *Client) Notifications() <-chan Notification {
+	return c.notifications
+}
+
+// Receive the messages sent by the agent
+func (c *Client) reader() {
+	var err error
+
+	for {
+		var msg message
+		if err = websocket.JSON.Receive(c.ws, &msg); err != nil {
+			break
+		}
+
+		c.mutex.Lock()
+		reply, ok := c.pending[msg.Id]
+		if ok && msg.Status != "" {
+			delete(c.pending, msg.Id)
+		}
+		c.mutex.Unlock()
+
+		if ok && msg.Status != "" {
+			reply <- msg
+			continue
+		}
+
+		notification := Notification{Type: msg.Notify, Board: msg.Board, Info: msg.Info}
+		if info, ok := notificationInfo[msg.Notify]; ok {
+			notification.Info = info()
+			json.Unmarshal(msg.Info, notification.Info)
+		}
+
+		select {
+		case c.notifications <- notification:
+		default:
+		}
+	}
+
+	c.mutex.Lock()
+	c.err = ErrClosed
+	c.mutex.Unlock()
+
+	close(c.closed)
+	close(c.notifications)
+}
+
+// Send a command and wait for its reply. Returns the info of the reply.
+func (c *Client) call(ctx context.Context, name string, arguments interface{}) (json.RawMessage, error) {
+	if arguments == nil {
+		arguments = struct{}{}
+	}
+
+	reply := make(chan message, 1)
+
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return nil, c.err
+	}
+
+	c.lastId++
+	cmd := command{Id: strconv.FormatUint(c.lastId, 10), Command: name, Board: c.board, Arguments: arguments}
+	c.pending[cmd.Id] = reply
+	c.mutex.Unlock()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		cmd.Timeout = int(time.Until(deadline) / time.Millisecond)
+		if cmd.Timeout <= 0 {
+			cmd.Timeout = 1
+		}
+	}
+
+	if err := websocket.JSON.Send(c.ws, cmd); err != nil {
+		c.forget(cmd.Id)
+		return nil, err
+	}
+
+	select {
+	case msg := <-reply:
+		if msg.Status == "error" {
+			return msg.Info, &Error{Command: name, Code: msg.Error}
+		}
+
+		return msg.Info, nil
+
+	case <-ctx.Done():
+		c.forget(cmd.Id)
+
+		if name != "cancel" {
+			go c.call(context.Background(), "cancel", cancelArguments{Id: cmd.Id})
+		}
+
+		return nil, ctx.Err()
+
+	case <-c.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (c *Client) forget(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.pending, id)
+}
+
+// Get the info of the board: firmware build and commit, model and brand
+func (c *Client) BoardInfo(ctx context.Context) (*BoardInfo, error) {
+	info, err := c.call(ctx, "boardInfo", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var boardInfo BoardInfo
+	if err := json.Unmarshal(info, &boardInfo); err != nil {
+		return nil, fmt.Errorf("boardInfo: %v", err)
+	}
+
+	return &boardInfo, nil
+}
+
+// List the content of a directory of the board
+func (c *Client) ListDir(ctx context.Context, path string) ([]DirEntry, error) {
+	info, err := c.call(ctx, "boardGetDirContent", pathArguments{Path: path})
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []DirEntry
+	if err := json.Unmarshal(info, &entries); err != nil {
+		return nil, fmt.Errorf("boardGetDirContent: %v", err)
+	}
+
+	return entries, nil
+}
+
+func (c *Client) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	info, err := c.call(ctx, "boardReadFile", pathArguments{Path: path})
+	if err != nil {
+		return nil, err
+	}
+
+	var content fileContentInfo
+	if err := json.Unmarshal(info, &content); err != nil {
+		return nil, fmt.Errorf("boardReadFile: %v", err)
+	}
+
+	return content.Content, nil
+}
+
+func (c *Client) WriteFile(ctx context.Context, path string, content []byte) error {
+	_, err := c.call(ctx, "boardWriteFile", writeFileArguments{Path: path, Content: content})
+	return err
+}
+
+// Remove a file of the board. The path is sent base64 encoded, as the agent
+// expects.
+func (c *Client) RemoveFile(ctx context.Context, path string) error {
+	_, err := c.call(ctx, "boardRemoveFile", pathArguments{Path: encodePath(path)})
+	return err
+}
+
+// Write a program to a file of the board, and run it
+func (c *Client) RunProgram(ctx context.Context, path string, code []byte) error {
+	_, err := c.call(ctx, "boardRunProgram", runProgramArguments{Path: path, Code: code})
+	return err
+}
+
+// Run Lua code in the board, and get its output
+func (c *Client) RunCommand(ctx context.Context, code string) ([]byte, error) {
+	info, err := c.call(ctx, "boardRunCommand", runCommandArguments{Code: []byte(code)})
+	if err != nil {
+		return nil, err
+	}
+
+	var response runCommandInfo
+	json.Unmarshal(info, &response)
+
+	return response.Response, nil
+}
+
+func (c *Client) Stop(ctx context.Context) error {
+	_, err := c.call(ctx, "boardStop", nil)
+	return err
+}
+
+func (c *Client) Reset(ctx context.Context) error {
+	_, err := c.call(ctx, "boardReset", nil)
+	return err
+}
+
+// Upgrade the board firmware. If custom is true the custom firmware uploaded to
+// the agent is flashed. The progress is sent in boardUpdate notifications.
+func (c *Client) Upgrade(ctx context.Context, custom bool) error {
+	_, err := c.call(ctx, "boardUpgrade", upgradeArguments{Custom: custom})
+	return err
+}
+
+// Install a firmware in a board without a valid firmware
+func (c *Client) Install(ctx context.Context, firmware string, custom bool) error {
+	_, err := c.call(ctx, "boardInstall", installArguments{Firmware: firmware, Custom: custom})
+	return err
+}
+
+// Request the lease of the default board. If other client holds the lease the
+// request is queued, and the error code is board-busy. The lease is notified in
+// boardLease notifications.
+func (c *Client) RequestLease(ctx context.Context) error {
+	_, err := c.call(ctx, "boardLeaseRequest", nil)
+	return err
+}
+
+func (c *Client) ReleaseLease(ctx context.Context) error {
+	_, err := c.call(ctx, "boardLeaseRelease", nil)
+	return err
+}
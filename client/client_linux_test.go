@@ -0,0 +1,256 @@
+//go:build linux
+// +build linux
+
+/*
+ * Whitecat Blocky Environment, agent client tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jyex/whitecat-create-agent/agent"
+	"github.com/jyex/whitecat-create-agent/emulator"
+)
+
+const testOrigin = "https://ide.whitecatboard.org"
+
+// Start an agent in-process, with a board emulated on a pseudo-terminal, and
+// connect a client to it
+func dialEmulatedBoard(t *testing.T) (*Client, *emulator.Emulator) {
+	folder := t.TempDir()
+
+	// The IDE server doesn't have the prerequisites, so the last downloaded
+	// ones are uploaded to the board
+	for name, content := range map[string]string{"board-info.lua": "print(\"{}\")\n", "lib/block.lua": "-- block\n"} {
+		file := path.Join(folder, "tmp", "prerequisites_files", "lua", name)
+
+		if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ide := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(ide.Close)
+
+	// Get a free port for the websocket server
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address := listener.Addr().String()
+	listener.Close()
+
+	config := agent.DefaultConfig()
+	config.DataFolder = folder
+	config.BaseURL = ide.URL
+	config.BaseIdeURL = ide.URL
+	config.AllowedOrigins = []string{testOrigin}
+	config.Address = address
+	config.GrpcAddress = ""
+	config.EmulatorDevices = true
+
+	a := agent.New(config)
+	if err := a.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(a.Stop)
+
+	// The user approves the pairing request
+	go func() {
+		if request := a.NextPairingRequest(); request != nil {
+			request.Approve(true)
+		}
+	}()
+
+	var token string
+
+	// The server is started in the background
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		token, err = Pair("ws://"+address, testOrigin, func(string) {})
+		if err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	emu := emulator.New()
+
+	pty, err := emulator.OpenPty()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { pty.Close() })
+
+	go emu.RunPty(pty)
+
+	c, err := Dial(Config{URL: "ws://" + address, Origin: testOrigin, Token: token, Boards: []string{pty.Name}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { c.Close() })
+
+	waitNotification(t, c, "boardAttached")
+
+	return c, emu
+}
+
+// Wait for a notification of a type, and get its info
+func waitNotification(t *testing.T, c *Client, notification string) interface{} {
+	timeout := time.After(20 * time.Second)
+
+	for {
+		select {
+		case n, ok := <-c.Notifications():
+			if !ok {
+				t.Fatalf("connection closed waiting for %s", notification)
+			}
+
+			if n.Type == notification {
+				return n.Info
+			}
+
+		case <-timeout:
+			t.Fatalf("%s not received", notification)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	c, emu := dialEmulatedBoard(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	info, err := c.BoardInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Board != "EMULATOR" || info.Brand != "WHITECAT" {
+		t.Fatalf("unexpected board info %+v", info)
+	}
+
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	if err := c.WriteFile(ctx, "/data.bin", content); err != nil {
+		t.Fatal(err)
+	}
+
+	if written, _ := emu.ReadFile("/data.bin"); !bytes.Equal(written, content) {
+		t.Fatalf("written %d bytes, expected %d", len(written), len(content))
+	}
+
+	read, err := c.ReadFile(ctx, "/data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(read, content) {
+		t.Fatalf("read %d bytes, expected %d", len(read), len(content))
+	}
+
+	entries, err := c.ListDir(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listed := false
+	for _, entry := range entries {
+		listed = listed || entry.Name == "data.bin"
+	}
+
+	if !listed {
+		t.Fatalf("data.bin not listed in %+v", entries)
+	}
+
+	if err := c.RemoveFile(ctx, "/data.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := emu.ReadFile("/data.bin"); ok {
+		t.Fatal("data.bin not removed")
+	}
+
+	response, err := c.RunCommand(ctx, "print(\"cmd\", 42)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(response) != "cmd\t42" {
+		t.Fatalf("response %q", response)
+	}
+
+	program := []byte("print(\"program output\")\n")
+	if err := c.RunProgram(ctx, "/main.lua", program); err != nil {
+		t.Fatal(err)
+	}
+
+	if written, _ := emu.ReadFile("/main.lua"); !bytes.Equal(written, program) {
+		t.Fatalf("program %q, expected %q", written, program)
+	}
+}
+
+func TestClientError(t *testing.T) {
+	c, _ := dialEmulatedBoard(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// The emulated board isn't connected to a serial port, so its firmware
+	// can't be flashed
+	err := c.Upgrade(ctx, false)
+	if agentErr, ok := err.(*Error); !ok || agentErr.Code != ErrNotAllowed {
+		t.Fatalf("error %v, expected %s", err, ErrNotAllowed)
+	}
+}
@@ -0,0 +1,268 @@
+/*
+ * Whitecat Blocky Environment, agent client, protocol messages
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// Version of the protocol implemented by the client
+const ProtocolVersion = 2
+
+// Error codes sent by the agent when a command fails
+const (
+	ErrTimeout              = "timeout"
+	ErrBoardBusy            = "board-busy"
+	ErrDecode               = "decode-error"
+	ErrNoBoard              = "no-board"
+	ErrInvalidFirmware      = "invalid-firmware"
+	ErrDownload             = "download-error"
+	ErrNotAllowed           = "not-allowed"
+	ErrInvalidCommand       = "invalid-command"
+	ErrFileTooLarge         = "file-too-large"
+	ErrTransfer             = "transfer-error"
+	ErrNoLease              = "no-lease"
+	ErrCancelled            = "cancelled"
+	ErrNotFound             = "not-found"
+	ErrIncompatibleProtocol = "incompatible-protocol"
+)
+
+// Command sent to the agent
+type command struct {
+	Id        string      `json:"id"`
+	Command   string      `json:"command"`
+	Timeout   int         `json:"timeout,omitempty"`
+	Board     string      `json:"board,omitempty"`
+	Arguments interface{} `json:"arguments"`
+}
+
+// Notification, or command reply, sent by the agent
+type message struct {
+	Notify string          `json:"notify"`
+	Id     string          `json:"id"`
+	Board  string          `json:"board"`
+	Status string          `json:"status"`
+	Error  string          `json:"error"`
+	Info   json.RawMessage `json:"info"`
+}
+
+type attachIdeArguments struct {
+	ProtocolVersion int      `json:"protocolVersion"`
+	Devices         []device `json:"devices,omitempty"`
+	Session         string   `json:"session,omitempty"`
+}
+
+type device struct {
+	Address string `json:"address"`
+}
+
+type pathArguments struct {
+	Path string `json:"path"`
+}
+
+type writeFileArguments struct {
+	Path    string `json:"path"`
+	Content []byte `json:"content"`
+}
+
+type runProgramArguments struct {
+	Path string `json:"path"`
+	Code []byte `json:"code"`
+}
+
+type runCommandArguments struct {
+	Code []byte `json:"code"`
+}
+
+type upgradeArguments struct {
+	Custom bool `json:"custom"`
+}
+
+type installArguments struct {
+	Firmware string `json:"firmware"`
+	Custom   bool   `json:"custom"`
+}
+
+type cancelArguments struct {
+	Id string `json:"id"`
+}
+
+type fileContentInfo struct {
+	Content []byte `json:"content"`
+}
+
+type runCommandInfo struct {
+	Response []byte `json:"response"`
+}
+
+type pairingInfo struct {
+	Code  string `json:"code"`
+	Token string `json:"token"`
+}
+
+// Capabilities of the agent
+type Capabilities struct {
+	Commands        []string `json:"commands"`
+	Notifications   []string `json:"notifications"`
+	Transports      []string `json:"transports"`
+	BoardTransports []string `json:"boardTransports"`
+	MaxFileSize     int      `json:"maxFileSize"`
+	ChunkSize       int      `json:"chunkSize"`
+	FrameSize       int      `json:"frameSize"`
+	BinaryFrames    bool     `json:"binaryFrames"`
+	MultipleBoards  bool     `json:"multipleBoards"`
+	MultipleIdes    bool     `json:"multipleIdes"`
+	Sessions        bool     `json:"sessions"`
+	Flashing        bool     `json:"flashing"`
+}
+
+// Information sent by the agent when the client attaches
+type AttachIdeInfo struct {
+	AgentVersion    string        `json:"agent-version"`
+	ProtocolVersion int           `json:"protocolVersion"`
+	Capabilities    *Capabilities `json:"capabilities"`
+	ClientId        string        `json:"clientId"`
+	LeaseHolder     string        `json:"leaseHolder"`
+	Session         string        `json:"session"`
+	Resumed         bool          `json:"resumed"`
+}
+
+type DirEntry struct {
+	Type string `json:"type"`
+	Size string `json:"size"`
+	Date string `json:"date"`
+	Name string `json:"name"`
+}
+
+// Info of the board, sent in the boardInfo reply
+type BoardInfo struct {
+	Build   string `json:"build"`
+	Commit  string `json:"commit"`
+	Board   string `json:"board"`
+	Subtype string `json:"subtype"`
+	Brand   string `json:"brand"`
+	Ota     bool   `json:"ota"`
+	Status  struct {
+		Shell   bool `json:"shell"`
+		History bool `json:"history"`
+	} `json:"status"`
+}
+
+// Info of the notifications
+
+type BoardAttachedInfo struct {
+	Id       string          `json:"id"`
+	Info     json.RawMessage `json:"info"`
+	NewBuild bool            `json:"newBuild"`
+}
+
+type BoardDetachedInfo struct {
+	Id string `json:"id"`
+}
+
+type BlockInfo struct {
+	Block []byte `json:"block"`
+}
+
+type BlockErrorInfo struct {
+	Block []byte `json:"block"`
+	Error []byte `json:"error"`
+}
+
+type RuntimeErrorInfo struct {
+	Where     string `json:"where"`
+	Line      string `json:"line"`
+	Exception string `json:"exception"`
+	Message   []byte `json:"message"`
+}
+
+type UpdateInfo struct {
+	What []byte `json:"what"`
+}
+
+// State is one of the board states of the agent's state.go: scanning, opening,
+// booting, formatting, uploading-prerequisites, ready, running, upgrading,
+// error or detached
+type BoardStateInfo struct {
+	Id       string `json:"id"`
+	State    string `json:"state"`
+	Previous string `json:"previous"`
+	Reason   string `json:"reason"`
+}
+
+type LeaseInfo struct {
+	Holder string `json:"holder"`
+	Board  string `json:"board,omitempty"`
+}
+
+type LeaseRequestedInfo struct {
+	Client string `json:"client"`
+	Board  string `json:"board,omitempty"`
+}
+
+type AgentHeartbeatInfo struct {
+	Interval int `json:"interval"`
+	Timeout  int `json:"timeout"`
+}
+
+type SessionResumedInfo struct {
+	Session  string `json:"session"`
+	Replayed int    `json:"replayed"`
+	Missed   int    `json:"missed"`
+}
+
+type ConsoleOverflowInfo struct {
+	Dropped int `json:"dropped"`
+}
+
+// Type of the info of each notification. The info of the notifications that
+// are not in the map is not decoded.
+var notificationInfo = map[string]func() interface{}{
+	"boardAttached":       func() interface{} { return &BoardAttachedInfo{} },
+	"boardDetached":       func() interface{} { return &BoardDetachedInfo{} },
+	"boardRuntimeError":   func() interface{} { return &RuntimeErrorInfo{} },
+	"boardRuntimeWarning": func() interface{} { return &RuntimeErrorInfo{} },
+	"boardUpdate":         func() interface{} { return &UpdateInfo{} },
+	"boardState":          func() interface{} { return &BoardStateInfo{} },
+	"blockStart":          func() interface{} { return &BlockInfo{} },
+	"blockEnd":            func() interface{} { return &BlockInfo{} },
+	"blockError":          func() interface{} { return &BlockErrorInfo{} },
+	"blockErrorCatched":   func() interface{} { return &BlockInfo{} },
+	"boardLease":          func() interface{} { return &LeaseInfo{} },
+	"boardLeaseRequested": func() interface{} { return &LeaseRequestedInfo{} },
+	"agentHeartbeat":      func() interface{} { return &AgentHeartbeatInfo{} },
+	"sessionResumed":      func() interface{} { return &SessionResumedInfo{} },
+	"consoleOverflow":     func() interface{} { return &ConsoleOverflowInfo{} },
+}
+
+func encodePath(path string) string {
+	return base64.StdEncoding.EncodeToString([]byte(path))
+}
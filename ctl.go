@@ -0,0 +1,312 @@
+/*
+ * Whitecat Blocky Environment, local control client
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+/*
+
+wccagent ctl controls a running agent, through its control socket, see agent/ctl.go:
+
+wccagent ctl status
+wccagent ctl ls /examples
+wccagent ctl get /examples/blink.lua blink.lua
+wccagent ctl put blink.lua /examples/blink.lua
+wccagent ctl reset
+wccagent ctl console
+
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/jyex/whitecat-create-agent/agent"
+)
+
+func ctlUsage() {
+	fmt.Println("wccagent: usage: wccagent ctl command [arguments]")
+	fmt.Println("")
+	fmt.Println(" status: show the agent status")
+	fmt.Println(" ls [path]: list a directory of the board")
+	fmt.Println(" get path [file]: read a file of the board, to stdout if file is missing")
+	fmt.Println(" put file path: write a file to the board, from stdin if file is -")
+	fmt.Println(" reset: reset the board")
+	fmt.Println(" console: show the board console, and send stdin to the board")
+}
+
+var ctlClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var dialer net.Dialer
+
+			return dialer.DialContext(ctx, "unix", agent.ControlSocket(AppDataFolder))
+		},
+	},
+}
+
+// Send a request to the agent on the control socket. Requests that fail return
+// the error code sent by the agent.
+func ctlRequest(method string, apiPath string, query string, body io.Reader) (*http.Response, error) {
+	u := url.URL{Scheme: "http", Host: "wccagent", Path: apiPath, RawQuery: query}
+
+	request, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := ctlClient.Do(request)
+	if err != nil {
+		return nil, errors.New("can't connect to the agent, is it running?")
+	}
+
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+
+		var reply struct {
+			Error string `json:"error"`
+		}
+
+		json.NewDecoder(response.Body).Decode(&reply)
+		if reply.Error == "" {
+			reply.Error = response.Status
+		}
+
+		return nil, errors.New(reply.Error)
+	}
+
+	return response, nil
+}
+
+// Send a request, and decode the JSON reply
+func ctlCall(method string, apiPath string, reply interface{}) error {
+	response, err := ctlRequest(method, apiPath, "", nil)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if reply == nil {
+		return nil
+	}
+
+	return json.NewDecoder(response.Body).Decode(reply)
+}
+
+// Get the path of a board file, that is always absolute
+func ctlPath(file string) string {
+	return "/" + strings.TrimPrefix(file, "/")
+}
+
+func ctlStatus() error {
+	var status agent.AgentStatusInfo
+	if err := ctlCall("GET", "/api/v1/status", &status); err != nil {
+		return err
+	}
+
+	fmt.Printf("version: %s\n", status.Version)
+
+	if status.Board != nil {
+		fmt.Printf("board: %s\n", status.Board.Info)
+		fmt.Printf("new firmware: %t\n", status.Board.NewBuild)
+	} else {
+		fmt.Println("board: not attached")
+	}
+
+	fmt.Printf("lease holder: %s\n", status.LeaseHolder)
+	fmt.Printf("clients: %d\n", status.Clients)
+
+	return nil
+}
+
+func ctlLs(dir string) error {
+	var entries []agent.DirEntry
+	if err := ctlCall("GET", "/api/v1/dir"+ctlPath(dir), &entries); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("%s %10s %s %s\n", entry.Type, entry.Size, entry.Date, entry.Name)
+	}
+
+	return nil
+}
+
+func ctlGet(file string, local string) error {
+	response, err := ctlRequest("GET", "/api/v1/files"+ctlPath(file), "", nil)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if local == "" {
+		_, err = io.Copy(os.Stdout, response.Body)
+		return err
+	}
+
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(local, content, 0644)
+}
+
+func ctlPut(local string, file string) error {
+	var content []byte
+	var err error
+
+	if local == "-" {
+		content, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		content, err = ioutil.ReadFile(local)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	response, err := ctlRequest("PUT", "/api/v1/files"+ctlPath(file), "", bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+
+	return response.Body.Close()
+}
+
+// Show the console output, and send the console input, until the agent closes
+// the connection
+func ctlConsole() error {
+	response, err := ctlRequest("GET", "/events", "type=console", nil)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	go func() {
+		input := make([]byte, 1024)
+
+		for {
+			n, err := os.Stdin.Read(input)
+			if n > 0 {
+				if response, err := ctlRequest("POST", "/api/v1/console", "", bytes.NewReader(input[:n])); err != nil {
+					fmt.Fprintf(os.Stderr, "wccagent: console input rejected: %v\n", err)
+				} else {
+					response.Body.Close()
+				}
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		// Console output is sent as a JSON string
+		var output string
+		if json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &output) == nil {
+			os.Stdout.WriteString(output)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Run a ctl command. Returns the exit status.
+func ctl(args []string) int {
+	var err error
+
+	if len(args) == 0 {
+		ctlUsage()
+		return 1
+	}
+
+	switch {
+	case args[0] == "status" && len(args) == 1:
+		err = ctlStatus()
+
+	case args[0] == "ls" && len(args) <= 2:
+		dir := "/"
+		if len(args) == 2 {
+			dir = args[1]
+		}
+
+		err = ctlLs(dir)
+
+	case args[0] == "get" && (len(args) == 2 || len(args) == 3):
+		local := ""
+		if len(args) == 3 {
+			local = args[2]
+		}
+
+		err = ctlGet(args[1], local)
+
+	case args[0] == "put" && len(args) == 3:
+		err = ctlPut(args[1], args[2])
+
+	case args[0] == "reset" && len(args) == 1:
+		err = ctlCall("POST", "/api/v1/board/reset", nil)
+
+	case args[0] == "console" && len(args) == 1:
+		err = ctlConsole()
+
+	default:
+		ctlUsage()
+		return 1
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "wccagent: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
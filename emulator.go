@@ -0,0 +1,88 @@
+/*
+ * Whitecat Blocky Environment, Lua RTOS emulator command
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+/*
+
+wccagent emulator runs an emulated Lua RTOS board on a pseudo-terminal (see emulator/emulator.go),
+so the agent can be tried without a board. This is only available on linux:
+
+wccagent emulator
+
+The path of the pseudo-terminal is printed, and the IDE attaches the board sending it in the
+devices of attachIde. The agent only attaches pseudo-terminals if EmulatorDevices is enabled in
+wccagent.json:
+
+{"command": "attachIde", "arguments": {"protocolVersion": 2, "devices": [{"address": "/dev/pts/3"}]}}
+
+The emulator runs until it is interrupted. Its files are lost when it ends.
+
+*/
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/jyex/whitecat-create-agent/emulator"
+)
+
+func emulatorUsage() {
+	fmt.Println("wccagent: usage: wccagent emulator")
+}
+
+func emulate(args []string) int {
+	if runtime.GOOS != "linux" {
+		fmt.Fprintln(os.Stderr, "wccagent: emulator is only available on linux")
+		return 1
+	}
+
+	if len(args) != 0 {
+		emulatorUsage()
+		return 1
+	}
+
+	pty, err := emulator.OpenPty()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "wccagent: %v\n", err)
+		return 1
+	}
+
+	defer pty.Close()
+
+	fmt.Println("Lua RTOS emulator on " + pty.Name)
+
+	if err = emulator.New().RunPty(pty); err != nil {
+		fmt.Fprintf(os.Stderr, "wccagent: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,673 @@
+/*
+ * Whitecat Blocky Environment, Lua RTOS emulator
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package emulator
+
+/*
+
+The emulator is a Lua RTOS board without hardware, that speaks the console protocol used by the
+agent, so the agent can be tested on laptops and in CI. On Linux it is connected to a
+pseudo-terminal, see pty_linux.go, that the IDE attaches as a device:
+
+{"command": "attachIde", "arguments": {"protocolVersion": 2, "devices": [{"address": "/dev/pts/3"}]}}
+
+When the pseudo-terminal is opened the board is powered on, and it prints the boot banners of an
+ESP32:
+
+rst:0x1 (POWERON_RESET),boot:0x13 (SPI_FAST_FLASH_BOOT)
+...
+Booting Lua RTOS...
+
+Ctrl-D aborts the boot scripts, printing Lua RTOS-boot-scripts-aborted-ESP32. Otherwise
+/autorun.lua is run. Then the prompt is shown, and the commands are echoed. The board is powered
+off when the pseudo-terminal is closed, so the agent resets it by closing and opening it again.
+
+The emulator doesn't run Lua. It understands the statements sent by the agent:
+
+os.shell(true | false)
+os.ls("path"), os.mkdir("path"), os.remove("path")
+do local att = io.attributes("path"); print(att ~= nil and att.type == "file" | "directory"); end
+io.receive("path"), io.send("path")
+os.run()
+dofile("path"), require("module")
+print(...), with literal arguments
+
+Other statements are accepted, and do nothing. Files are transferred with io.receive and io.send
+in chunks: the receiver sends C and a new line, and the sender answers with the chunk length, in
+one byte, and the chunk. A chunk of length 0 ends the transfer.
+
+dofile runs the statements of a file, one per line. /_info.lua prints the board info of the
+emulator, see Info. Errors are printed as Lua errors, stdin:1: message.
+
+The files are kept in memory, and survive the resets. The file system is formatted on the first
+boot.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The prompt of the Lua RTOS console
+const Prompt = "/ > "
+
+// Time the boot scripts can be aborted with Ctrl-D
+const bootScriptsTimeout = 500 * time.Millisecond
+
+// Board info printed by /_info.lua
+const Info = `{"build":"emulator","commit":"emulator","board":"EMULATOR","subtype":"","brand":"WHITECAT","ota":false,"status":{"shell":false,"history":false}}`
+
+// Raised when the connection of the board is lost
+var errPowerOff = errors.New("power off")
+
+type file struct {
+	data     []byte
+	modified time.Time
+}
+
+// An emulated Lua RTOS board
+type Emulator struct {
+	mutex sync.Mutex
+
+	// File system, the files and the directories by path
+	files     map[string]*file
+	dirs      map[string]bool
+	formatted bool
+
+	// Code uploaded with os.run
+	code []byte
+}
+
+// A power cycle of the board, from the power on until the connection is lost
+type cycle struct {
+	emulator *Emulator
+
+	conn  io.ReadWriter
+	input chan byte
+	err   error
+
+	shell bool
+}
+
+func New() *Emulator {
+	return &Emulator{
+		files: make(map[string]*file),
+		dirs:  map[string]bool{"/": true},
+	}
+}
+
+// Get the content of a file of the board
+func (emulator *Emulator) ReadFile(name string) ([]byte, bool) {
+	emulator.mutex.Lock()
+	defer emulator.mutex.Unlock()
+
+	f, ok := emulator.files[cleanPath(name)]
+	if !ok {
+		return nil, false
+	}
+
+	return append([]byte(nil), f.data...), true
+}
+
+// Write a file of the board. The directory of the file must exist.
+func (emulator *Emulator) WriteFile(name string, data []byte) error {
+	emulator.mutex.Lock()
+	defer emulator.mutex.Unlock()
+
+	name = cleanPath(name)
+
+	if !emulator.dirs[path.Dir(name)] {
+		return fmt.Errorf("%s: No such file or directory", name)
+	}
+
+	if emulator.dirs[name] {
+		return fmt.Errorf("%s: Is a directory", name)
+	}
+
+	emulator.files[name] = &file{data: append([]byte(nil), data...), modified: time.Now()}
+
+	return nil
+}
+
+// Run the board on a connection, until it is lost. The board boots, and then
+// it runs the console. Returns the error that closed the connection.
+func (emulator *Emulator) Run(conn io.ReadWriter) (err error) {
+	c := &cycle{
+		emulator: emulator,
+		conn:     conn,
+		input:    make(chan byte, 1024),
+	}
+
+	go c.reader()
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			if recovered != errPowerOff {
+				panic(recovered)
+			}
+
+			err = c.err
+		}
+	}()
+
+	c.boot()
+	c.console()
+
+	return nil
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// Read the connection, until it fails
+func (c *cycle) reader() {
+	buffer := make([]byte, 1024)
+
+	for {
+		n, err := c.conn.Read(buffer)
+		for _, b := range buffer[:n] {
+			c.input <- b
+		}
+
+		if err != nil {
+			c.err = err
+			close(c.input)
+			return
+		}
+	}
+}
+
+func (c *cycle) read() byte {
+	b, ok := <-c.input
+	if !ok {
+		panic(errPowerOff)
+	}
+
+	return b
+}
+
+func (c *cycle) write(s string) {
+	c.conn.Write([]byte(s))
+}
+
+func (c *cycle) println(s string) {
+	c.write(s + "\r\n")
+}
+
+// Print the boot banners, and run the boot scripts unless they are aborted
+// with Ctrl-D
+func (c *cycle) boot() {
+	emulator := c.emulator
+
+	c.println("ets Jun  8 2016 00:22:57")
+	c.println("")
+	c.println("rst:0x1 (POWERON_RESET),boot:0x13 (SPI_FAST_FLASH_BOOT)")
+	c.println("configsip: 0, SPIWP:0xee")
+	c.println("mode:DIO, clock div:2")
+	c.println("entry 0x40078a58")
+	c.println("")
+
+	emulator.mutex.Lock()
+	formatted := emulator.formatted
+	emulator.mutex.Unlock()
+
+	if !formatted {
+		c.println("spiffs0 formatting ...")
+	}
+
+	c.println("Booting Lua RTOS...")
+	c.println("Lua RTOS emulator")
+	c.println("")
+
+	timeout := time.After(bootScriptsTimeout)
+
+	for {
+		select {
+		case b, ok := <-c.input:
+			if !ok {
+				panic(errPowerOff)
+			}
+
+			if b == 4 {
+				c.println("Lua RTOS-boot-scripts-aborted-ESP32")
+				c.booted()
+				return
+			}
+
+		case <-timeout:
+			if emulator.exists("/autorun.lua") {
+				c.dofile("/autorun.lua")
+			}
+
+			c.booted()
+			return
+		}
+	}
+}
+
+// Show the prompt at the end of the boot. The file system is formatted only
+// if the boot isn't interrupted.
+func (c *cycle) booted() {
+	c.emulator.mutex.Lock()
+	c.emulator.formatted = true
+	c.emulator.mutex.Unlock()
+
+	c.write(Prompt)
+}
+
+// Run the console: echo the input, and execute the lines
+func (c *cycle) console() {
+	var line []byte
+
+	for {
+		switch b := c.read(); b {
+		case '\r':
+			c.write("\r\n")
+			c.execute(strings.TrimSpace(string(line)))
+			c.write(Prompt)
+			line = nil
+
+		case '\n':
+			c.write("\n")
+
+		case 3:
+			// Ctrl-C discards the line
+			c.write("^C\r\n" + Prompt)
+			line = nil
+
+		case 8, 127:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				c.write("\b \b")
+			}
+
+		default:
+			if b >= ' ' || b == '\t' {
+				line = append(line, b)
+				c.conn.Write([]byte{b})
+			}
+		}
+	}
+}
+
+func (c *cycle) error(message string) {
+	c.println("stdin:1: " + message)
+}
+
+var (
+	shellStatement     = regexp.MustCompile(`^os\.shell\((true|false)\)$`)
+	lsStatement        = regexp.MustCompile(`^os\.ls\(\s*(?:"([^"]*)")?\s*\)$`)
+	mkdirStatement     = regexp.MustCompile(`^os\.mkdir\("([^"]*)"\)$`)
+	removeStatement    = regexp.MustCompile(`^os\.remove\("([^"]*)"\)$`)
+	attributeStatement = regexp.MustCompile(`^do local att = io\.attributes\("([^"]*)"\); print\(att ~= nil and att\.type == "(file|directory)"\); end$`)
+	receiveStatement   = regexp.MustCompile(`^io\.receive\("([^"]*)"\)$`)
+	sendStatement      = regexp.MustCompile(`^io\.send\("([^"]*)"\)$`)
+	runStatement       = regexp.MustCompile(`^os\.run\(\)$`)
+	dofileStatement    = regexp.MustCompile(`^dofile\("([^"]*)"\)$`)
+	printStatement     = regexp.MustCompile(`^print\((.*)\)$`)
+)
+
+// Execute a line, that can have several statements separated by ;
+func (c *cycle) execute(line string) {
+	for _, statement := range splitStatements(line) {
+		if !c.statement(statement) {
+			return
+		}
+	}
+}
+
+// Execute a statement. Returns false if it has failed.
+func (c *cycle) statement(statement string) bool {
+	emulator := c.emulator
+
+	if m := shellStatement.FindStringSubmatch(statement); m != nil {
+		c.shell = m[1] == "true"
+	} else if m := lsStatement.FindStringSubmatch(statement); m != nil {
+		entries, err := emulator.list(m[1])
+		if err != nil {
+			c.error(err.Error())
+			return false
+		}
+
+		for _, entry := range entries {
+			c.println(entry)
+		}
+	} else if m := mkdirStatement.FindStringSubmatch(statement); m != nil {
+		if err := emulator.mkdir(m[1]); err != nil {
+			c.error(err.Error())
+			return false
+		}
+	} else if m := removeStatement.FindStringSubmatch(statement); m != nil {
+		if err := emulator.remove(m[1]); err != nil {
+			c.error(err.Error())
+			return false
+		}
+	} else if m := attributeStatement.FindStringSubmatch(statement); m != nil {
+		kind := emulator.kind(m[1])
+		c.println(fmt.Sprint(kind == m[2]))
+	} else if m := receiveStatement.FindStringSubmatch(statement); m != nil {
+		name := cleanPath(m[1])
+		if !emulator.exists(path.Dir(name)) {
+			c.error(name + ": No such file or directory")
+			return false
+		}
+
+		if err := emulator.WriteFile(name, c.receive()); err != nil {
+			c.println("false")
+			return false
+		}
+
+		c.println("true")
+	} else if m := sendStatement.FindStringSubmatch(statement); m != nil {
+		data, ok := emulator.ReadFile(m[1])
+		if !ok {
+			c.error(cleanPath(m[1]) + ": No such file or directory")
+			return false
+		}
+
+		c.send(data)
+	} else if runStatement.MatchString(statement) {
+		code := c.receive()
+
+		emulator.mutex.Lock()
+		emulator.code = code
+		emulator.mutex.Unlock()
+	} else if statement == "_code()" {
+		emulator.mutex.Lock()
+		code := emulator.code
+		emulator.mutex.Unlock()
+
+		return c.run(code)
+	} else if m := dofileStatement.FindStringSubmatch(statement); m != nil {
+		return c.dofile(m[1])
+	} else if m := printStatement.FindStringSubmatch(statement); m != nil {
+		values, err := literals(m[1])
+		if err != nil {
+			c.error(err.Error())
+			return false
+		}
+
+		c.println(strings.Join(values, "\t"))
+	}
+
+	return true
+}
+
+// Run the statements of a file. /_info.lua prints the board info.
+func (c *cycle) dofile(name string) bool {
+	name = cleanPath(name)
+
+	code, ok := c.emulator.ReadFile(name)
+	if !ok {
+		c.error("cannot open " + name)
+		return false
+	}
+
+	if name == "/_info.lua" {
+		c.println(Info)
+		return true
+	}
+
+	return c.run(code)
+}
+
+// Run code, one line at a time
+func (c *cycle) run(code []byte) bool {
+	for _, line := range strings.Split(string(code), "\n") {
+		for _, statement := range splitStatements(strings.TrimSpace(line)) {
+			if !c.statement(statement) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Receive data in chunks, for io.receive and os.run
+func (c *cycle) receive() []byte {
+	var data []byte
+
+	for {
+		c.println("C")
+
+		length := int(c.read())
+		if length == 0 {
+			return data
+		}
+
+		for i := 0; i < length; i++ {
+			data = append(data, c.read())
+		}
+	}
+}
+
+// Send data in chunks, for io.send
+func (c *cycle) send(data []byte) {
+	for {
+		// Wait until the receiver asks for a chunk
+		for c.read() != 'C' {
+		}
+
+		for c.read() != '\n' {
+		}
+
+		length := len(data)
+		if length > 255 {
+			length = 255
+		}
+
+		c.conn.Write(append([]byte{byte(length)}, data[:length]...))
+		data = data[length:]
+
+		if length == 0 {
+			return
+		}
+	}
+}
+
+// Split a line in statements, separated by ; outside the strings
+func splitStatements(line string) []string {
+	var statements []string
+	var quote rune
+
+	start := 0
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ';':
+			statements = append(statements, strings.TrimSpace(line[start:i]))
+			start = i + 1
+		}
+	}
+
+	statements = append(statements, strings.TrimSpace(line[start:]))
+
+	// Skip the empty statements
+	result := statements[:0]
+	for _, statement := range statements {
+		if statement != "" {
+			result = append(result, statement)
+		}
+	}
+
+	return result
+}
+
+var literalPattern = regexp.MustCompile(`^\s*("[^"]*"|'[^']*'|-?[0-9.]+|true|false|nil)\s*(,|$)`)
+
+// Get the values of a list of literals, as printed by print
+func literals(list string) ([]string, error) {
+	var values []string
+
+	for strings.TrimSpace(list) != "" {
+		m := literalPattern.FindStringSubmatch(list)
+		if m == nil {
+			return nil, errors.New("only literals can be printed by the emulator")
+		}
+
+		value := m[1]
+		if strings.HasPrefix(value, "\"") || strings.HasPrefix(value, "'") {
+			value = value[1 : len(value)-1]
+		}
+
+		values = append(values, value)
+		list = list[len(m[0]):]
+	}
+
+	return values, nil
+}
+
+/*
+ * File system
+ */
+
+// Get the kind of a path: file, directory, or "" if it doesn't exist
+func (emulator *Emulator) kind(name string) string {
+	emulator.mutex.Lock()
+	defer emulator.mutex.Unlock()
+
+	name = cleanPath(name)
+
+	if emulator.dirs[name] {
+		return "directory"
+	}
+
+	if _, ok := emulator.files[name]; ok {
+		return "file"
+	}
+
+	return ""
+}
+
+func (emulator *Emulator) exists(name string) bool {
+	return emulator.kind(name) != ""
+}
+
+// List a directory, as printed by os.ls: type, size, date and name,
+// separated by tabs
+func (emulator *Emulator) list(dir string) ([]string, error) {
+	emulator.mutex.Lock()
+	defer emulator.mutex.Unlock()
+
+	dir = cleanPath(dir)
+	if !emulator.dirs[dir] {
+		return nil, fmt.Errorf("%s: No such file or directory", dir)
+	}
+
+	var entries []string
+
+	for name := range emulator.dirs {
+		if name != "/" && path.Dir(name) == dir {
+			entries = append(entries, "d\t\t\t"+path.Base(name))
+		}
+	}
+
+	for name, f := range emulator.files {
+		if path.Dir(name) == dir {
+			entries = append(entries, fmt.Sprintf("f\t%d\t%s\t%s", len(f.data), f.modified.Format("Jan 02 2006 15:04"), path.Base(name)))
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entryName(entries[i]) < entryName(entries[j])
+	})
+
+	return entries, nil
+}
+
+func entryName(entry string) string {
+	return entry[strings.LastIndex(entry, "\t")+1:]
+}
+
+func (emulator *Emulator) mkdir(dir string) error {
+	emulator.mutex.Lock()
+	defer emulator.mutex.Unlock()
+
+	dir = cleanPath(dir)
+
+	if _, ok := emulator.files[dir]; ok || emulator.dirs[dir] {
+		return fmt.Errorf("%s: File exists", dir)
+	}
+
+	if !emulator.dirs[path.Dir(dir)] {
+		return fmt.Errorf("%s: No such file or directory", dir)
+	}
+
+	emulator.dirs[dir] = true
+
+	return nil
+}
+
+// Remove a file, or an empty directory
+func (emulator *Emulator) remove(name string) error {
+	emulator.mutex.Lock()
+	defer emulator.mutex.Unlock()
+
+	name = cleanPath(name)
+
+	if _, ok := emulator.files[name]; ok {
+		delete(emulator.files, name)
+		return nil
+	}
+
+	if !emulator.dirs[name] || name == "/" {
+		return fmt.Errorf("%s: No such file or directory", name)
+	}
+
+	for other := range emulator.dirs {
+		if other != name && path.Dir(other) == name {
+			return fmt.Errorf("%s: Directory not empty", name)
+		}
+	}
+
+	for other := range emulator.files {
+		if path.Dir(other) == name {
+			return fmt.Errorf("%s: Directory not empty", name)
+		}
+	}
+
+	delete(emulator.dirs, name)
+
+	return nil
+}
@@ -0,0 +1,186 @@
+//go:build linux
+// +build linux
+
+/*
+ * Whitecat Blocky Environment, Lua RTOS emulator pseudo-terminal
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package emulator
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Interval between the checks of the pseudo-terminal state, while the board
+// is powered off
+const ptyPollInterval = 10 * time.Millisecond
+
+// Time between the opening of the pseudo-terminal and the boot banners, so the
+// agent can configure the terminal
+const powerOnDelay = 100 * time.Millisecond
+
+// A pseudo-terminal. The emulated board is connected to its master side, and
+// the agent opens the slave side.
+type Pty struct {
+	// Path of the slave side
+	Name string
+
+	master *os.File
+
+	// Input read while waiting for the slave side to be opened
+	pending []byte
+}
+
+func ioctl(fd int, request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// Create a pseudo-terminal in raw mode
+func OpenPty() (*Pty, error) {
+	// The master side is opened in non-blocking mode, so its reads can have
+	// a deadline
+	fd, err := syscall.Open("/dev/ptmx", syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: "/dev/ptmx", Err: err}
+	}
+
+	var number uint32
+	var unlock int32
+	var termios syscall.Termios
+
+	if err = ioctl(fd, syscall.TIOCGPTN, unsafe.Pointer(&number)); err == nil {
+		err = ioctl(fd, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock))
+	}
+
+	// The terminal settings of the slave side are changed through the master
+	// side, and they are kept when the slave side is opened again
+	if err == nil {
+		err = ioctl(fd, syscall.TCGETS, unsafe.Pointer(&termios))
+	}
+
+	if err == nil {
+		termios.Iflag = 0
+		termios.Oflag = 0
+		termios.Lflag = 0
+		termios.Cflag = termios.Cflag&^(syscall.CSIZE|syscall.PARENB) | syscall.CS8 | syscall.CREAD | syscall.CLOCAL
+
+		err = ioctl(fd, syscall.TCSETS, unsafe.Pointer(&termios))
+	}
+
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	pty := &Pty{
+		Name:   "/dev/pts/" + strconv.Itoa(int(number)),
+		master: os.NewFile(uintptr(fd), "/dev/ptmx"),
+	}
+
+	// Open and close the slave side, so the master side sees the hang up
+	// until the agent opens it
+	slave, err := os.OpenFile(pty.Name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		pty.Close()
+		return nil, err
+	}
+
+	slave.Close()
+
+	return pty, nil
+}
+
+func (pty *Pty) Read(b []byte) (int, error) {
+	if len(pty.pending) > 0 {
+		n := copy(b, pty.pending)
+		pty.pending = pty.pending[n:]
+
+		return n, nil
+	}
+
+	return pty.master.Read(b)
+}
+
+func (pty *Pty) Write(b []byte) (int, error) {
+	return pty.master.Write(b)
+}
+
+func (pty *Pty) Close() error {
+	return pty.master.Close()
+}
+
+// Wait until the slave side is opened
+func (pty *Pty) waitOpen() error {
+	buffer := make([]byte, 1024)
+
+	for {
+		pty.master.SetReadDeadline(time.Now().Add(ptyPollInterval))
+
+		n, err := pty.master.Read(buffer)
+		pty.pending = append(pty.pending, buffer[:n]...)
+
+		switch {
+		case err == nil || errors.Is(err, os.ErrDeadlineExceeded):
+			// The slave side is open
+			return pty.master.SetReadDeadline(time.Time{})
+
+		case errors.Is(err, syscall.EIO):
+			// Nobody has the slave side open
+			time.Sleep(ptyPollInterval)
+
+		default:
+			return err
+		}
+	}
+}
+
+// Run the board on a pseudo-terminal. The board is powered on when the slave
+// side is opened, and it is powered off when it is closed. Returns when the
+// pseudo-terminal is closed.
+func (emulator *Emulator) RunPty(pty *Pty) error {
+	for {
+		if err := pty.waitOpen(); err != nil {
+			return err
+		}
+
+		time.Sleep(powerOnDelay)
+
+		if err := emulator.Run(pty); !errors.Is(err, syscall.EIO) {
+			return err
+		}
+	}
+}
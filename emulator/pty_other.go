@@ -0,0 +1,52 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * Whitecat Blocky Environment, Lua RTOS emulator pseudo-terminal
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package emulator
+
+import "errors"
+
+// Pseudo-terminals are only supported on Linux. Use Run on other systems.
+type Pty struct {
+	Name string
+}
+
+func OpenPty() (*Pty, error) {
+	return nil, errors.New("pseudo-terminals are only supported on Linux")
+}
+
+func (pty *Pty) Close() error {
+	return nil
+}
+
+func (emulator *Emulator) RunPty(pty *Pty) error {
+	return errors.New("pseudo-terminals are only supported on Linux")
+}
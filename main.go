@@ -30,6 +30,8 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -39,53 +41,41 @@ import (
 	"os/user"
 	"path"
 	"runtime"
+	"strings"
 
+	"github.com/jyex/whitecat-create-agent/agent"
 	"github.com/kardianos/osext"
 )
 
-var Version string = "2.2"
 var Options []string
 
 var AppFolder = "/"
 var AppDataFolder string = "/"
-var AppDataTmpFolder string = "/tmp"
 var AppFileName = ""
 
+// Settings of wccagent.json. The agent settings are described in agent/agent.go.
 type Configuration struct {
-	BaseURL     string
-	SupportURL  string
-	DownloadURL string
-	BaseIdeURL  string
-	HttpProxy   string
-	HttpsProxy  string
-}
-
-/* "http://whitecatboard.org" */
-var BaseURL = "http://localhost:8082"
-
-/* "https://raw.githubusercontent.com/whitecatboard/Lua-RTOS-ESP32/master" */
-var BaseSupportURL = BaseURL + "/support"
+	agent.Config
 
-/* "http://downloads.whitecatboard.org" */
-var BaseDownloadURL = BaseURL + "/download"
-
-/* "https://ide.whitecatboard.org" */
-var BaseIdeURL = BaseURL + "/ide"
-
-var LastBuildURL = BaseURL + "/lastbuildv2.php"
-var FirmwareURL = BaseURL + "/firmwarev2.php"
-var SupportedBoardsURL = BaseSupportURL + "/boards/boards.json"
-var HttpProxy = ""
-var HttpsProxy = ""
+	HttpProxy  string
+	HttpsProxy string
+}
 
 func usage() {
-	fmt.Println("wccagent: usage: wccagent [-b | -lf | -lc | -ui | -v]")
+	fmt.Println("wccagent: usage: wccagent [-b | -lf | -lc | -ui | -token | -v]")
+	fmt.Println("       wccagent ctl command [arguments]")
+	fmt.Println("       wccagent cert install | uninstall")
+	fmt.Println("       wccagent emulator")
 	fmt.Println("")
 	fmt.Println(" -b : run in background (only windows)")
 	fmt.Println(" -lf: log to file")
 	fmt.Println(" -lc: log to console")
 	fmt.Println(" -ui: enable the user interface")
+	fmt.Println(" -token: create a token for the REST API")
 	fmt.Println(" -v : show version")
+	fmt.Println(" ctl: control a running agent, see wccagent ctl")
+	fmt.Println(" cert: trust the certificates of the secure websocket server (only linux)")
+	fmt.Println(" emulator: run an emulated Lua RTOS board on a pseudo-terminal (only linux)")
 }
 
 func restart() {
@@ -98,18 +88,59 @@ func restart() {
 	}
 }
 
-func start(ui bool, background bool) {
+// Start the agent
+func startAgent(a *agent.Agent) {
+	if err := a.Start(context.Background()); err != nil {
+		fmt.Println("wccagent: can't start the agent: ", err)
+		os.Exit(1)
+	}
+}
+
+func start(a *agent.Agent, ui bool, background bool) {
 	if ui {
 		if background {
 			restart()
 		} else {
-			setupSysTray()
+			setupSysTray(a)
 		}
 	} else {
-		exitChan := make(chan int)
+		startAgent(a)
 
-		go webSocketStart(exitChan)
-		<-exitChan
+		go consolePairing(a)
+		<-a.Done()
+	}
+}
+
+// Ask the user to approve the pairing requests from the console, when the
+// agent runs without user interface
+func consolePairing(a *agent.Agent) {
+	lines := make(chan string)
+
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+
+		close(lines)
+	}()
+
+	for {
+		request := a.NextPairingRequest()
+		if request == nil {
+			return
+		}
+
+		fmt.Printf("Pairing request from %s with code %s. Approve? [y/N] ", request.Origin, request.Code)
+
+		select {
+		case line, ok := <-lines:
+			request.Approve(ok && strings.EqualFold(strings.TrimSpace(line), "y"))
+
+		case <-request.Cancelled():
+			fmt.Println("")
+			fmt.Println("Pairing request cancelled")
+		}
 	}
 }
 
@@ -119,11 +150,31 @@ func main() {
 	withLogConsole := false
 	withUI := false
 	withBackground := false
+	withToken := false
 	ok := true
 	i := 0
 
+	// wccagent ctl controls a running agent, wccagent cert installs the
+	// certificates, and wccagent emulator runs an emulated board, their
+	// arguments are not options
+	args := os.Args
+	var ctlArgs []string
+	var certArgs []string
+	var emulatorArgs []string
+
+	if len(args) > 1 && args[1] == "ctl" {
+		ctlArgs = args[2:]
+		args = args[:1]
+	} else if len(args) > 1 && args[1] == "cert" {
+		certArgs = args[2:]
+		args = args[:1]
+	} else if len(args) > 1 && args[1] == "emulator" {
+		emulatorArgs = args[2:]
+		args = args[:1]
+	}
+
 	// Get arguments and process arguments
-	for _, arg := range os.Args {
+	for _, arg := range args {
 		includeInRespawn = true
 
 		switch arg {
@@ -139,9 +190,12 @@ func main() {
 			withLogConsole = true
 		case "-ui":
 			withUI = true
+		case "-token":
+			includeInRespawn = false
+			withToken = true
 		case "-v":
 			includeInRespawn = false
-			fmt.Println(Version)
+			fmt.Println(agent.Version)
 			os.Exit(0)
 		default:
 			if i > 0 {
@@ -175,10 +229,32 @@ func main() {
 		AppDataFolder = path.Join(usr.HomeDir, ".whitecat-create-agent")
 	}
 
-	AppDataTmpFolder = path.Join(AppDataFolder, "tmp")
-
 	_ = os.Mkdir(AppDataFolder, 0755)
-	_ = os.Mkdir(AppDataTmpFolder, 0755)
+	_ = os.Mkdir(path.Join(AppDataFolder, "tmp"), 0755)
+
+	if ctlArgs != nil {
+		os.Exit(ctl(ctlArgs))
+	}
+
+	if certArgs != nil {
+		os.Exit(cert(certArgs))
+	}
+
+	if emulatorArgs != nil {
+		os.Exit(emulate(emulatorArgs))
+	}
+
+	// Create a token for the REST API
+	if withToken {
+		token, err := agent.New(agent.Config{DataFolder: AppDataFolder}).NewToken()
+		if err != nil {
+			fmt.Println("wccagent: can't create token: ", err)
+			os.Exit(1)
+		}
+
+		fmt.Println(token)
+		os.Exit(0)
+	}
 
 	// Get where program is executed
 	execFolder, err := osext.ExecutableFolder()
@@ -204,12 +280,7 @@ func main() {
 
 	// Set defalt settings
 	configuration := Configuration{
-		BaseURL:     BaseURL,
-		SupportURL:  BaseSupportURL,
-		DownloadURL: BaseDownloadURL,
-		BaseIdeURL:  BaseIdeURL,
-		HttpProxy:   HttpProxy,
-		HttpsProxy:  HttpsProxy,
+		Config: agent.DefaultConfig(),
 	}
 
 	inifile := path.Join(AppDataFolder, "wccagent.json")
@@ -222,23 +293,20 @@ func main() {
 		if err != nil {
 			panic(err)
 		} else {
-			BaseURL = configuration.BaseURL
-			BaseSupportURL = configuration.SupportURL
-			BaseDownloadURL = configuration.DownloadURL
-			BaseIdeURL = configuration.BaseIdeURL
-			HttpProxy = configuration.HttpProxy
-			HttpsProxy = configuration.HttpsProxy
-			LastBuildURL = BaseURL + "/lastbuildv2.php"
-			FirmwareURL = BaseURL + "/firmwarev2.php"
-			SupportedBoardsURL = BaseSupportURL + "/boards/boards.json"
-			os.Setenv("HTTP_PROXY", HttpProxy)
-			os.Setenv("HTTPS_PROXY", HttpsProxy)
-			log.Println("HTTP_PROXY: ", HttpProxy)
-			log.Println("HTTPS_PROXY: ", HttpsProxy)
+			os.Setenv("HTTP_PROXY", configuration.HttpProxy)
+			os.Setenv("HTTPS_PROXY", configuration.HttpsProxy)
+			log.Println("HTTP_PROXY: ", configuration.HttpProxy)
+			log.Println("HTTPS_PROXY: ", configuration.HttpsProxy)
 		}
 	} else if os.IsNotExist(err) {
 		// TODO: write default settings
 	}
 
-	start(withUI, withBackground)
+	configuration.DataFolder = AppDataFolder
+
+	log.Println("AppFolder: ", AppFolder)
+	log.Println("AppFileName: ", AppFileName)
+	log.Println("AppDataFolder: ", AppDataFolder)
+
+	start(agent.New(configuration.Config), withUI, withBackground)
 }
@@ -31,28 +31,42 @@ package main
 
 import (
 	"github.com/getlantern/systray"
+	"github.com/jyex/whitecat-create-agent/agent"
 	"github.com/skratchdot/open-golang/open"
 	"os"
+	"sort"
+	"strings"
 )
 
-func setupSysTray() {
-	systray.Run(setupSysTrayAgent)
+func setupSysTray(a *agent.Agent) {
+	systray.Run(func() {
+		setupSysTrayAgent(a)
+	})
 }
 
-func setupSysTrayAgent() {
+func setupSysTrayAgent(a *agent.Agent) {
 	systray.SetIcon(iconAgent)
 
 	mGoToIde := systray.AddMenuItem("Open The Witecat IDE", "")
 	//mUpdate := systray.AddMenuItem("Search for updates", "")
 	mQuit := systray.AddMenuItem("Quit", "")
 	mRestart := systray.AddMenuItem("Restart", "")
-	systray.AddMenuItem("Current version: " + Version, "")
+	systray.AddMenuItem("Current version: " + agent.Version, "")
+
+	mApprovePairing := systray.AddMenuItem("No pairing requests", "")
+	mRejectPairing := systray.AddMenuItem("Reject pairing request", "")
+
+	mBoards := systray.AddMenuItem("No board attached", "")
+	mBoards.Disable()
+
+	go trayPairing(a, mApprovePairing, mRejectPairing)
+	go trayBoards(a, mBoards)
 
 	go func() {
 		for {
 			select {
 			case <-mGoToIde.ClickedCh:
-				open.Run(BaseIdeURL)
+				open.Run(a.Config().BaseIdeURL)
 
 			//case <-mUpdate.ClickedCh:
 			//	if (runtime.GOOS == "darwin") {
@@ -73,7 +87,80 @@ func setupSysTrayAgent() {
 		}
 	}()
 
-	exitChan := make(chan int)
+	startAgent(a)
+}
+
+// Ask the user to approve the pairing requests from the tray menu
+func trayPairing(a *agent.Agent, mApprove *systray.MenuItem, mReject *systray.MenuItem) {
+	for {
+		mApprove.SetTitle("No pairing requests")
+		mApprove.Disable()
+		mReject.Disable()
+
+		request := a.NextPairingRequest()
+		if request == nil {
+			return
+		}
+
+		mApprove.SetTitle("Approve pairing code " + request.Code + " (" + request.Origin + ")")
+		mApprove.Enable()
+		mReject.Enable()
+
+		select {
+		case <-mApprove.ClickedCh:
+			request.Approve(true)
+
+		case <-mReject.ClickedCh:
+			request.Approve(false)
+
+		case <-request.Cancelled():
+		}
+	}
+}
+
+// Sink for the board state notifications, that are shown in the tray menu
+type trayBoardsSink chan agent.BoardStateInfo
+
+func (sink trayBoardsSink) Handle(event agent.Event) {
+	if info, ok := event.Info.(agent.BoardStateInfo); ok && info.Id != "" {
+		select {
+		case sink <- info:
+		default:
+		}
+	}
+}
+
+// Show the state of the attached boards in the tray menu
+func trayBoards(a *agent.Agent, mBoards *systray.MenuItem) {
+	sink := make(trayBoardsSink, 64)
+	defer a.Subscribe(sink, "boardState")()
+
+	states := make(map[string]agent.BoardState)
+
+	for {
+		select {
+		case info := <-sink:
+			if info.State == agent.BoardDetached {
+				delete(states, info.Id)
+			} else {
+				states[info.Id] = info.State
+			}
+
+		case <-a.Done():
+			return
+		}
+
+		if len(states) == 0 {
+			mBoards.SetTitle("No board attached")
+			continue
+		}
+
+		var boards []string
+		for id, state := range states {
+			boards = append(boards, id+": "+string(state))
+		}
 
-	go webSocketStart(exitChan)
+		sort.Strings(boards)
+		mBoards.SetTitle("Boards: " + strings.Join(boards, ", "))
+	}
 }